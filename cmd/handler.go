@@ -0,0 +1,154 @@
+package main
+
+import (
+	"at/internal/config"
+	"at/internal/connect"
+	"at/internal/forwarded"
+	"at/internal/pages"
+	"at/internal/proxyproto"
+	"at/internal/ratelimit"
+	"at/internal/route"
+	"at/internal/scan/clienthello"
+	"at/internal/scan/http1"
+	"at/internal/server/http"
+	"at/internal/server/passthrough"
+	"at/internal/server/tcp"
+	"at/internal/sniff"
+	"context"
+	"crypto/tls"
+	"errors"
+	"github.com/indigo-web/utils/arena"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+// handler serves a single accepted connection by the listener's mode
+type handler struct {
+	cfg    *config.Listener
+	routes *route.Routes
+	pool   *connect.Pool
+	pages  *pages.Pages
+	// origin describes the client connection to upstreams, that want PROXY protocol
+	origin proxyproto.Header
+	// requests keeps buckets of the listener's request rate limit. It's shared by all the
+	// connections and survives reloads
+	requests *ratelimit.Limiter
+}
+
+// http forwards HTTP requests. The TLS is terminated first, if the config is set
+func (h *handler) http(ctx context.Context, conn net.Conn, tlsConfig *tls.Config) {
+	proto := "http"
+	if tlsConfig != nil {
+		tlsConn, err := handshake(conn, tlsConfig, h.cfg.Timeouts.Read)
+		if err != nil {
+			log.Println("error: tls handshake:", conn.RemoteAddr(), err)
+			_ = conn.Close()
+			return
+		}
+
+		if sni := tlsConn.ConnectionState().ServerName; len(sni) > 0 {
+			h.origin.Authority = sni
+		}
+
+		conn, proto = tlsConn, "https"
+	}
+
+	scanner := http1.NewScanner()
+	if h.cfg.Strict {
+		scanner = http1.NewStrictScanner()
+	}
+
+	var injector *forwarded.Injector
+	// the config is validated already
+	if fwd, _ := h.cfg.Forwarded.Config(proto); fwd != nil {
+		injector = forwarded.NewInjector(fwd)
+	}
+
+	// the config is validated already
+	allowlist, _ := h.cfg.Connect.Allowlist()
+	limit, _ := h.cfg.RateLimit.Requests.Rule(h.requests)
+
+	server := http.New(
+		h.client(conn), scanner, h.routes, h.pool, h.newUpstream, h.buffer(), h.pages, proto == "https",
+		injector, h.origin, allowlist, limit, h.cfg.Timeouts.Tunnel,
+	)
+	server.Serve(ctx, h.cfg.Timeouts.Drain)
+}
+
+// passthrough forwards TLS connections by SNI
+func (h *handler) passthrough(conn net.Conn) *passthrough.Server {
+	return passthrough.New(
+		h.client(conn), clienthello.NewScanner(), h.routes, h.pool, h.newUpstream, h.buffer(), h.origin,
+		h.cfg.Timeouts.Tunnel,
+	)
+}
+
+// sniff tells the protocol by first bytes. TLS connections are passed through, if there's
+// a passthrough route for the SNI, and terminated otherwise. Anything, that is neither HTTP
+// nor TLS, goes to the raw upstream
+func (h *handler) sniff(ctx context.Context, conn net.Conn, tlsConfig *tls.Config) {
+	protocol, sniffed, err := sniff.Detect(conn, h.cfg.Timeouts.Peek)
+	if err != nil {
+		if !errors.Is(err, io.EOF) {
+			log.Println("error: sniff:", conn.RemoteAddr(), err)
+		}
+
+		_ = conn.Close()
+		return
+	}
+
+	switch protocol {
+	case sniff.HTTP:
+		h.http(ctx, sniffed, nil)
+	case sniff.TLS:
+		sni, err := sniff.ServerName(sniffed, h.cfg.Timeouts.Read)
+		if err != nil {
+			log.Println("error: sniff:", conn.RemoteAddr(), err)
+			_ = conn.Close()
+			return
+		}
+
+		if _, found := passthrough.Lookup(h.routes.Table(), sni); found || tlsConfig == nil {
+			h.passthrough(sniffed).Serve()
+			return
+		}
+
+		h.http(ctx, sniffed, tlsConfig)
+	default:
+		upstream, found := h.routes.Table().Raw(h.cfg.Raw)
+		if !found {
+			_ = conn.Close()
+			return
+		}
+
+		h.passthrough(sniffed).ServeRaw(upstream)
+	}
+}
+
+func (h *handler) client(conn net.Conn) tcp.Client {
+	return tcp.NewClient(conn, h.cfg.Timeouts.Read, h.cfg.Timeouts.Write, make([]byte, h.cfg.Buffers.Client))
+}
+
+// newUpstream wraps connections to upstreams. They're pooled and might be reused by other
+// listeners, so their timeouts are pool's rather than listener's
+func (h *handler) newUpstream(conn net.Conn) tcp.Client {
+	read, write := h.pool.Timeouts()
+
+	return tcp.NewClient(conn, read, write, make([]byte, h.cfg.Buffers.Upstream))
+}
+
+func (h *handler) buffer() *arena.Arena[byte] {
+	return arena.NewArena[byte](h.cfg.Buffers.ArenaInitial, h.cfg.Buffers.ArenaMax)
+}
+
+// handshake must be completed in the timeout
+func handshake(conn net.Conn, config *tls.Config, timeout time.Duration) (*tls.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	tlsConn := tls.Server(conn, config)
+
+	return tlsConn, tlsConn.HandshakeContext(ctx)
+}
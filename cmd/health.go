@@ -0,0 +1,32 @@
+package main
+
+import (
+	"at/internal/health"
+	"at/internal/route"
+	"context"
+)
+
+// healthChecks runs active health checks of the current routing table. On reload, checks
+// of the old table are stopped, as its backends aren't used anymore
+type healthChecks struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newHealthChecks(ctx context.Context) *healthChecks {
+	return &healthChecks{ctx: ctx}
+}
+
+// Start checks upstreams of the table, stopping checks of the previous one
+func (h *healthChecks) Start(table *route.Table) {
+	if h.cancel != nil {
+		h.cancel()
+	}
+
+	var ctx context.Context
+	ctx, h.cancel = context.WithCancel(h.ctx)
+
+	for _, upstream := range table.Upstreams() {
+		go health.Run(ctx, upstream.Check, upstream.Balancer.Backends())
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"at/internal/config"
+	"io"
+	"log"
+	"os"
+)
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
+
+// setupLogging points the standard logger to the configured output. The returned closer
+// must be closed on exit
+func setupLogging(cfg config.Logging) (io.Closer, error) {
+	flags := 0
+	if cfg.Timestamps {
+		flags = log.LstdFlags
+	}
+
+	log.SetFlags(flags)
+
+	switch cfg.Output {
+	case "stderr":
+		log.SetOutput(os.Stderr)
+	case "stdout":
+		log.SetOutput(os.Stdout)
+	default:
+		file, err := os.OpenFile(cfg.Output, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			return nil, err
+		}
+
+		log.SetOutput(file)
+
+		return file, nil
+	}
+
+	return nopCloser{}, nil
+}
@@ -1,44 +1,197 @@
 package main
 
 import (
+	"at/internal/certs"
+	"at/internal/config"
 	"at/internal/connect"
-	"at/internal/scan/http1"
-	"at/internal/server/http"
+	"at/internal/pages"
+	"at/internal/proxyproto"
+	"at/internal/ratelimit"
+	"at/internal/route"
 	"at/internal/server/tcp"
 	"context"
+	"crypto/tls"
+	"flag"
 	"fmt"
-	"github.com/indigo-web/utils/arena"
+	"log"
 	"net"
-	"time"
-)
-
-const (
-	network       = "tcp4"
-	addr          = "0.0.0.0:8000"
-	readDeadline  = 3 * time.Minute
-	writeDeadline = 1 * time.Minute
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
 )
 
 func main() {
-	sock, err := net.Listen(network, addr)
+	configPath := flag.String("config", "at.yaml", "path to the configuration file")
+	checkConfig := flag.Bool("check-config", false, "validate the configuration file and exit")
+	watchInterval := flag.Duration("watch", 0, "reload the configuration on file change, checking it with this interval")
+	flag.Parse()
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error: config:", err)
+		os.Exit(1)
+	}
+
+	if *checkConfig {
+		fmt.Println("config is valid")
+		return
+	}
+
+	logs, err := setupLogging(cfg.Logging)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error: logging:", err)
+		os.Exit(1)
+	}
+
+	defer logs.Close()
+
+	table, err := cfg.Table()
 	if err != nil {
-		fmt.Println("error: listen:", err)
+		log.Println("error: routes:", err)
 		return
 	}
 
-	fmt.Println("Starting on", network, addr)
+	// the first SIGTERM or SIGINT starts graceful shutdown, the second one terminates the
+	// process immediately, as the handler is reset
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		<-ctx.Done()
+		stop()
+		log.Println("shutting down gracefully")
+	}()
+
+	errorPages, err := cfg.Pages()
+	if err != nil {
+		log.Println("error: error pages:", err)
+		return
+	}
 
-	err = tcp.Run(context.Background(), sock, func(conn net.Conn) {
-		client := tcp.NewClient(conn, readDeadline, writeDeadline, make([]byte, 4096))
-		scanner := http1.NewScanner()
-		connector := connect.New(func(conn net.Conn) tcp.Client {
-			return tcp.NewClient(conn, readDeadline, writeDeadline, make([]byte, 4096))
-		})
-		buffer := arena.NewArena[byte](4*1024 /* 4kb */, 64*1024 /* 64kb */)
-		server := http.New(client, scanner, connector, buffer)
-		server.Serve()
+	routes := route.NewRoutes(table)
+	checks := newHealthChecks(ctx)
+	checks.Start(table)
+	pool := connect.NewPool(connect.Limits{
+		MaxIdlePerHost: cfg.Pool.MaxIdlePerHost,
+		MaxPerHost:     cfg.Pool.MaxPerHost,
+		IdleTimeout:    cfg.Pool.IdleTimeout,
+		Wait:           cfg.Pool.Wait,
+		ConnectTimeout: cfg.Pool.ConnectTimeout,
+		ReadTimeout:    cfg.Pool.ReadTimeout,
+		WriteTimeout:   cfg.Pool.WriteTimeout,
 	})
+	go pool.Run(ctx)
+
+	reload := newReloader(*configPath, cfg, routes, checks, errorPages)
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go reload.Run(ctx, hangups, *watchInterval)
+
+	wg := new(sync.WaitGroup)
+
+	for _, listener := range cfg.Listeners {
+		sock, err := net.Listen(listener.Network, listener.Addr)
+		if err != nil {
+			log.Println("error: listen:", err)
+			return
+		}
+
+		tlsConfig, err := newTLSConfig(ctx, listener.TLS)
+		if err != nil {
+			log.Println("error: tls:", err)
+			return
+		}
+
+		log.Println("Starting on", listener.Network, listener.Addr)
+
+		wg.Add(1)
+		go func(limits *atomic.Pointer[config.Listener]) {
+			serve(ctx, sock, limits, tlsConfig, routes, pool, reload.Pages())
+			wg.Done()
+		}(reload.Listener(listener.Addr))
+	}
+
+	wg.Wait()
+	log.Println("all listeners are stopped")
+}
+
+// newTLSConfig returns nil, if TLS isn't enabled. Otherwise, certificates are watched and
+// session ticket keys are rotated until the context is done
+func newTLSConfig(ctx context.Context, cfg config.TLS) (*tls.Config, error) {
+	if !cfg.Enabled() {
+		return nil, nil
+	}
+
+	store, err := certs.NewStore(cfg.Pairs())
 	if err != nil {
-		fmt.Println("error: tcp:", err)
+		return nil, err
+	}
+
+	go store.Watch(ctx, cfg.Reload)
+	tlsConfig := store.Config()
+	if err = certs.RotateTickets(ctx, tlsConfig, cfg.TicketRotation); err != nil {
+		return nil, err
+	}
+
+	return tlsConfig, nil
+}
+
+func serve(
+	ctx context.Context, sock net.Listener, limits *atomic.Pointer[config.Listener], tlsConfig *tls.Config,
+	routes *route.Routes, pool *connect.Pool, errorPages *atomic.Pointer[pages.Pages],
+) {
+	drain := limits.Load().Timeouts.Drain
+	connections, requests := ratelimit.NewLimiter(), ratelimit.NewLimiter()
+	// limits are loaded on every accept, so they're changed by reload, while buckets are kept
+	admit := func(conn net.Conn) bool {
+		// the config is validated already
+		limit, _ := limits.Load().RateLimit.Connections.Limit()
+		if limit == nil {
+			return true
+		}
+
+		var ip [16]byte
+		if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			ip = addr.AddrPort().Addr().As16()
+		}
+
+		_, ok := connections.Allow(ip[:], *limit)
+
+		return ok
+	}
+
+	err := tcp.RunGraceful(ctx, sock, drain, admit, func(conn net.Conn) {
+		cfg := limits.Load()
+		if cfg.ProxyProtocol {
+			proxied, err := proxyproto.Accept(conn, cfg.Timeouts.Read)
+			if err != nil {
+				log.Println("error: proxy protocol:", conn.RemoteAddr(), err)
+				_ = conn.Close()
+				return
+			}
+
+			conn = proxied
+		}
+
+		h := &handler{
+			cfg:      cfg,
+			routes:   routes,
+			pool:     pool,
+			pages:    errorPages.Load(),
+			origin:   proxyproto.HeaderOf(conn),
+			requests: requests,
+		}
+
+		switch cfg.Mode {
+		case config.ModePassthrough:
+			h.passthrough(conn).Serve()
+		case config.ModeSniff:
+			h.sniff(ctx, conn, tlsConfig)
+		default:
+			h.http(ctx, conn, tlsConfig)
+		}
+	})
+	if err != nil && ctx.Err() == nil {
+		log.Println("error: tcp:", err)
 	}
 }
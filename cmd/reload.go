@@ -0,0 +1,159 @@
+package main
+
+import (
+	"at/internal/config"
+	"at/internal/pages"
+	"at/internal/route"
+	"context"
+	"log"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"time"
+)
+
+// reloader re-reads the configuration file and applies routes, error pages and listeners'
+// limits. The rest of the configuration (listeners set, pool and logging) requires a restart
+type reloader struct {
+	path      string
+	current   config.Config
+	routes    *route.Routes
+	checks    *healthChecks
+	pages     *atomic.Pointer[pages.Pages]
+	listeners map[string]*atomic.Pointer[config.Listener]
+	modTime   time.Time
+}
+
+func newReloader(
+	path string, cfg config.Config, routes *route.Routes, checks *healthChecks, errorPages *pages.Pages,
+) *reloader {
+	r := &reloader{
+		path:      path,
+		current:   cfg,
+		routes:    routes,
+		checks:    checks,
+		pages:     new(atomic.Pointer[pages.Pages]),
+		listeners: make(map[string]*atomic.Pointer[config.Listener], len(cfg.Listeners)),
+		modTime:   modTime(path),
+	}
+
+	r.pages.Store(errorPages)
+
+	for _, listener := range cfg.Listeners {
+		listener := listener
+		limits := new(atomic.Pointer[config.Listener])
+		limits.Store(&listener)
+		r.listeners[listener.Addr] = limits
+	}
+
+	return r
+}
+
+// Listener returns the holder of the current listener configuration. New connections must
+// load it on accept, so changed limits are applied to them, while older ones are left alone
+func (r *reloader) Listener(addr string) *atomic.Pointer[config.Listener] {
+	return r.listeners[addr]
+}
+
+// Pages returns the holder of current error pages. Like listeners' limits, they must be
+// loaded on accept
+func (r *reloader) Pages() *atomic.Pointer[pages.Pages] {
+	return r.pages
+}
+
+// Run reloads the configuration every time the signal is received or, in case the interval
+// is positive, the file modification time has been changed
+func (r *reloader) Run(ctx context.Context, signals <-chan os.Signal, interval time.Duration) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+			log.Println("reload: signal received")
+			r.Reload()
+		case <-tick:
+			if mtime := modTime(r.path); !mtime.Equal(r.modTime) {
+				log.Println("reload: configuration file has been changed")
+				r.modTime = mtime
+				r.Reload()
+			}
+		}
+	}
+}
+
+// Reload applies the new configuration. In case it's invalid, the old one is kept
+func (r *reloader) Reload() {
+	cfg, err := config.Load(r.path)
+	if err != nil {
+		log.Println("error: reload: keeping the old configuration:", err)
+		return
+	}
+
+	table, err := cfg.Table()
+	if err != nil {
+		log.Println("error: reload: keeping the old configuration:", err)
+		return
+	}
+
+	errorPages, err := cfg.Pages()
+	if err != nil {
+		log.Println("error: reload: keeping the old configuration:", err)
+		return
+	}
+
+	if len(cfg.Listeners) != len(r.listeners) {
+		log.Println("warning: reload: listeners set can be changed only by restart")
+	}
+
+	for _, listener := range cfg.Listeners {
+		listener := listener
+		limits, found := r.listeners[listener.Addr]
+		if !found {
+			log.Println("warning: reload: new listener is ignored until restart:", listener.Addr)
+			continue
+		}
+
+		if listener.Network != limits.Load().Network {
+			log.Println("warning: reload: listener network can be changed only by restart:", listener.Addr)
+			listener.Network = limits.Load().Network
+		}
+
+		// certificate files are watched on their own, but the set of them is fixed
+		if !reflect.DeepEqual(listener.TLS, limits.Load().TLS) {
+			log.Println("warning: reload: listener tls can be changed only by restart:", listener.Addr)
+			listener.TLS = limits.Load().TLS
+		}
+
+		limits.Store(&listener)
+	}
+
+	if cfg.Pool != r.current.Pool {
+		log.Println("warning: reload: pool limits can be changed only by restart")
+	}
+
+	if !reflect.DeepEqual(cfg.Logging, r.current.Logging) {
+		log.Println("warning: reload: logging can be changed only by restart")
+	}
+
+	r.routes.Swap(table)
+	r.pages.Store(errorPages)
+	r.checks.Start(table)
+	r.current = cfg
+	log.Println("reload: configuration has been applied")
+}
+
+func modTime(path string) time.Time {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return stat.ModTime()
+}
@@ -0,0 +1,98 @@
+package balance
+
+import (
+	"sync/atomic"
+)
+
+// Thresholds tell, how many consecutive failures make the backend unhealthy, and how many
+// consecutive passed probes bring it back. Zero Unhealthy disables health tracking
+type Thresholds struct {
+	Healthy, Unhealthy int32
+}
+
+// Backend is a single address of the upstream
+type Backend struct {
+	Addr       string
+	weight     int
+	inflight   atomic.Int64
+	thresholds Thresholds
+	unhealthy  atomic.Bool
+	fails      atomic.Int32
+	passes     atomic.Int32
+}
+
+func NewBackend(addr string, weight int, thresholds Thresholds) *Backend {
+	if weight <= 0 {
+		weight = 1
+	}
+
+	return &Backend{
+		Addr:       addr,
+		weight:     weight,
+		thresholds: thresholds,
+	}
+}
+
+// Weight returns the share of requests, the backend receives relative to others
+func (b *Backend) Weight() int {
+	return b.weight
+}
+
+// Inflight returns the number of requests, which responses aren't relayed yet
+func (b *Backend) Inflight() int64 {
+	return b.inflight.Load()
+}
+
+// Acquire must be called once the request is sent to the backend
+func (b *Backend) Acquire() {
+	b.inflight.Add(1)
+}
+
+// Release must be called once the response is relayed or the request has failed
+func (b *Backend) Release() {
+	b.inflight.Add(-1)
+}
+
+// Healthy reports whether the backend is in rotation
+func (b *Backend) Healthy() bool {
+	return !b.unhealthy.Load()
+}
+
+// Report records the outcome of the request. Failures are connect errors and broken
+// responses. Succeeded requests don't bring the unhealthy backend back, only probes do
+func (b *Backend) Report(ok bool) {
+	if ok {
+		b.fails.Store(0)
+		return
+	}
+
+	b.fail()
+}
+
+// Probe records the outcome of the health check
+func (b *Backend) Probe(ok bool) {
+	if !ok {
+		b.passes.Store(0)
+		b.fail()
+		return
+	}
+
+	b.fails.Store(0)
+	if b.unhealthy.Load() && b.passes.Add(1) >= b.thresholds.Healthy {
+		b.passes.Store(0)
+		b.unhealthy.Store(false)
+	}
+}
+
+func (b *Backend) fail() {
+	if b.thresholds.Unhealthy > 0 && b.fails.Add(1) >= b.thresholds.Unhealthy {
+		b.passes.Store(0)
+		b.unhealthy.Store(true)
+	}
+}
+
+// lessLoaded reports whether a has fewer requests in flight than b, taking their weights
+// into account
+func lessLoaded(a, b *Backend) bool {
+	return a.Inflight()*int64(b.weight) < b.Inflight()*int64(a.weight)
+}
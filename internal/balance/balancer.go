@@ -0,0 +1,190 @@
+package balance
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	ErrNoBackends      = errors.New("no backends")
+	ErrUnknownStrategy = errors.New("unknown balancing strategy")
+)
+
+const (
+	RoundRobin       = "round_robin"
+	LeastOutstanding = "least_outstanding"
+	RandomTwo        = "random_two"
+	Hash             = "hash"
+)
+
+// Balancer chooses the backend for every request
+type Balancer interface {
+	// Pick returns a healthy backend for the request, or nil in case there's none. The key
+	// is used by hashing balancers only
+	Pick(key []byte) *Backend
+	// Backends returns all the backends in order they're configured
+	Backends() []*Backend
+}
+
+// Hashed is implemented by balancers, that pick the backend by the request key
+type Hashed interface {
+	// Header returns the name of the header, which value is the key. Empty name means
+	// the client IP is the key
+	Header() string
+}
+
+// New returns the balancer by the strategy name. The header is used only by the hash
+// strategy
+func New(strategy string, backends []*Backend, header string) (Balancer, error) {
+	if len(backends) == 0 {
+		return nil, ErrNoBackends
+	}
+
+	switch strategy {
+	case RoundRobin, "":
+		return newRoundRobin(backends), nil
+	case LeastOutstanding:
+		return &leastOutstanding{backends: backends}, nil
+	case RandomTwo:
+		return &randomTwo{backends: backends}, nil
+	case Hash:
+		return newRing(backends, header), nil
+	default:
+		return nil, ErrUnknownStrategy
+	}
+}
+
+// roundRobin is the smooth weighted round-robin: backends with greater weights are picked
+// more often, but their picks are interleaved with others
+type roundRobin struct {
+	backends []*Backend
+	mu       sync.Mutex
+	current  []int
+}
+
+func newRoundRobin(backends []*Backend) *roundRobin {
+	return &roundRobin{
+		backends: backends,
+		current:  make([]int, len(backends)),
+	}
+}
+
+func (r *roundRobin) Pick([]byte) *Backend {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	best, total := -1, 0
+	for i, backend := range r.backends {
+		if !backend.Healthy() {
+			continue
+		}
+
+		total += backend.weight
+		r.current[i] += backend.weight
+		if best == -1 || r.current[i] > r.current[best] {
+			best = i
+		}
+	}
+
+	if best == -1 {
+		return nil
+	}
+
+	r.current[best] -= total
+
+	return r.backends[best]
+}
+
+func (r *roundRobin) Backends() []*Backend {
+	return r.backends
+}
+
+// leastOutstanding picks the backend with the fewest requests in flight per weight unit.
+// Ties are broken in round-robin manner, so idle backends are loaded evenly
+type leastOutstanding struct {
+	backends []*Backend
+	offset   atomic.Uint32
+}
+
+func (l *leastOutstanding) Pick([]byte) *Backend {
+	var (
+		start = int(l.offset.Add(1))
+		best  *Backend
+	)
+
+	for i := range l.backends {
+		backend := l.backends[(start+i)%len(l.backends)]
+		if backend.Healthy() && (best == nil || lessLoaded(backend, best)) {
+			best = backend
+		}
+	}
+
+	return best
+}
+
+func (l *leastOutstanding) Backends() []*Backend {
+	return l.backends
+}
+
+// randomTwo picks two random backends and chooses the less loaded of them
+type randomTwo struct {
+	backends []*Backend
+}
+
+func (r *randomTwo) Pick([]byte) *Backend {
+	healthy := 0
+	for _, backend := range r.backends {
+		if backend.Healthy() {
+			healthy++
+		}
+	}
+
+	switch healthy {
+	case 0:
+		return nil
+	case 1:
+		return r.nthHealthy(0)
+	}
+
+	a := rand.Intn(healthy)
+	b := rand.Intn(healthy - 1)
+	if b >= a {
+		b++
+	}
+
+	first, second := r.nthHealthy(a), r.nthHealthy(b)
+	if lessLoaded(second, first) {
+		return second
+	}
+
+	return first
+}
+
+// nthHealthy returns n-th healthy backend. Backends' health may be changed concurrently,
+// so the last healthy one is returned in case there are fewer of them now
+func (r *randomTwo) nthHealthy(n int) (backend *Backend) {
+	for _, b := range r.backends {
+		if !b.Healthy() {
+			continue
+		}
+
+		if backend = b; n == 0 {
+			break
+		}
+
+		n--
+	}
+
+	if backend == nil {
+		// all the backends became unhealthy in the meantime
+		return r.backends[0]
+	}
+
+	return backend
+}
+
+func (r *randomTwo) Backends() []*Backend {
+	return r.backends
+}
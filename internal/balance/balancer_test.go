@@ -0,0 +1,117 @@
+package balance
+
+import (
+	"github.com/stretchr/testify/require"
+	"strconv"
+	"testing"
+)
+
+func newBackends(weights ...int) []*Backend {
+	backends := make([]*Backend, len(weights))
+	for i, weight := range weights {
+		backends[i] = NewBackend("10.0.0."+strconv.Itoa(i+1)+":80", weight, Thresholds{Healthy: 2, Unhealthy: 2})
+	}
+
+	return backends
+}
+
+func picks(balancer Balancer, n int) map[*Backend]int {
+	counts := make(map[*Backend]int)
+	for i := 0; i < n; i++ {
+		counts[balancer.Pick([]byte(strconv.Itoa(i)))]++
+	}
+
+	return counts
+}
+
+func TestBalancer(t *testing.T) {
+	t.Run("round robin", func(t *testing.T) {
+		backends := newBackends(1, 3)
+		balancer, err := New(RoundRobin, backends, "")
+		require.NoError(t, err)
+
+		counts := picks(balancer, 40)
+		require.Equal(t, 10, counts[backends[0]])
+		require.Equal(t, 30, counts[backends[1]])
+	})
+
+	t.Run("least outstanding", func(t *testing.T) {
+		backends := newBackends(1, 1, 1)
+		balancer, err := New(LeastOutstanding, backends, "")
+		require.NoError(t, err)
+
+		backends[0].Acquire()
+		backends[2].Acquire()
+		require.Equal(t, backends[1], balancer.Pick(nil))
+		backends[1].Acquire()
+		backends[1].Acquire()
+		require.NotEqual(t, backends[1], balancer.Pick(nil))
+	})
+
+	t.Run("random two", func(t *testing.T) {
+		backends := newBackends(1, 1)
+		balancer, err := New(RandomTwo, backends, "")
+		require.NoError(t, err)
+
+		backends[0].Acquire()
+		require.Equal(t, map[*Backend]int{backends[1]: 10}, picks(balancer, 10))
+	})
+
+	t.Run("hash", func(t *testing.T) {
+		backends := newBackends(1, 1, 1)
+		balancer, err := New(Hash, backends, "X-User")
+		require.NoError(t, err)
+		require.Equal(t, "X-User", balancer.(Hashed).Header())
+
+		for i := 0; i < 100; i++ {
+			key := []byte(strconv.Itoa(i))
+			require.Equal(t, balancer.Pick(key), balancer.Pick(key))
+		}
+
+		counts := picks(balancer, 3000)
+		for _, backend := range backends {
+			require.InDelta(t, 1000, counts[backend], 250, backend.Addr)
+		}
+
+		// removing the backend must remap only keys, that belonged to it
+		shrunk, err := New(Hash, backends[:2], "")
+		require.NoError(t, err)
+		for i := 0; i < 1000; i++ {
+			key := []byte(strconv.Itoa(i))
+			if picked := balancer.Pick(key); picked != backends[2] {
+				require.Equal(t, picked, shrunk.Pick(key))
+			}
+		}
+	})
+
+	t.Run("health", func(t *testing.T) {
+		for _, strategy := range []string{RoundRobin, LeastOutstanding, RandomTwo, Hash} {
+			backends := newBackends(1, 1)
+			balancer, err := New(strategy, backends, "")
+			require.NoError(t, err)
+
+			backends[0].Report(false)
+			require.True(t, backends[0].Healthy(), strategy)
+			backends[0].Report(false)
+			require.False(t, backends[0].Healthy(), strategy)
+			require.Equal(t, map[*Backend]int{backends[1]: 10}, picks(balancer, 10), strategy)
+
+			backends[1].Probe(false)
+			backends[1].Probe(false)
+			require.Nil(t, balancer.Pick(nil), strategy)
+
+			backends[0].Probe(true)
+			require.False(t, backends[0].Healthy(), strategy)
+			backends[0].Probe(true)
+			require.True(t, backends[0].Healthy(), strategy)
+			require.Equal(t, backends[0], balancer.Pick(nil), strategy)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		_, err := New(RoundRobin, nil, "")
+		require.ErrorIs(t, err, ErrNoBackends)
+		_, err = New("fastest", newBackends(1), "")
+		require.ErrorIs(t, err, ErrUnknownStrategy)
+	})
+}
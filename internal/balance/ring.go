@@ -0,0 +1,85 @@
+package balance
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// pointsPerWeight is the number of points on the ring for every weight unit of the backend.
+// More points spread keys more evenly
+const pointsPerWeight = 100
+
+type point struct {
+	hash    uint64
+	backend *Backend
+}
+
+// ring is the consistent hashing balancer. Adding or removing a backend remaps only
+// the keys, that belonged to it
+type ring struct {
+	backends []*Backend
+	points   []point
+	header   string
+}
+
+func newRing(backends []*Backend, header string) *ring {
+	r := &ring{
+		backends: backends,
+		header:   header,
+	}
+
+	for _, backend := range backends {
+		for i := 0; i < backend.weight*pointsPerWeight; i++ {
+			r.points = append(r.points, point{
+				hash:    hash([]byte(backend.Addr + "#" + strconv.Itoa(i))),
+				backend: backend,
+			})
+		}
+	}
+
+	sort.Slice(r.points, func(i, j int) bool {
+		return r.points[i].hash < r.points[j].hash
+	})
+
+	return r
+}
+
+func (r *ring) Pick(key []byte) *Backend {
+	h := hash(key)
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= h
+	})
+
+	// keys of the unhealthy backend are spread over the next ones on the ring
+	for n := 0; n < len(r.points); n++ {
+		if backend := r.points[(i+n)%len(r.points)].backend; backend.Healthy() {
+			return backend
+		}
+	}
+
+	return nil
+}
+
+func (r *ring) Backends() []*Backend {
+	return r.backends
+}
+
+func (r *ring) Header() string {
+	return r.header
+}
+
+// hash is FNV-1a, finalized by murmur3's mixer. Plain FNV of short and similar keys, like
+// addresses or IPs, clusters on the ring
+func hash(key []byte) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(key)
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+
+	return x
+}
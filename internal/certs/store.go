@@ -0,0 +1,254 @@
+package certs
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ticketKeysKept is the number of session ticket keys in use. The first one encrypts new
+// tickets, the rest only decrypt older ones, so tickets survive a couple of rotations
+const ticketKeysKept = 3
+
+var (
+	ErrNoCertificates = errors.New("no certificates")
+	ErrNoNames        = errors.New("certificate has neither DNS names nor common name")
+)
+
+// Pair is paths to the PEM-encoded certificate (possibly with the chain) and its key
+type Pair struct {
+	Cert, Key string
+}
+
+// Store holds certificates and chooses them by SNI. Files are reloaded on change
+type Store struct {
+	pairs   []Pair
+	current atomic.Pointer[set]
+	mtimes  []time.Time
+}
+
+// NewStore loads the certificates. The first one is the default: it's used, when the client
+// hasn't sent SNI or no other certificate matches it
+func NewStore(pairs []Pair) (*Store, error) {
+	s := &Store{pairs: pairs}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Config returns the server TLS configuration, that uses the store. Only HTTP/1.1 is
+// advertised, as the forwarder doesn't speak HTTP/2
+func (s *Store) Config() *tls.Config {
+	return &tls.Config{
+		GetCertificate: s.GetCertificate,
+		NextProtos:     []string{"http/1.1"},
+		MinVersion:     tls.VersionTLS12,
+	}
+}
+
+// GetCertificate chooses the certificate by SNI. Exact names win over wildcards
+func (s *Store) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return s.current.Load().lookup(strings.ToLower(hello.ServerName)), nil
+}
+
+// Watch checks files for changes with the interval until the context is done. Changed
+// certificates are reloaded, but in case any of them is invalid, the old ones are kept
+func (s *Store) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !s.changed() {
+				continue
+			}
+
+			if err := s.load(); err != nil {
+				log.Println("error: certificates: keeping the old ones:", err)
+				continue
+			}
+
+			log.Println("certificates have been reloaded")
+		}
+	}
+}
+
+func (s *Store) changed() bool {
+	for i, pair := range s.pairs {
+		if !modTime(pair.Cert).Equal(s.mtimes[2*i]) || !modTime(pair.Key).Equal(s.mtimes[2*i+1]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *Store) load() error {
+	if len(s.pairs) == 0 {
+		return ErrNoCertificates
+	}
+
+	// modification times are taken before reading, so changes made meanwhile aren't missed
+	mtimes := make([]time.Time, 0, 2*len(s.pairs))
+	for _, pair := range s.pairs {
+		mtimes = append(mtimes, modTime(pair.Cert), modTime(pair.Key))
+	}
+
+	certs := newSet()
+	for _, pair := range s.pairs {
+		if err := certs.add(pair); err != nil {
+			// broken files aren't retried until they're changed again
+			s.mtimes = mtimes
+			return err
+		}
+	}
+
+	s.mtimes = mtimes
+	s.current.Store(certs)
+
+	return nil
+}
+
+// Load checks, whether the pair is a valid certificate
+func Load(pair Pair) error {
+	return newSet().add(pair)
+}
+
+// set is an immutable snapshot of loaded certificates
+type set struct {
+	exact map[string]*tls.Certificate
+	// wildcard is keyed by the suffix including the leading dot, e.g. .example.com
+	wildcard map[string]*tls.Certificate
+	fallback *tls.Certificate
+}
+
+func newSet() *set {
+	return &set{
+		exact:    make(map[string]*tls.Certificate),
+		wildcard: make(map[string]*tls.Certificate),
+	}
+}
+
+func (s *set) add(pair Pair) error {
+	cert, err := tls.LoadX509KeyPair(pair.Cert, pair.Key)
+	if err != nil {
+		return err
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+
+	cert.Leaf = leaf
+	names := leaf.DNSNames
+	if len(names) == 0 && len(leaf.Subject.CommonName) > 0 {
+		names = []string{leaf.Subject.CommonName}
+	}
+
+	if len(names) == 0 {
+		return ErrNoNames
+	}
+
+	for _, name := range names {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "*.") {
+			addFirst(s.wildcard, name[1:], &cert)
+		} else {
+			addFirst(s.exact, name, &cert)
+		}
+	}
+
+	if s.fallback == nil {
+		s.fallback = &cert
+	}
+
+	return nil
+}
+
+// lookup returns the certificate for the name. Wildcard matches exactly one label, as
+// defined by RFC 6125
+func (s *set) lookup(name string) *tls.Certificate {
+	if cert, found := s.exact[name]; found {
+		return cert
+	}
+
+	if dot := strings.IndexByte(name, '.'); dot > 0 {
+		if cert, found := s.wildcard[name[dot:]]; found {
+			return cert
+		}
+	}
+
+	return s.fallback
+}
+
+// addFirst adds the certificate, unless the name is already covered by the earlier one
+func addFirst(certs map[string]*tls.Certificate, name string, cert *tls.Certificate) {
+	if _, found := certs[name]; !found {
+		certs[name] = cert
+	}
+}
+
+// RotateTickets replaces session ticket keys of the config with the interval until the context
+// is done. The interval must be positive
+func RotateTickets(ctx context.Context, config *tls.Config, interval time.Duration) error {
+	var keys [][32]byte
+	rotate := func() error {
+		var key [32]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+
+		keys = append([][32]byte{key}, keys...)
+		if len(keys) > ticketKeysKept {
+			keys = keys[:ticketKeysKept]
+		}
+
+		config.SetSessionTicketKeys(keys)
+
+		return nil
+	}
+
+	if err := rotate(); err != nil {
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := rotate(); err != nil {
+					log.Println("error: session ticket keys:", err)
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+func modTime(path string) time.Time {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return stat.ModTime()
+}
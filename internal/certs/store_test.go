@@ -0,0 +1,110 @@
+package certs
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/stretchr/testify/require"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writePair writes a self-signed certificate for the names into the directory
+func writePair(t *testing.T, dir, file string, names ...string) Pair {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	pair := Pair{Cert: filepath.Join(dir, file+".crt"), Key: filepath.Join(dir, file+".key")}
+	require.NoError(t, os.WriteFile(pair.Cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(pair.Key, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+
+	return pair
+}
+
+func commonName(t *testing.T, store *Store, sni string) string {
+	cert, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: sni})
+	require.NoError(t, err)
+
+	return cert.Leaf.Subject.CommonName
+}
+
+func TestStore(t *testing.T) {
+	t.Run("sni", func(t *testing.T) {
+		dir := t.TempDir()
+		store, err := NewStore([]Pair{
+			writePair(t, dir, "default", "default.com"),
+			writePair(t, dir, "wildcard", "*.example.com"),
+			writePair(t, dir, "exact", "api.example.com", "example.com"),
+		})
+		require.NoError(t, err)
+
+		for sni, want := range map[string]string{
+			"":                  "default.com",
+			"API.example.com":   "api.example.com",
+			"example.com":       "api.example.com",
+			"www.example.com":   "*.example.com",
+			"a.www.example.com": "default.com",
+			"example.org":       "default.com",
+		} {
+			require.Equal(t, want, commonName(t, store, sni), sni)
+		}
+	})
+
+	t.Run("reload", func(t *testing.T) {
+		dir := t.TempDir()
+		pair := writePair(t, dir, "cert", "old.com")
+		store, err := NewStore([]Pair{pair})
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go store.Watch(ctx, 10*time.Millisecond)
+
+		// broken files are ignored
+		require.NoError(t, os.WriteFile(pair.Cert, []byte("garbage"), 0o600))
+		time.Sleep(50 * time.Millisecond)
+		require.Equal(t, "old.com", commonName(t, store, ""))
+
+		// modification times might be coarse, so they're forced to change
+		writePair(t, dir, "cert", "new.com")
+		future := time.Now().Add(time.Minute)
+		require.NoError(t, os.Chtimes(pair.Cert, future, future))
+		require.Eventually(t, func() bool {
+			return commonName(t, store, "") == "new.com"
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		_, err := NewStore(nil)
+		require.ErrorIs(t, err, ErrNoCertificates)
+		require.Error(t, Load(Pair{Cert: "nope.crt", Key: "nope.key"}))
+	})
+}
+
+func TestRotateTickets(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	config := new(tls.Config)
+	require.NoError(t, RotateTickets(ctx, config, time.Hour))
+}
@@ -0,0 +1,826 @@
+package config
+
+import (
+	"at/internal/balance"
+	"at/internal/certs"
+	"at/internal/forwarded"
+	"at/internal/health"
+	"at/internal/pages"
+	"at/internal/proxyproto"
+	"at/internal/ratelimit"
+	"at/internal/respond"
+	"at/internal/rewrite"
+	"at/internal/route"
+	"at/internal/tunnel"
+	"bytes"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const hashHeaderPrefix = "header:"
+
+const (
+	ModeHTTP        = "http"
+	ModePassthrough = "passthrough"
+	ModeSniff       = "sniff"
+)
+
+type Config struct {
+	Listeners []Listener          `yaml:"listeners"`
+	Upstreams map[string]Upstream `yaml:"upstreams"`
+	Routing   Routing             `yaml:"routing"`
+	Pool      Pool                `yaml:"pool"`
+	Errors    Errors              `yaml:"errors"`
+	Logging   Logging             `yaml:"logging"`
+}
+
+type Listener struct {
+	Network string `yaml:"network"`
+	Addr    string `yaml:"addr"`
+	// Mode is either http (default), that forwards HTTP requests, passthrough, that
+	// forwards TLS connections as is by SNI, or sniff, that tells HTTP, TLS and anything
+	// else apart by first bytes
+	Mode string `yaml:"mode"`
+	// Raw is the upstream of sniffing listeners for connections, that are neither HTTP nor
+	// TLS. They're closed, if it isn't set
+	Raw string `yaml:"raw"`
+	// Strict enables the request smuggling hardening mode of the HTTP scanner
+	Strict bool `yaml:"strict"`
+	// ProxyProtocol makes the listener expect PROXY protocol header of either version
+	// on every connection. The client address is taken from it
+	ProxyProtocol bool      `yaml:"proxy_protocol"`
+	Timeouts      Timeouts  `yaml:"timeouts"`
+	Buffers       Buffers   `yaml:"buffers"`
+	Forwarded     Forwarded `yaml:"forwarded"`
+	Connect       Connect   `yaml:"connect"`
+	TLS           TLS       `yaml:"tls"`
+	// RateLimit limits connections and requests of clients of the listener
+	RateLimit ListenerRateLimit `yaml:"rate_limit"`
+}
+
+// ListenerRateLimit limits new connections of every client IP on accept, and requests on
+// top of limits of their routes
+type ListenerRateLimit struct {
+	Connections RateLimit `yaml:"connections"`
+	Requests    RateLimit `yaml:"requests"`
+}
+
+// RateLimit is the token bucket, that gets Rate tokens every Per and holds up to Burst of
+// them. Every connection or request takes a token
+type RateLimit struct {
+	Rate int `yaml:"rate"`
+	// Per defaults to 1s
+	Per time.Duration `yaml:"per"`
+	// Burst defaults to Rate
+	Burst int `yaml:"burst"`
+	// Key tells clients apart: ip (default), route, meaning a single bucket for all of them,
+	// or header:<name>. Clients without the header are told apart by ip
+	Key string `yaml:"key"`
+}
+
+// Limit returns nil if the limit isn't set
+func (r RateLimit) Limit() (*ratelimit.Limit, error) {
+	if r == (RateLimit{}) {
+		return nil, nil
+	}
+
+	per, burst := r.Per, r.Burst
+	if per == 0 {
+		per = time.Second
+	}
+
+	if burst == 0 {
+		burst = r.Rate
+	}
+
+	limit, err := ratelimit.NewLimit(r.Rate, per, burst)
+	if err != nil {
+		return nil, err
+	}
+
+	return &limit, nil
+}
+
+// Rule returns nil if the limit isn't set. Buckets are kept in the limiter
+func (r RateLimit) Rule(limiter *ratelimit.Limiter) (*ratelimit.Rule, error) {
+	limit, err := r.Limit()
+	if err != nil || limit == nil {
+		return nil, err
+	}
+
+	return ratelimit.NewRule(*limit, r.Key, limiter)
+}
+
+// Connect makes the listener a forward proxy, that opens tunnels by CONNECT requests
+type Connect struct {
+	// Allow are destinations of tunnels in the form of host:port. Host might be a wildcard,
+	// port might be *. CONNECT requests are refused, if there are none
+	Allow []string `yaml:"allow"`
+}
+
+// Allowlist returns nil if CONNECT is disabled
+func (c Connect) Allowlist() (*tunnel.Allowlist, error) {
+	if len(c.Allow) == 0 {
+		return nil, nil
+	}
+
+	return tunnel.NewAllowlist(c.Allow)
+}
+
+// TLS enables termination of TLS on the listener, if there are any certificates
+type TLS struct {
+	// Certs are chosen by SNI. The first one is the default
+	Certs []CertPair `yaml:"certs"`
+	// Reload is the interval of checking certificate files for changes
+	Reload time.Duration `yaml:"reload"`
+	// TicketRotation is the interval of session ticket keys rotation
+	TicketRotation time.Duration `yaml:"ticket_rotation"`
+}
+
+type CertPair struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+}
+
+func (t TLS) Enabled() bool {
+	return len(t.Certs) > 0
+}
+
+func (t TLS) Pairs() []certs.Pair {
+	pairs := make([]certs.Pair, len(t.Certs))
+	for i, pair := range t.Certs {
+		pairs[i] = certs.Pair{Cert: pair.Cert, Key: pair.Key}
+	}
+
+	return pairs
+}
+
+type Timeouts struct {
+	Read  time.Duration `yaml:"read"`
+	Write time.Duration `yaml:"write"`
+	// Drain limits the time of graceful shutdown: requests and responses in flight are
+	// waited for at most this long, and then the connections are closed
+	Drain time.Duration `yaml:"drain"`
+	// Tunnel closes raw tunnels, e.g. TLS passthrough or upgraded HTTP connections, after
+	// no data in either direction for this long
+	Tunnel time.Duration `yaml:"tunnel"`
+	// Peek is how long sniffing listeners wait for first bytes. Clients, that keep silence,
+	// are forwarded to the raw upstream, as server-first protocols do
+	Peek time.Duration `yaml:"peek"`
+}
+
+type Buffers struct {
+	// Client and Upstream are sizes of read buffers of client and upstream connections
+	Client   int `yaml:"client"`
+	Upstream int `yaml:"upstream"`
+	// ArenaInitial and ArenaMax limit the buffer, the request is amassed in until its
+	// destination is known
+	ArenaInitial int `yaml:"arena_initial"`
+	ArenaMax     int `yaml:"arena_max"`
+}
+
+// Forwarded configures headers, that tell upstreams about the client
+type Forwarded struct {
+	// Headers are any of x-forwarded-for, x-forwarded-proto, x-forwarded-host and forwarded
+	Headers []string `yaml:"headers"`
+	// Trusted are addresses or CIDRs of proxies in front of the forwarder. Forwarding headers
+	// of other clients are stripped
+	Trusted []string `yaml:"trusted"`
+}
+
+// Config returns nil if no headers are enabled. Proto is the protocol of the listener
+func (f Forwarded) Config(proto string) (*forwarded.Config, error) {
+	if len(f.Headers) == 0 {
+		return nil, nil
+	}
+
+	return forwarded.NewConfig(f.Headers, f.Trusted, proto)
+}
+
+type Upstream struct {
+	Addrs []Backend `yaml:"addrs"`
+	// Balance is the balancing strategy: round_robin (default), least_outstanding, random_two
+	// or hash
+	Balance string `yaml:"balance"`
+	// HashKey is the key of the hash strategy: either ip (default) or header:<name>
+	HashKey string `yaml:"hash_key"`
+	Health  Health `yaml:"health"`
+}
+
+// Health configures health checking of upstream's backends. Omitted values are defaulted
+// by Health.Defaults
+type Health struct {
+	// Check is either tcp (default), http or none. None disables health checking at all,
+	// so backends never leave rotation
+	Check string `yaml:"check"`
+	// Path and Status are used by the http check. Zero status means any 2xx
+	Path     string        `yaml:"path"`
+	Status   int           `yaml:"status"`
+	Interval time.Duration `yaml:"interval"`
+	Timeout  time.Duration `yaml:"timeout"`
+	// HealthyThreshold is the number of consecutive passed checks, that bring the unhealthy
+	// backend back to rotation
+	HealthyThreshold int32 `yaml:"healthy_threshold"`
+	// UnhealthyThreshold is the number of consecutive failures, either of checks or of
+	// requests, that make the backend unhealthy
+	UnhealthyThreshold int32 `yaml:"unhealthy_threshold"`
+}
+
+// Defaults returns the health configuration with omitted values set to defaults
+func (h Health) Defaults() Health {
+	if len(h.Check) == 0 {
+		h.Check = health.TCP
+	}
+
+	if len(h.Path) == 0 {
+		h.Path = "/"
+	}
+
+	if h.Interval == 0 {
+		h.Interval = 5 * time.Second
+	}
+
+	if h.Timeout == 0 {
+		h.Timeout = time.Second
+	}
+
+	if h.HealthyThreshold == 0 {
+		h.HealthyThreshold = 2
+	}
+
+	if h.UnhealthyThreshold == 0 {
+		h.UnhealthyThreshold = 3
+	}
+
+	return h
+}
+
+// Backend is either a plain address, or a mapping of the address and its weight
+type Backend struct {
+	Addr   string `yaml:"addr"`
+	Weight int    `yaml:"weight"`
+}
+
+func (b *Backend) UnmarshalYAML(node *yaml.Node) error {
+	b.Weight = 1
+	if node.Kind == yaml.ScalarNode {
+		return node.Decode(&b.Addr)
+	}
+
+	// the alias type prevents infinite recursion
+	type plain Backend
+	return node.Decode((*plain)(b))
+}
+
+// HashHeader returns the name of the header, which value is used as the key by the hash
+// strategy. Empty name means the client IP
+func (u Upstream) HashHeader() string {
+	return strings.TrimPrefix(u.HashKey, hashHeaderPrefix)
+}
+
+// Pool limits connections to upstreams. They're shared by all the listeners
+type Pool struct {
+	// MaxIdlePerHost limits idle connections to a single address. Zero disables pooling
+	MaxIdlePerHost int `yaml:"max_idle_per_host"`
+	// MaxPerHost limits both idle and busy connections to a single address. Zero means
+	// no limit
+	MaxPerHost  int           `yaml:"max_per_host"`
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+	// Wait limits the time of waiting for a free connection, when max_per_host is reached
+	Wait time.Duration `yaml:"wait"`
+	// ConnectTimeout limits establishing new connections, so unresponsive backends don't
+	// hold slots for long
+	ConnectTimeout time.Duration `yaml:"connect_timeout"`
+	// ReadTimeout and WriteTimeout limit I/O of upstream connections. Unlike listener's
+	// timeouts, they don't depend on the client, as connections are shared
+	ReadTimeout  time.Duration `yaml:"read_timeout"`
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+}
+
+type Routing struct {
+	// UnknownHostStatus is either 421 or 404
+	UnknownHostStatus int `yaml:"unknown_host_status"`
+	// Default is the route for hosts, not matched by any other route
+	Default DefaultRoute `yaml:"default"`
+	Routes  []Route      `yaml:"routes"`
+}
+
+type Route struct {
+	// Host is either exact (example.com) or wildcard (*.example.com). Exact hosts might be
+	// followed by the port (example.com:8080)
+	Host string `yaml:"host"`
+	// Aliases are other hosts, routed the same way, e.g. www.example.com
+	Aliases []string `yaml:"aliases"`
+	// Upstream is where requests are forwarded to. Routes, that are responded by Redirect or
+	// Respond, have none
+	Upstream string `yaml:"upstream"`
+	// ProxyProtocol is either v1 or v2. If set, new connections to the upstream start with
+	// PROXY protocol header, describing the client
+	ProxyProtocol string `yaml:"proxy_protocol"`
+	// Passthrough routes TLS connections by SNI without terminating them. Such routes are
+	// used only by passthrough listeners
+	Passthrough bool `yaml:"passthrough"`
+	// Path, PathRegex and Methods narrow the route down to matching requests. Path is either
+	// exact (/login) or a prefix (/api/*). Requests to the host, that don't match any route,
+	// are routed as if there were no routes of this host at all
+	Path      string   `yaml:"path"`
+	PathRegex string   `yaml:"path_regex"`
+	Methods   []string `yaml:"methods"`
+	// Headers and PathRewrite rewrite requests of the route before they're forwarded
+	Headers     HeaderRules `yaml:"headers"`
+	PathRewrite PathRewrite `yaml:"path_rewrite"`
+	// Redirect and Respond answer requests of the route by the forwarder itself
+	Redirect Redirect `yaml:"redirect"`
+	Respond  Respond  `yaml:"respond"`
+	// HTTPSRedirect redirects requests over plain connections to https with 308. Requests
+	// over TLS are routed as usual
+	HTTPSRedirect bool `yaml:"https_redirect"`
+	// RateLimit limits requests of the route. Its buckets start over on reload
+	RateLimit RateLimit `yaml:"rate_limit"`
+}
+
+// Matcher returns the matcher of requests, that belong to the route
+func (r Route) Matcher() (route.Matcher, error) {
+	return route.NewMatcher(r.Methods, r.Path, r.PathRegex)
+}
+
+// Responder returns the responder of the route, or nil if its requests are forwarded
+func (r Route) Responder() (respond.Responder, error) {
+	redirect, err := r.Redirect.Responder()
+	if err != nil {
+		return nil, err
+	}
+
+	if redirect != nil {
+		return redirect, nil
+	}
+
+	fixed, err := r.Respond.Responder()
+	if err != nil || fixed == nil {
+		return nil, err
+	}
+
+	return fixed, nil
+}
+
+// Redirect responds with redirects to the location
+type Redirect struct {
+	// To is the location, where {host} is replaced with the host of the request
+	To string `yaml:"to"`
+	// Status is either 301, 302, 303, 307 or 308. Defaults to 301
+	Status int `yaml:"status"`
+	// PreservePath and PreserveQuery append the path and the query of the request to the
+	// location
+	PreservePath  bool `yaml:"preserve_path"`
+	PreserveQuery bool `yaml:"preserve_query"`
+}
+
+// Responder returns the redirect, or nil if it's not set
+func (r Redirect) Responder() (*respond.Redirect, error) {
+	if r == (Redirect{}) {
+		return nil, nil
+	}
+
+	status := r.Status
+	if status == 0 {
+		status = http.StatusMovedPermanently
+	}
+
+	return respond.NewRedirect(status, r.To, r.PreservePath, r.PreserveQuery)
+}
+
+// Respond is the fixed response to every request, e.g. 410 Gone or a maintenance page
+type Respond struct {
+	// Status defaults to 200
+	Status  int               `yaml:"status"`
+	Headers map[string]string `yaml:"headers"`
+	// Body is either inline, or read from the File
+	Body string `yaml:"body"`
+	File string `yaml:"file"`
+}
+
+// Responder returns the fixed response, or nil if it's not set. The file is read at once
+func (r Respond) Responder() (*respond.Fixed, error) {
+	if r.Status == 0 && len(r.Headers) == 0 && len(r.Body) == 0 && len(r.File) == 0 {
+		return nil, nil
+	}
+
+	status := r.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	body := []byte(r.Body)
+	if len(r.File) > 0 {
+		if len(r.Body) > 0 {
+			return nil, errors.New("body and file are mutually exclusive")
+		}
+
+		var err error
+		if body, err = os.ReadFile(r.File); err != nil {
+			return nil, err
+		}
+	}
+
+	return respond.NewFixed(status, r.Headers, body)
+}
+
+// DefaultRoute is either a plain name of the upstream, or a mapping like a route without
+// the host
+type DefaultRoute struct {
+	Upstream      string      `yaml:"upstream"`
+	ProxyProtocol string      `yaml:"proxy_protocol"`
+	Headers       HeaderRules `yaml:"headers"`
+	PathRewrite   PathRewrite `yaml:"path_rewrite"`
+	RateLimit     RateLimit   `yaml:"rate_limit"`
+}
+
+func (d *DefaultRoute) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		return node.Decode(&d.Upstream)
+	}
+
+	// the alias type prevents infinite recursion
+	type plain DefaultRoute
+	return node.Decode((*plain)(d))
+}
+
+// HeaderRules edit request headers. Headers are removed first, then renamed, set replacing
+// present values and added alongside them. Content-Length and Transfer-Encoding can't be
+// edited, as they delimit requests
+type HeaderRules struct {
+	Remove []string          `yaml:"remove"`
+	Rename map[string]string `yaml:"rename"`
+	Set    map[string]string `yaml:"set"`
+	Add    map[string]string `yaml:"add"`
+}
+
+// Rewrite returns the rewriter of request headers, or nil if there are no rules
+func (h HeaderRules) Rewrite() (*rewrite.Headers, error) {
+	if len(h.Remove) == 0 && len(h.Rename) == 0 && len(h.Set) == 0 && len(h.Add) == 0 {
+		return nil, nil
+	}
+
+	return rewrite.NewHeaders(h.Remove, h.Rename, h.Set, h.Add)
+}
+
+// PathRewrite rewrites the path of the request target. The prefix is stripped first, then
+// matches of the regex are replaced and finally the prefix is added. The query is kept
+type PathRewrite struct {
+	// StripPrefix must end at the segment boundary: /billing strips /billing/a, but not
+	// /billings
+	StripPrefix string `yaml:"strip_prefix"`
+	// Replacement might refer to capture groups of the Regex: $1 or ${name}
+	Regex       string `yaml:"regex"`
+	Replacement string `yaml:"replacement"`
+	AddPrefix   string `yaml:"add_prefix"`
+}
+
+// Rewrite returns the rewriter of request paths, or nil if there are no rules
+func (p PathRewrite) Rewrite() (*rewrite.Path, error) {
+	if p == (PathRewrite{}) {
+		return nil, nil
+	}
+
+	return rewrite.NewPath(p.StripPrefix, p.Regex, p.Replacement, p.AddPrefix)
+}
+
+func proxyProtocolVersion(version string) (int, error) {
+	switch version {
+	case "":
+		return 0, nil
+	case "v1":
+		return proxyproto.V1, nil
+	case "v2":
+		return proxyproto.V2, nil
+	default:
+		return 0, errors.New("must be either v1 or v2")
+	}
+}
+
+// Errors configure responses, that are sent by the forwarder itself, e.g. when the request
+// is malformed or the upstream is unavailable
+type Errors struct {
+	ContentType string `yaml:"content_type"`
+	// Templates are bodies of responses, keyed by the status code or default. They're
+	// text/template, executed with .Status, .Reason and .RequestID
+	Templates map[string]string `yaml:"templates"`
+}
+
+type Logging struct {
+	// Output is either stdout, stderr or a path to the file
+	Output     string `yaml:"output"`
+	Timestamps bool   `yaml:"timestamps"`
+}
+
+func Default() Config {
+	return Config{
+		Routing: Routing{
+			UnknownHostStatus: 421,
+		},
+		Pool: Pool{
+			MaxIdlePerHost: 32,
+			IdleTimeout:    90 * time.Second,
+			Wait:           5 * time.Second,
+			ConnectTimeout: 5 * time.Second,
+			ReadTimeout:    3 * time.Minute,
+			WriteTimeout:   1 * time.Minute,
+		},
+		Logging: Logging{
+			Output:     "stderr",
+			Timestamps: true,
+		},
+	}
+}
+
+func defaultListener() Listener {
+	return Listener{
+		Network: "tcp4",
+		Addr:    "0.0.0.0:8000",
+		Mode:    ModeHTTP,
+		Timeouts: Timeouts{
+			Read:   3 * time.Minute,
+			Write:  1 * time.Minute,
+			Drain:  30 * time.Second,
+			Tunnel: 5 * time.Minute,
+			Peek:   500 * time.Millisecond,
+		},
+		Buffers: Buffers{
+			Client:       4096,
+			Upstream:     4096,
+			ArenaInitial: 4 * 1024,
+			ArenaMax:     64 * 1024,
+		},
+		TLS: TLS{
+			Reload:         time.Minute,
+			TicketRotation: 12 * time.Hour,
+		},
+	}
+}
+
+// Load reads and validates the configuration file. Validation errors are prefixed by the
+// file name and the position of the invalid value
+func Load(path string) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+
+	cfg, err := Parse(data)
+	if err != nil {
+		return cfg, prefixErrors(path, err)
+	}
+
+	return cfg, nil
+}
+
+// Parse decodes and validates the configuration. Unknown fields are considered as an error
+func Parse(data []byte) (Config, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return Config{}, err
+	}
+
+	cfg := Default()
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&cfg); err != nil && err != io.EOF {
+		return Config{}, err
+	}
+
+	if err := fillListeners(&cfg, data); err != nil {
+		return Config{}, err
+	}
+
+	return cfg, validate(cfg, &root)
+}
+
+// fillListeners decodes listeners once again, each one on top of defaults. This cannot be
+// done in a single pass, as the decoder doesn't know the default value of new slice elements
+func fillListeners(cfg *Config, data []byte) error {
+	var raw struct {
+		Listeners []yaml.Node `yaml:"listeners"`
+	}
+
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	if len(raw.Listeners) == 0 {
+		cfg.Listeners = []Listener{defaultListener()}
+		return nil
+	}
+
+	for i := range raw.Listeners {
+		listener := defaultListener()
+		if err := raw.Listeners[i].Decode(&listener); err != nil {
+			return err
+		}
+
+		cfg.Listeners[i] = listener
+	}
+
+	return nil
+}
+
+// Pages builds error responses. The config is expected to be already validated
+func (c Config) Pages() (*pages.Pages, error) {
+	return pages.New(c.Errors.ContentType, c.Errors.Templates)
+}
+
+// Table builds the routing table. The config is expected to be already validated
+func (c Config) Table() (*route.Table, error) {
+	upstreams := make(map[string]*route.Upstream, len(c.Upstreams))
+	for name, upstream := range c.Upstreams {
+		check := upstream.Health.Defaults()
+		thresholds := balance.Thresholds{
+			Healthy:   check.HealthyThreshold,
+			Unhealthy: check.UnhealthyThreshold,
+		}
+		if check.Check == health.None {
+			thresholds = balance.Thresholds{}
+		}
+
+		backends := make([]*balance.Backend, len(upstream.Addrs))
+		for i, backend := range upstream.Addrs {
+			backends[i] = balance.NewBackend(backend.Addr, backend.Weight, thresholds)
+		}
+
+		balancer, err := balance.New(upstream.Balance, backends, upstream.HashHeader())
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+
+		upstreams[name] = &route.Upstream{
+			Name:     name,
+			Balancer: balancer,
+			Check: health.Check{
+				Kind:     check.Check,
+				Path:     check.Path,
+				Status:   check.Status,
+				Interval: check.Interval,
+				Timeout:  check.Timeout,
+			},
+		}
+	}
+
+	// routes with PROXY protocol get their own variant of the upstream, sharing backends
+	type variant struct {
+		name          string
+		proxyProtocol string
+	}
+	variants := make(map[variant]*route.Upstream)
+	lookup := func(name, proxyProtocol string) (*route.Upstream, error) {
+		upstream, found := upstreams[name]
+		if !found {
+			return nil, fmt.Errorf("%s: %w", name, errUnknownUpstream)
+		}
+
+		version, err := proxyProtocolVersion(proxyProtocol)
+		if err != nil || version == 0 {
+			return upstream, err
+		}
+
+		key := variant{name, proxyProtocol}
+		if variants[key] == nil {
+			withProxy := *upstream
+			withProxy.ProxyProtocol = version
+			variants[key] = &withProxy
+		}
+
+		return variants[key], nil
+	}
+
+	// routes with rewriting rules get their own variant of the upstream, too
+	withRewrites := func(
+		upstream *route.Upstream, headerRules HeaderRules, pathRewrite PathRewrite,
+	) (*route.Upstream, error) {
+		headers, err := headerRules.Rewrite()
+		if err != nil {
+			return nil, err
+		}
+
+		path, err := pathRewrite.Rewrite()
+		if err != nil || (headers == nil && path == nil) {
+			return upstream, err
+		}
+
+		withRules := *upstream
+		withRules.Headers, withRules.Path = headers, path
+
+		return &withRules, nil
+	}
+
+	// routes with rate limits get their own variant of the upstream with their own buckets
+	withRateLimit := func(upstream *route.Upstream, rateLimit RateLimit) (*route.Upstream, error) {
+		rule, err := rateLimit.Rule(ratelimit.NewLimiter())
+		if err != nil || rule == nil {
+			return upstream, err
+		}
+
+		limited := *upstream
+		limited.RateLimit = rule
+
+		return &limited, nil
+	}
+
+	table := route.NewTable(c.Routing.UnknownHostStatus)
+
+	for _, r := range c.Routing.Routes {
+		responder, err := r.Responder()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", r.Host, err)
+		}
+
+		var upstream *route.Upstream
+		if responder != nil {
+			upstream = &route.Upstream{Respond: responder}
+		} else if upstream, err = lookup(r.Upstream, r.ProxyProtocol); err != nil {
+			return nil, err
+		} else if upstream, err = withRewrites(upstream, r.Headers, r.PathRewrite); err != nil {
+			return nil, fmt.Errorf("%s: %w", r.Host, err)
+		}
+
+		if r.HTTPSRedirect {
+			httpsOnly := *upstream
+			httpsOnly.HTTPSOnly = true
+			upstream = &httpsOnly
+		}
+
+		if upstream, err = withRateLimit(upstream, r.RateLimit); err != nil {
+			return nil, fmt.Errorf("%s: %w", r.Host, err)
+		}
+
+		matcher, err := r.Matcher()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", r.Host, err)
+		}
+
+		target := table
+		if r.Passthrough {
+			target = table.Passthrough()
+		}
+
+		for _, host := range append([]string{r.Host}, r.Aliases...) {
+			if err = target.AddMatching(host, matcher, upstream); err != nil {
+				return nil, fmt.Errorf("%s: %w", host, err)
+			}
+		}
+	}
+
+	if len(c.Routing.Default.Upstream) > 0 {
+		upstream, err := lookup(c.Routing.Default.Upstream, c.Routing.Default.ProxyProtocol)
+		if err != nil {
+			return nil, err
+		}
+
+		if upstream, err = withRewrites(upstream, c.Routing.Default.Headers, c.Routing.Default.PathRewrite); err != nil {
+			return nil, err
+		}
+
+		if upstream, err = withRateLimit(upstream, c.Routing.Default.RateLimit); err != nil {
+			return nil, err
+		}
+
+		if err = table.SetDefault(upstream); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, listener := range c.Listeners {
+		if len(listener.Raw) == 0 {
+			continue
+		}
+
+		upstream, err := lookup(listener.Raw, "")
+		if err != nil {
+			return nil, err
+		}
+
+		if err = table.AddRaw(listener.Raw, upstream); err != nil {
+			return nil, fmt.Errorf("%s: %w", listener.Addr, err)
+		}
+	}
+
+	return table, nil
+}
+
+func prefixErrors(path string, err error) error {
+	var errs interface{ Unwrap() []error }
+	if !errors.As(err, &errs) {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	var prefixed []error
+	for _, e := range errs.Unwrap() {
+		prefixed = append(prefixed, fmt.Errorf("%s:%w", path, e))
+	}
+
+	return errors.Join(prefixed...)
+}
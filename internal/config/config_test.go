@@ -0,0 +1,394 @@
+package config
+
+import (
+	"at/internal/ratelimit"
+	"at/internal/respond"
+	"at/internal/scan"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		cfg, err := Parse([]byte("upstreams:\n  api:\n    addrs: [127.0.0.1:8080]\n"))
+		require.NoError(t, err)
+		require.Len(t, cfg.Listeners, 1)
+		require.Equal(t, defaultListener(), cfg.Listeners[0])
+		require.Equal(t, 421, cfg.Routing.UnknownHostStatus)
+	})
+
+	t.Run("listener on top of defaults", func(t *testing.T) {
+		cfg, err := Parse([]byte("listeners:\n  - addr: 127.0.0.1:80\n    timeouts:\n      read: 5s\n"))
+		require.NoError(t, err)
+		require.Equal(t, "127.0.0.1:80", cfg.Listeners[0].Addr)
+		require.Equal(t, 5*time.Second, cfg.Listeners[0].Timeouts.Read)
+		require.Equal(t, time.Minute, cfg.Listeners[0].Timeouts.Write)
+	})
+
+	t.Run("balancing", func(t *testing.T) {
+		config := `
+upstreams:
+  api:
+    balance: hash
+    hash_key: header:X-User
+    addrs:
+      - 127.0.0.1:8080
+      - { addr: 127.0.0.1:8081, weight: 3 }
+`
+		cfg, err := Parse([]byte(config))
+		require.NoError(t, err)
+		api := cfg.Upstreams["api"]
+		require.Equal(t, []Backend{{Addr: "127.0.0.1:8080", Weight: 1}, {Addr: "127.0.0.1:8081", Weight: 3}}, api.Addrs)
+		require.Equal(t, "X-User", api.HashHeader())
+
+		_, err = Parse([]byte("upstreams:\n  api:\n    balance: fastest\n    addrs: [127.0.0.1:8080]\n"))
+		require.ErrorContains(t, err, "upstreams.api.balance")
+	})
+
+	t.Run("forwarded", func(t *testing.T) {
+		cfg, err := Parse([]byte("listeners:\n  - forwarded: {headers: [X-Forwarded-For], trusted: [10.0.0.0/8]}\n"))
+		require.NoError(t, err)
+		fwd, err := cfg.Listeners[0].Forwarded.Config("http")
+		require.NoError(t, err)
+		require.True(t, fwd.XForwardedFor)
+		require.Len(t, fwd.Trusted, 1)
+
+		_, err = Parse([]byte("listeners:\n  - forwarded: {headers: [x-real-ip], trusted: [10.0.0.0/33]}\n"))
+		require.ErrorContains(t, err, "listeners.0.forwarded.headers.0")
+		require.ErrorContains(t, err, "listeners.0.forwarded.trusted.0")
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		_, err := Parse([]byte("errors:\n  content_type: \"text/html\\r\\nX-Injected: 1\"\n"))
+		require.ErrorContains(t, err, "errors.content_type")
+	})
+
+	t.Run("proxy protocol", func(t *testing.T) {
+		config := `
+upstreams:
+  api:
+    addrs: [127.0.0.1:8080]
+routing:
+  default: { upstream: api, proxy_protocol: v2 }
+  routes:
+    - host: example.com
+      upstream: api
+    - host: v1.example.com
+      upstream: api
+      proxy_protocol: v1
+`
+		cfg, err := Parse([]byte(config))
+		require.NoError(t, err)
+		table, err := cfg.Table()
+		require.NoError(t, err)
+		require.Len(t, table.Upstreams(), 1)
+
+		for host, version := range map[string]int{"example.com": 0, "v1.example.com": 1, "example.org": 2} {
+			upstream, found := table.Lookup(host)
+			require.True(t, found)
+			require.Equal(t, version, upstream.ProxyProtocol, host)
+		}
+
+		cfg, err = Parse([]byte("upstreams:\n  api:\n    addrs: [127.0.0.1:8080]\nrouting:\n  default: api\n"))
+		require.NoError(t, err)
+		require.Equal(t, DefaultRoute{Upstream: "api"}, cfg.Routing.Default)
+
+		_, err = Parse([]byte("upstreams:\n  api:\n    addrs: [127.0.0.1:8080]\nrouting:\n  default: { upstream: api, proxy_protocol: v3 }\n"))
+		require.ErrorContains(t, err, "routing.default.proxy_protocol")
+	})
+
+	t.Run("passthrough", func(t *testing.T) {
+		config := `
+listeners:
+  - addr: 127.0.0.1:443
+    mode: passthrough
+upstreams:
+  web: {addrs: [127.0.0.1:8080]}
+  tls: {addrs: [127.0.0.1:8443]}
+routing:
+  routes:
+    - {host: example.com, upstream: web}
+    - {host: example.com, upstream: tls, passthrough: true}
+`
+		cfg, err := Parse([]byte(config))
+		require.NoError(t, err)
+		table, err := cfg.Table()
+		require.NoError(t, err)
+		upstream, found := table.Lookup("example.com")
+		require.True(t, found)
+		require.Equal(t, "web", upstream.Name)
+		upstream, found = table.Passthrough().Lookup("example.com")
+		require.True(t, found)
+		require.Equal(t, "tls", upstream.Name)
+
+		_, err = Parse([]byte("listeners:\n  - mode: tcp\n"))
+		require.ErrorContains(t, err, "listeners.0.mode")
+	})
+
+	t.Run("sniff", func(t *testing.T) {
+		config := `
+listeners:
+  - addr: 127.0.0.1:443
+    mode: sniff
+    raw: ssh
+    timeouts: {peek: 1s}
+upstreams:
+  ssh: {addrs: [127.0.0.1:22]}
+`
+		cfg, err := Parse([]byte(config))
+		require.NoError(t, err)
+		require.Equal(t, time.Second, cfg.Listeners[0].Timeouts.Peek)
+		table, err := cfg.Table()
+		require.NoError(t, err)
+		upstream, found := table.Raw("ssh")
+		require.True(t, found)
+		require.Equal(t, "ssh", upstream.Name)
+
+		_, err = Parse([]byte("listeners:\n  - mode: sniff\n    raw: ssh\n"))
+		require.ErrorContains(t, err, "listeners.0.raw")
+		_, err = Parse([]byte(strings.Replace(config, "mode: sniff", "mode: http", 1)))
+		require.ErrorContains(t, err, "listeners.0.raw")
+	})
+
+	t.Run("path routing", func(t *testing.T) {
+		config := `
+upstreams:
+  api: {addrs: [127.0.0.1:8080]}
+  web: {addrs: [127.0.0.1:8081]}
+routing:
+  routes:
+    - {host: example.com, upstream: web}
+    - {host: example.com, upstream: api, path: /api/*, methods: [GET, POST]}
+`
+		cfg, err := Parse([]byte(config))
+		require.NoError(t, err)
+		table, err := cfg.Table()
+		require.NoError(t, err)
+		upstream, found := table.Match("example.com", "", scan.Request{Method: []byte("GET"), Target: []byte("/api/users")})
+		require.True(t, found)
+		require.Equal(t, "api", upstream.Name)
+		upstream, _ = table.Match("example.com", "", scan.Request{Method: []byte("PUT"), Target: []byte("/api/users")})
+		require.Equal(t, "web", upstream.Name)
+
+		for field, invalid := range map[string]string{
+			"path":        "path: api",
+			"path_regex":  "path_regex: '('",
+			"methods":     "methods: ['']",
+			"passthrough": "passthrough: true, path: /api/*",
+		} {
+			_, err = Parse([]byte(strings.Replace(config, "path: /api/*, methods: [GET, POST]", invalid, 1)))
+			require.ErrorContains(t, err, "routing.routes.1."+field)
+		}
+	})
+
+	t.Run("aliases", func(t *testing.T) {
+		config := `
+upstreams:
+  web: {addrs: [127.0.0.1:8080]}
+routing:
+  routes:
+    - {host: example.com, aliases: [www.example.com, "example.net:8080"], upstream: web}
+`
+		cfg, err := Parse([]byte(config))
+		require.NoError(t, err)
+		table, err := cfg.Table()
+		require.NoError(t, err)
+		_, found := table.Lookup("www.example.com")
+		require.True(t, found)
+		_, found = table.Match("example.net", "8080", scan.Request{})
+		require.True(t, found)
+		_, found = table.Lookup("www.example.net")
+		require.False(t, found)
+
+		_, err = Parse([]byte(strings.Replace(config, "www.example.com", "example.com", 1)))
+		require.ErrorContains(t, err, "routing.routes.0.aliases.0")
+		_, err = Parse([]byte(strings.Replace(config, "example.net:8080", "*.example.net:8080", 1)))
+		require.ErrorContains(t, err, "routing.routes.0.aliases.1")
+	})
+
+	t.Run("rewriting rules", func(t *testing.T) {
+		config := `
+upstreams:
+  api: {addrs: [127.0.0.1:8080]}
+routing:
+  default: api
+  routes:
+    - host: example.com
+      upstream: api
+      headers: {remove: [Proxy-Authorization], set: {X-Env: prod}}
+      path_rewrite: {strip_prefix: /billing}
+`
+		cfg, err := Parse([]byte(config))
+		require.NoError(t, err)
+		table, err := cfg.Table()
+		require.NoError(t, err)
+		upstream, _ := table.Lookup("example.com")
+		require.NotNil(t, upstream.Headers)
+		require.NotNil(t, upstream.Path)
+		fallback, _ := table.Lookup("other.com")
+		require.Nil(t, fallback.Headers)
+		require.Nil(t, fallback.Path)
+		require.Equal(t, upstream.Balancer, fallback.Balancer)
+
+		for _, invalid := range []string{"{remove: [Content-Length]}", "{set: {X-Env: \"a\\r\\nb\"}}"} {
+			_, err = Parse([]byte(strings.Replace(config, "{remove: [Proxy-Authorization], set: {X-Env: prod}}", invalid, 1)))
+			require.ErrorContains(t, err, "routing.routes.0.headers")
+		}
+
+		for _, invalid := range []string{"{strip_prefix: billing}", "{replacement: /x}", "{regex: '('}"} {
+			_, err = Parse([]byte(strings.Replace(config, "{strip_prefix: /billing}", invalid, 1)))
+			require.ErrorContains(t, err, "routing.routes.0.path_rewrite")
+		}
+	})
+
+	t.Run("responses", func(t *testing.T) {
+		page := filepath.Join(t.TempDir(), "maintenance.html")
+		require.NoError(t, os.WriteFile(page, []byte("<h1>back soon</h1>"), 0o644))
+
+		config := `
+upstreams:
+  web: {addrs: [127.0.0.1:8080]}
+routing:
+  routes:
+    - {host: old.example.com, redirect: {to: "https://example.com", preserve_path: true}}
+    - {host: example.com, upstream: web, https_redirect: true}
+    - {host: example.com, path: /legacy/*, respond: {status: 410}}
+    - {host: status.example.com, respond: {status: 503, file: ` + page + `}}
+`
+		cfg, err := Parse([]byte(config))
+		require.NoError(t, err)
+		table, err := cfg.Table()
+		require.NoError(t, err)
+		require.Len(t, table.Upstreams(), 1)
+
+		upstream, _ := table.Lookup("old.example.com")
+		require.IsType(t, &respond.Redirect{}, upstream.Respond)
+		upstream, _ = table.Lookup("example.com")
+		require.True(t, upstream.HTTPSOnly)
+		require.Nil(t, upstream.Respond)
+		require.Equal(t, "web", upstream.Name)
+		upstream, _ = table.Lookup("status.example.com")
+		response := upstream.Respond.Response("status.example.com", scan.Request{Method: []byte("GET")}, false)
+		require.True(t, strings.HasSuffix(string(response), "<h1>back soon</h1>"))
+
+		for field, invalid := range map[string]string{
+			"redirect":    "{host: old.example.com, redirect: {to: /, status: 200}}",
+			"upstream":    "{host: old.example.com, upstream: web, redirect: {to: /}}",
+			"respond":     "{host: old.example.com, redirect: {to: /}, respond: {status: 410}}",
+			"passthrough": "{host: old.example.com, redirect: {to: /}, passthrough: true}",
+		} {
+			_, err = Parse([]byte(strings.Replace(config, `{host: old.example.com, redirect: {to: "https://example.com", preserve_path: true}}`, invalid, 1)))
+			require.ErrorContains(t, err, "routing.routes.0."+field)
+		}
+
+		_, err = Parse([]byte(strings.Replace(config, "file: "+page, "file: "+page+", body: down", 1)))
+		require.ErrorContains(t, err, "routing.routes.3.respond")
+		_, err = Parse([]byte(strings.Replace(config, page, page+".missing", 1)))
+		require.ErrorContains(t, err, "routing.routes.3.respond")
+	})
+
+	t.Run("rate limits", func(t *testing.T) {
+		config := `
+listeners:
+  - addr: 127.0.0.1:80
+    rate_limit:
+      connections: {rate: 10}
+      requests: {rate: 100, per: 1m, burst: 20, key: header:X-Api-Key}
+upstreams:
+  api: {addrs: [127.0.0.1:8080]}
+routing:
+  default: api
+  routes:
+    - {host: example.com, upstream: api, rate_limit: {rate: 5, key: route}}
+`
+		cfg, err := Parse([]byte(config))
+		require.NoError(t, err)
+		connections, err := cfg.Listeners[0].RateLimit.Connections.Limit()
+		require.NoError(t, err)
+		require.Equal(t, ratelimit.Limit{Interval: 100 * time.Millisecond, Burst: 10}, *connections)
+		requests, err := cfg.Listeners[0].RateLimit.Requests.Rule(ratelimit.NewLimiter())
+		require.NoError(t, err)
+		require.Equal(t, "X-Api-Key", requests.Header())
+
+		table, err := cfg.Table()
+		require.NoError(t, err)
+		upstream, _ := table.Lookup("example.com")
+		require.NotNil(t, upstream.RateLimit)
+		fallback, _ := table.Lookup("other.com")
+		require.Nil(t, fallback.RateLimit)
+
+		for path, invalid := range map[string]string{
+			"listeners.0.rate_limit.connections":     "connections: {rate: -1}",
+			"listeners.0.rate_limit.connections.key": "connections: {rate: 10, key: header:X-Api-Key}",
+		} {
+			_, err = Parse([]byte(strings.Replace(config, "connections: {rate: 10}", invalid, 1)))
+			require.ErrorContains(t, err, path)
+		}
+
+		_, err = Parse([]byte(strings.Replace(config, "key: header:X-Api-Key", "key: cookie", 1)))
+		require.ErrorContains(t, err, "listeners.0.rate_limit.requests.key")
+		_, err = Parse([]byte(strings.Replace(config, "    rate_limit:", "    proxy_protocol: true\n    rate_limit:", 1)))
+		require.ErrorContains(t, err, "listeners.0.rate_limit.connections")
+		_, err = Parse([]byte(strings.Replace(config, "key: route", "key: host", 1)))
+		require.ErrorContains(t, err, "routing.routes.0.rate_limit.key")
+		_, err = Parse([]byte(strings.Replace(config, "upstream: api, rate", "upstream: api, passthrough: true, rate", 1)))
+		require.ErrorContains(t, err, "routing.routes.0.passthrough")
+	})
+
+	t.Run("connect", func(t *testing.T) {
+		cfg, err := Parse([]byte("listeners:\n  - connect: {allow: [\"*.example.com:443\"]}\n"))
+		require.NoError(t, err)
+		allowlist, err := cfg.Listeners[0].Connect.Allowlist()
+		require.NoError(t, err)
+		require.True(t, allowlist.Allowed("api.example.com:443"))
+
+		cfg, err = Parse([]byte("listeners:\n  - addr: 127.0.0.1:80\n"))
+		require.NoError(t, err)
+		allowlist, err = cfg.Listeners[0].Connect.Allowlist()
+		require.NoError(t, err)
+		require.Nil(t, allowlist)
+
+		_, err = Parse([]byte("listeners:\n  - connect: {allow: [example.com]}\n"))
+		require.ErrorContains(t, err, "listeners.0.connect.allow.0")
+	})
+
+	t.Run("unknown field", func(t *testing.T) {
+		_, err := Parse([]byte("listeners:\n  - adr: 127.0.0.1:80\n"))
+		require.ErrorContains(t, err, "line 2")
+	})
+
+	t.Run("validation errors", func(t *testing.T) {
+		config := `
+listeners:
+  - addr: localhost
+upstreams:
+  api:
+    addrs: [127.0.0.1:8080]
+routing:
+  routes:
+    - host: a.*.com
+      upstream: api
+    - host: example.com
+      upstream: nope
+`
+		_, err := Parse([]byte(config))
+		require.Error(t, err)
+
+		var errs []*Error
+		for _, e := range err.(interface{ Unwrap() []error }).Unwrap() {
+			var cfgErr *Error
+			require.True(t, errors.As(e, &cfgErr))
+			errs = append(errs, cfgErr)
+		}
+
+		require.Len(t, errs, 3)
+		require.Equal(t, Error{Line: 3, Column: 11, Path: "listeners.0.addr", Err: errs[0].Err}, *errs[0])
+		require.Equal(t, Error{Line: 9, Column: 13, Path: "routing.routes.0.host", Err: errs[1].Err}, *errs[1])
+		require.Equal(t, Error{Line: 12, Column: 17, Path: "routing.routes.1.upstream", Err: errUnknownUpstream}, *errs[2])
+	})
+}
@@ -0,0 +1,436 @@
+package config
+
+import (
+	"at/internal/balance"
+	"at/internal/certs"
+	"at/internal/forwarded"
+	"at/internal/health"
+	"at/internal/pages"
+	"at/internal/ratelimit"
+	"at/internal/route"
+	"at/internal/tunnel"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var (
+	errUnknownUpstream = errors.New("unknown upstream")
+	errNotPositive     = errors.New("must be positive")
+)
+
+// Error is a validation error, pointing at the invalid value in the configuration file
+type Error struct {
+	Line, Column int
+	// Path is a dot-separated path to the invalid value, e.g. listeners.0.addr
+	Path string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d:%d: %s: %s", e.Line, e.Column, e.Path, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+type validator struct {
+	root *yaml.Node
+	errs []error
+}
+
+func validate(cfg Config, root *yaml.Node) error {
+	v := &validator{root: root}
+
+	if len(cfg.Listeners) == 0 {
+		v.fail(errors.New("at least one listener is required"), "listeners")
+	}
+
+	addrs := make(map[string]bool, len(cfg.Listeners))
+	for i, listener := range cfg.Listeners {
+		v.listener(listener, "listeners", strconv.Itoa(i))
+		if len(listener.Raw) > 0 {
+			if _, found := cfg.Upstreams[listener.Raw]; !found {
+				v.fail(errUnknownUpstream, "listeners", strconv.Itoa(i), "raw")
+			}
+		}
+
+		if addrs[listener.Addr] {
+			v.fail(errors.New("duplicate listener address"), "listeners", strconv.Itoa(i), "addr")
+		}
+
+		addrs[listener.Addr] = true
+	}
+
+	for name, upstream := range cfg.Upstreams {
+		v.upstream(upstream, "upstreams", name)
+	}
+
+	v.routing(cfg)
+	v.pool(cfg.Pool)
+
+	if _, err := pages.New(cfg.Errors.ContentType, nil); err != nil {
+		v.fail(err, "errors", "content_type")
+	}
+
+	for key, text := range cfg.Errors.Templates {
+		if _, err := pages.New("", map[string]string{key: text}); err != nil {
+			v.fail(err, "errors", "templates", key)
+		}
+	}
+
+	if len(cfg.Logging.Output) == 0 {
+		v.fail(errors.New("must be stdout, stderr or a path to the file"), "logging", "output")
+	}
+
+	return errors.Join(v.errs...)
+}
+
+func (v *validator) listener(listener Listener, path ...string) {
+	switch listener.Network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		v.fail(errors.New("must be tcp, tcp4 or tcp6"), append(path, "network")...)
+	}
+
+	switch listener.Mode {
+	case ModeHTTP:
+	case ModePassthrough:
+		if listener.TLS.Enabled() {
+			v.fail(errors.New("must not be set for passthrough listeners"), append(path, "tls", "certs")...)
+		}
+	case ModeSniff:
+	default:
+		v.fail(errors.New("must be http, passthrough or sniff"), append(path, "mode")...)
+	}
+
+	if len(listener.Raw) > 0 && listener.Mode != ModeSniff {
+		v.fail(errors.New("must be set only for sniffing listeners"), append(path, "raw")...)
+	}
+
+	v.addr(listener.Addr, append(path, "addr")...)
+	v.positive(int(listener.Timeouts.Read), append(path, "timeouts", "read")...)
+	v.positive(int(listener.Timeouts.Write), append(path, "timeouts", "write")...)
+	v.positive(int(listener.Timeouts.Drain), append(path, "timeouts", "drain")...)
+	v.positive(int(listener.Timeouts.Tunnel), append(path, "timeouts", "tunnel")...)
+	v.positive(int(listener.Timeouts.Peek), append(path, "timeouts", "peek")...)
+	v.positive(listener.Buffers.Client, append(path, "buffers", "client")...)
+	v.positive(listener.Buffers.Upstream, append(path, "buffers", "upstream")...)
+	v.positive(listener.Buffers.ArenaInitial, append(path, "buffers", "arena_initial")...)
+
+	if listener.Buffers.ArenaMax < listener.Buffers.ArenaInitial {
+		v.fail(errors.New("must not be less than arena_initial"), append(path, "buffers", "arena_max")...)
+	}
+
+	v.forwarded(listener.Forwarded, append(path, "forwarded")...)
+
+	for i, dst := range listener.Connect.Allow {
+		if _, err := tunnel.NewAllowlist([]string{dst}); err != nil {
+			v.fail(err, append(path, "connect", "allow", strconv.Itoa(i))...)
+		}
+	}
+	v.tls(listener.TLS, append(path, "tls")...)
+	v.listenerRateLimit(listener, append(path, "rate_limit")...)
+}
+
+func (v *validator) listenerRateLimit(listener Listener, path ...string) {
+	connections, requests := listener.RateLimit.Connections, listener.RateLimit.Requests
+	v.rateLimit(connections, append(path, "connections")...)
+	v.rateLimit(requests, append(path, "requests")...)
+
+	if len(connections.Key) > 0 && connections.Key != "ip" {
+		v.fail(errors.New("connections are told apart by ip only"), append(path, "connections", "key")...)
+	}
+
+	// the client address of PROXY protocol connections isn't known on accept yet
+	if connections != (RateLimit{}) && listener.ProxyProtocol {
+		v.fail(errors.New("must not be set along with proxy_protocol"), append(path, "connections")...)
+	}
+
+	if requests != (RateLimit{}) && listener.Mode == ModePassthrough {
+		v.fail(errors.New("must not be set for passthrough listeners"), append(path, "requests")...)
+	}
+}
+
+func (v *validator) rateLimit(r RateLimit, path ...string) {
+	_, err := r.Rule(nil)
+	switch {
+	case errors.Is(err, ratelimit.ErrBadKey):
+		v.fail(err, append(path, "key")...)
+	case err != nil:
+		v.fail(err, path...)
+	}
+}
+
+func (v *validator) tls(t TLS, path ...string) {
+	for i, pair := range t.Pairs() {
+		if err := certs.Load(pair); err != nil {
+			v.fail(err, append(path, "certs", strconv.Itoa(i))...)
+		}
+	}
+
+	v.positive(int(t.Reload), append(path, "reload")...)
+	v.positive(int(t.TicketRotation), append(path, "ticket_rotation")...)
+}
+
+func (v *validator) forwarded(f Forwarded, path ...string) {
+	for i, header := range f.Headers {
+		if _, err := forwarded.NewConfig([]string{header}, nil, ""); err != nil {
+			v.fail(err, append(path, "headers", strconv.Itoa(i))...)
+		}
+	}
+
+	for i, trusted := range f.Trusted {
+		if _, err := forwarded.NewConfig(nil, []string{trusted}, ""); err != nil {
+			v.fail(errors.New("must be an IP address or CIDR"), append(path, "trusted", strconv.Itoa(i))...)
+		}
+	}
+}
+
+func (v *validator) upstream(upstream Upstream, path ...string) {
+	if len(upstream.Addrs) == 0 {
+		v.fail(route.ErrNoAddrs, append(path, "addrs")...)
+	}
+
+	for i, backend := range upstream.Addrs {
+		v.addr(backend.Addr, append(path, "addrs", strconv.Itoa(i))...)
+		v.positive(backend.Weight, append(path, "addrs", strconv.Itoa(i), "weight")...)
+	}
+
+	switch upstream.Balance {
+	case "", balance.RoundRobin, balance.LeastOutstanding, balance.RandomTwo, balance.Hash:
+	default:
+		v.fail(errors.New("must be round_robin, least_outstanding, random_two or hash"), append(path, "balance")...)
+	}
+
+	v.health(upstream.Health.Defaults(), append(path, "health")...)
+
+	switch {
+	case len(upstream.HashKey) == 0, upstream.HashKey == "ip":
+	case strings.HasPrefix(upstream.HashKey, hashHeaderPrefix) && len(upstream.HashHeader()) > 0:
+	default:
+		v.fail(errors.New("must be either ip or header:<name>"), append(path, "hash_key")...)
+	}
+}
+
+func (v *validator) health(h Health, path ...string) {
+	switch h.Check {
+	case health.TCP, health.HTTP, health.None:
+	default:
+		v.fail(errors.New("must be tcp, http or none"), append(path, "check")...)
+	}
+
+	if !strings.HasPrefix(h.Path, "/") {
+		v.fail(errors.New("must start with a slash"), append(path, "path")...)
+	}
+
+	if h.Status != 0 && (h.Status < 100 || h.Status > 599) {
+		v.fail(errors.New("must be a valid status code"), append(path, "status")...)
+	}
+
+	v.positive(int(h.Interval), append(path, "interval")...)
+	v.positive(int(h.Timeout), append(path, "timeout")...)
+	v.positive(int(h.HealthyThreshold), append(path, "healthy_threshold")...)
+	v.positive(int(h.UnhealthyThreshold), append(path, "unhealthy_threshold")...)
+}
+
+func (v *validator) routing(cfg Config) {
+	switch cfg.Routing.UnknownHostStatus {
+	case 404, 421:
+	default:
+		v.fail(errors.New("must be either 404 or 421"), "routing", "unknown_host_status")
+	}
+
+	if len(cfg.Routing.Default.Upstream) > 0 {
+		if _, found := cfg.Upstreams[cfg.Routing.Default.Upstream]; !found {
+			v.fail(errUnknownUpstream, "routing", "default")
+		}
+	}
+
+	if _, err := proxyProtocolVersion(cfg.Routing.Default.ProxyProtocol); err != nil {
+		v.fail(err, "routing", "default", "proxy_protocol")
+	}
+
+	if _, err := cfg.Routing.Default.Headers.Rewrite(); err != nil {
+		v.fail(err, "routing", "default", "headers")
+	}
+
+	if _, err := cfg.Routing.Default.PathRewrite.Rewrite(); err != nil {
+		v.fail(err, "routing", "default", "path_rewrite")
+	}
+
+	v.rateLimit(cfg.Routing.Default.RateLimit, "routing", "default", "rate_limit")
+
+	// routes are added to the scratch table in order to catch malformed and duplicate hosts
+	table := route.NewTable(cfg.Routing.UnknownHostStatus)
+	balancer, _ := balance.New(balance.RoundRobin, []*balance.Backend{balance.NewBackend("", 1, balance.Thresholds{})}, "")
+	scratch := &route.Upstream{Balancer: balancer}
+	for i, r := range cfg.Routing.Routes {
+		path := []string{"routing", "routes", strconv.Itoa(i)}
+
+		if _, err := proxyProtocolVersion(r.ProxyProtocol); err != nil {
+			v.fail(err, append(path, "proxy_protocol")...)
+		}
+
+		headers, err := r.Headers.Rewrite()
+		if err != nil {
+			v.fail(err, append(path, "headers")...)
+		}
+
+		pathRewrite, err := r.PathRewrite.Rewrite()
+		if err != nil {
+			v.fail(err, append(path, "path_rewrite")...)
+		}
+
+		v.rateLimit(r.RateLimit, append(path, "rate_limit")...)
+
+		// invalid responses are reported on their own, so the upstream is not expected either
+		redirect, redirectErr := r.Redirect.Responder()
+		if redirectErr != nil {
+			v.fail(redirectErr, append(path, "redirect")...)
+		}
+
+		fixed, respondErr := r.Respond.Responder()
+		if respondErr != nil {
+			v.fail(respondErr, append(path, "respond")...)
+		}
+
+		responded := redirect != nil || fixed != nil || redirectErr != nil || respondErr != nil
+		switch _, found := cfg.Upstreams[r.Upstream]; {
+		case redirect != nil && fixed != nil:
+			v.fail(errors.New("must not be set along with redirect"), append(path, "respond")...)
+		case responded && len(r.Upstream) > 0:
+			v.fail(errors.New("must not be set along with redirect or respond"), append(path, "upstream")...)
+		case !responded && !found:
+			v.fail(errUnknownUpstream, append(path, "upstream")...)
+			continue
+		}
+
+		matcher, err := r.Matcher()
+		switch {
+		case errors.Is(err, route.ErrBadMethod):
+			v.fail(err, append(path, "methods")...)
+			continue
+		case errors.Is(err, route.ErrBadPath):
+			v.fail(err, append(path, "path")...)
+			continue
+		case err != nil:
+			v.fail(err, append(path, "path_regex")...)
+			continue
+		}
+
+		target := table
+		if r.Passthrough {
+			if !matcher.Any() {
+				v.fail(errors.New("must not narrow passthrough routes down"), append(path, "passthrough")...)
+			}
+
+			if headers != nil || pathRewrite != nil {
+				v.fail(errors.New("must not rewrite passthrough routes"), append(path, "passthrough")...)
+			}
+
+			if responded || r.HTTPSRedirect {
+				v.fail(errors.New("must not respond to passthrough routes"), append(path, "passthrough")...)
+			}
+
+			if r.RateLimit != (RateLimit{}) {
+				v.fail(errors.New("must not limit passthrough routes"), append(path, "passthrough")...)
+			}
+
+			target = table.Passthrough()
+		}
+
+		if err = target.AddMatching(r.Host, matcher, scratch); err != nil {
+			v.fail(err, append(path, "host")...)
+		}
+
+		for j, alias := range r.Aliases {
+			if err = target.AddMatching(alias, matcher, scratch); err != nil {
+				v.fail(err, append(path, "aliases", strconv.Itoa(j))...)
+			}
+		}
+	}
+}
+
+func (v *validator) pool(pool Pool) {
+	v.nonNegative(pool.MaxIdlePerHost, "pool", "max_idle_per_host")
+	v.nonNegative(pool.MaxPerHost, "pool", "max_per_host")
+	v.positive(int(pool.IdleTimeout), "pool", "idle_timeout")
+	v.positive(int(pool.Wait), "pool", "wait")
+	v.positive(int(pool.ConnectTimeout), "pool", "connect_timeout")
+	v.positive(int(pool.ReadTimeout), "pool", "read_timeout")
+	v.positive(int(pool.WriteTimeout), "pool", "write_timeout")
+
+	if pool.MaxPerHost > 0 && pool.MaxIdlePerHost > pool.MaxPerHost {
+		v.fail(errors.New("must not be greater than max_per_host"), "pool", "max_idle_per_host")
+	}
+}
+
+func (v *validator) addr(addr string, path ...string) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		v.fail(errors.New("must be in form of host:port"), path...)
+	}
+}
+
+func (v *validator) positive(value int, path ...string) {
+	if value <= 0 {
+		v.fail(errNotPositive, path...)
+	}
+}
+
+func (v *validator) nonNegative(value int, path ...string) {
+	if value < 0 {
+		v.fail(errors.New("must not be negative"), path...)
+	}
+}
+
+func (v *validator) fail(err error, path ...string) {
+	line, column := position(v.root, path)
+	v.errs = append(v.errs, &Error{
+		Line:   line,
+		Column: column,
+		Path:   strings.Join(path, "."),
+		Err:    err,
+	})
+}
+
+// position returns the position of the value by its path. In case the value isn't presented
+// (e.g. it's omitted, so the default is used), the position of the closest parent is returned
+func position(node *yaml.Node, path []string) (line, column int) {
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+
+	line, column = node.Line, node.Column
+
+	for _, key := range path {
+		var next *yaml.Node
+
+		switch node.Kind {
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == key {
+					next = node.Content[i+1]
+					break
+				}
+			}
+		case yaml.SequenceNode:
+			if i, err := strconv.Atoi(key); err == nil && i < len(node.Content) {
+				next = node.Content[i]
+			}
+		}
+
+		if next == nil {
+			break
+		}
+
+		node = next
+		line, column = node.Line, node.Column
+	}
+
+	return line, column
+}
@@ -0,0 +1,24 @@
+//go:build !unix
+
+package connect
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// alive checks whether the connection is still usable. The idle connection must neither
+// be closed by the upstream, nor have any unsolicited data. Already expired deadline fails
+// the read without even trying, so the tiny one is set instead
+func (c *Conn) alive() bool {
+	if err := c.conn.SetReadDeadline(time.Now().Add(time.Millisecond)); err != nil {
+		return false
+	}
+
+	var probe [1]byte
+	_, err := c.conn.Read(probe[:])
+	var netErr net.Error
+
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,41 @@
+//go:build unix
+
+package connect
+
+import (
+	"errors"
+	"syscall"
+)
+
+// alive checks whether the connection is still usable. The idle connection must neither
+// be closed by the upstream, nor have any unsolicited data. The socket is peeked without
+// blocking, so the check is almost free
+func (c *Conn) alive() bool {
+	sc, ok := c.conn.(syscall.Conn)
+	if !ok {
+		return true
+	}
+
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return false
+	}
+
+	var (
+		probe   [1]byte
+		n       int
+		peekErr error
+	)
+
+	err = raw.Read(func(fd uintptr) bool {
+		n, _, peekErr = syscall.Recvfrom(int(fd), probe[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+		// returning true prevents waiting for the socket to become readable
+		return true
+	})
+	if err != nil {
+		return false
+	}
+
+	// nothing to read means the connection is just idle, as expected
+	return n == -1 && errors.Is(peekErr, syscall.EAGAIN)
+}
@@ -0,0 +1,341 @@
+package connect
+
+import (
+	"at/internal/server/tcp"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+var ErrPoolExhausted = errors.New("no free upstream connection")
+
+type Limits struct {
+	// MaxIdlePerHost limits the number of idle connections, kept for a single address. Zero
+	// disables pooling at all
+	MaxIdlePerHost int
+	// MaxPerHost limits the number of both idle and busy connections to a single address.
+	// Zero means no limit
+	MaxPerHost int
+	// IdleTimeout is how long the connection may stay idle before it's closed
+	IdleTimeout time.Duration
+	// Wait limits the time of waiting for a free connection, when MaxPerHost is reached
+	Wait time.Duration
+	// ConnectTimeout limits establishing new connections. Zero means no limit
+	ConnectTimeout time.Duration
+	// ReadTimeout and WriteTimeout limit I/O of upstream connections. They're pooled along
+	// with connections, so they don't depend on the listener, the connection is opened by
+	ReadTimeout, WriteTimeout time.Duration
+}
+
+// Conn is a connection to the upstream, checked out of the pool
+type Conn struct {
+	tcp.Client
+	conn net.Conn
+	host *host
+	// preface is sent right after the connection is established. Connections with it are
+	// reused only by the same preface
+	preface   string
+	idleSince time.Time
+}
+
+// Pool keeps connections to upstreams for reuse, so they're shared by all the clients
+type Pool struct {
+	limits Limits
+	mu     sync.Mutex
+	hosts  map[string]*host
+}
+
+func NewPool(limits Limits) *Pool {
+	return &Pool{
+		limits: limits,
+		hosts:  make(map[string]*host),
+	}
+}
+
+// Get returns an idle connection to the address, or establishes a new one. In case
+// MaxPerHost is reached, it waits for a connection to be freed at most Wait. Non-empty
+// preface is written to new connections before anything else. Such connections are private,
+// i.e. are reused only by the same preface
+func (p *Pool) Get(addr string, preface []byte, newClient func(conn net.Conn) tcp.Client) (*Conn, error) {
+	h := p.host(addr)
+
+	for {
+		conn := p.popIdle(h, string(preface))
+		if conn == nil {
+			break
+		}
+
+		if time.Since(conn.idleSince) < p.limits.IdleTimeout && conn.alive() {
+			return conn, nil
+		}
+
+		p.Discard(conn)
+	}
+
+	if h.full() {
+		// idle connections with other prefaces are useless for us, but take the slots
+		if conn := p.popOldest(h); conn != nil {
+			p.Discard(conn)
+		}
+	}
+
+	// connections, freed by others, are handed over without a preface, so callers with one
+	// wait for a slot only
+	if len(preface) > 0 {
+		if err := h.acquireSlot(p.limits.Wait); err != nil {
+			return nil, err
+		}
+	} else if conn, err := h.acquire(p.limits.Wait); err != nil || conn != nil {
+		return conn, err
+	}
+
+	return p.dial(h, addr, preface, newClient)
+}
+
+// Dial establishes a new connection, that isn't shared with anyone. It's limited by
+// MaxPerHost as well, and must be discarded after use
+func (p *Pool) Dial(addr string, preface []byte, newClient func(conn net.Conn) tcp.Client) (*Conn, error) {
+	h := p.host(addr)
+	if err := h.acquireSlot(p.limits.Wait); err != nil {
+		return nil, err
+	}
+
+	return p.dial(h, addr, preface, newClient)
+}
+
+// dial establishes a new connection. The slot must be already acquired
+func (p *Pool) dial(
+	h *host, addr string, preface []byte, newClient func(conn net.Conn) tcp.Client,
+) (*Conn, error) {
+	netConn, err := net.DialTimeout("tcp", addr, p.limits.ConnectTimeout)
+	if err != nil {
+		h.release()
+		return nil, err
+	}
+
+	conn := &Conn{
+		Client:  newClient(netConn),
+		conn:    netConn,
+		host:    h,
+		preface: string(preface),
+	}
+
+	if len(preface) > 0 {
+		if err = conn.Write(preface); err != nil {
+			p.Discard(conn)
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+// ConnectTimeout limits establishing connections, that bypass the pool, too
+func (p *Pool) ConnectTimeout() time.Duration {
+	return p.limits.ConnectTimeout
+}
+
+// Timeouts returns read and write timeouts of upstream connections
+func (p *Pool) Timeouts() (read, write time.Duration) {
+	return p.limits.ReadTimeout, p.limits.WriteTimeout
+}
+
+// Put returns the connection to the pool. It must be done only at the response boundary,
+// so the next request over it starts with a clean state
+func (p *Pool) Put(conn *Conn) {
+	// in case someone waits for a free connection, just hand it over. Private ones can't be
+	// handed over, as waiters might have another preface
+	if len(conn.preface) == 0 {
+		select {
+		case conn.host.handover <- conn:
+			return
+		default:
+		}
+	}
+
+	p.mu.Lock()
+	if len(conn.host.idle) >= p.limits.MaxIdlePerHost {
+		p.mu.Unlock()
+		p.Discard(conn)
+		return
+	}
+
+	conn.idleSince = time.Now()
+	conn.host.idle = append(conn.host.idle, conn)
+	p.mu.Unlock()
+}
+
+// Discard closes the connection, so it's never reused
+func (p *Pool) Discard(conn *Conn) {
+	_ = conn.Close()
+	conn.host.release()
+}
+
+// Run closes connections, which have been idle for too long, until the context is done.
+// Then all the idle connections are closed
+func (p *Pool) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.limits.IdleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			p.prune(0)
+			return
+		case <-ticker.C:
+			p.prune(p.limits.IdleTimeout)
+		}
+	}
+}
+
+// prune closes connections, which have been idle for at least the timeout
+func (p *Pool) prune(timeout time.Duration) {
+	var stale []*Conn
+
+	p.mu.Lock()
+	for _, h := range p.hosts {
+		var fresh []*Conn
+		for _, conn := range h.idle {
+			if time.Since(conn.idleSince) >= timeout {
+				stale = append(stale, conn)
+			} else {
+				fresh = append(fresh, conn)
+			}
+		}
+
+		h.idle = fresh
+	}
+	p.mu.Unlock()
+
+	for _, conn := range stale {
+		p.Discard(conn)
+	}
+}
+
+func (p *Pool) host(addr string) *host {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	h, found := p.hosts[addr]
+	if !found {
+		h = newHost(p.limits.MaxPerHost)
+		p.hosts[addr] = h
+	}
+
+	return h
+}
+
+// popIdle returns the most recently used idle connection with the preface, as it's the most
+// likely one to be still alive
+func (p *Pool) popIdle(h *host, preface string) *Conn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i := len(h.idle) - 1; i >= 0; i-- {
+		if h.idle[i].preface == preface {
+			return h.remove(i)
+		}
+	}
+
+	return nil
+}
+
+// popOldest returns the least recently used idle connection
+func (p *Pool) popOldest(h *host) *Conn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(h.idle) == 0 {
+		return nil
+	}
+
+	return h.remove(0)
+}
+
+// host holds connections to a single address
+type host struct {
+	idle []*Conn
+	// slots is a semaphore, limiting the number of connections. It's nil in case
+	// there's no limit
+	slots    chan struct{}
+	handover chan *Conn
+}
+
+func newHost(maxConns int) *host {
+	h := &host{
+		handover: make(chan *Conn),
+	}
+
+	if maxConns > 0 {
+		h.slots = make(chan struct{}, maxConns)
+	}
+
+	return h
+}
+
+// acquire takes a slot for the new connection. In case there are no free slots, a connection,
+// freed by someone else, might be returned instead
+func (h *host) acquire(wait time.Duration) (*Conn, error) {
+	if h.slots == nil {
+		return nil, nil
+	}
+
+	select {
+	case h.slots <- struct{}{}:
+		return nil, nil
+	default:
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case h.slots <- struct{}{}:
+		return nil, nil
+	case conn := <-h.handover:
+		return conn, nil
+	case <-timer.C:
+		return nil, ErrPoolExhausted
+	}
+}
+
+// full tells, whether there are no free slots at the moment
+func (h *host) full() bool {
+	return h.slots != nil && len(h.slots) == cap(h.slots)
+}
+
+// remove removes the idle connection at the index. Must be called under the pool's lock
+func (h *host) remove(i int) *Conn {
+	conn := h.idle[i]
+	copy(h.idle[i:], h.idle[i+1:])
+	h.idle[len(h.idle)-1] = nil
+	h.idle = h.idle[:len(h.idle)-1]
+
+	return conn
+}
+
+// acquireSlot takes a slot for the new connection, that won't be shared, so connections,
+// freed by others, aren't accepted
+func (h *host) acquireSlot(wait time.Duration) error {
+	if h.slots == nil {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case h.slots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return ErrPoolExhausted
+	}
+}
+
+func (h *host) release() {
+	if h.slots != nil {
+		<-h.slots
+	}
+}
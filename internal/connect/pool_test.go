@@ -0,0 +1,183 @@
+package connect
+
+import (
+	"at/internal/server/tcp"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// upstream accepts connections and keeps them, so they can be closed by the test
+func upstream(t *testing.T) (addr string, accepted chan net.Conn) {
+	sock, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = sock.Close() })
+
+	accepted = make(chan net.Conn, 16)
+	go func() {
+		for {
+			conn, err := sock.Accept()
+			if err != nil {
+				return
+			}
+
+			accepted <- conn
+		}
+	}()
+
+	return sock.Addr().String(), accepted
+}
+
+func newClient(conn net.Conn) tcp.Client {
+	return tcp.NewClient(conn, time.Second, time.Second, make([]byte, 64))
+}
+
+func TestPool(t *testing.T) {
+	limits := Limits{
+		MaxIdlePerHost: 1,
+		IdleTimeout:    time.Minute,
+		Wait:           50 * time.Millisecond,
+	}
+
+	t.Run("reuse", func(t *testing.T) {
+		addr, accepted := upstream(t)
+		pool := NewPool(limits)
+
+		first, err := pool.Get(addr, nil, newClient)
+		require.NoError(t, err)
+		pool.Put(first)
+		second, err := pool.Get(addr, nil, newClient)
+		require.NoError(t, err)
+		require.Same(t, first, second)
+		require.Len(t, accepted, 1)
+	})
+
+	t.Run("max idle", func(t *testing.T) {
+		addr, accepted := upstream(t)
+		pool := NewPool(limits)
+
+		first, err := pool.Get(addr, nil, newClient)
+		require.NoError(t, err)
+		second, err := pool.Get(addr, nil, newClient)
+		require.NoError(t, err)
+		pool.Put(first)
+		pool.Put(second)
+		require.Len(t, pool.host(addr).idle, 1)
+		require.Eventually(t, func() bool { return len(accepted) == 2 }, time.Second, time.Millisecond)
+	})
+
+	t.Run("dead connection", func(t *testing.T) {
+		addr, accepted := upstream(t)
+		pool := NewPool(limits)
+
+		first, err := pool.Get(addr, nil, newClient)
+		require.NoError(t, err)
+		pool.Put(first)
+		require.NoError(t, (<-accepted).Close())
+		time.Sleep(10 * time.Millisecond)
+
+		second, err := pool.Get(addr, nil, newClient)
+		require.NoError(t, err)
+		require.NotSame(t, first, second)
+	})
+
+	t.Run("idle timeout", func(t *testing.T) {
+		addr, _ := upstream(t)
+		limits := limits
+		limits.IdleTimeout = time.Millisecond
+		pool := NewPool(limits)
+
+		first, err := pool.Get(addr, nil, newClient)
+		require.NoError(t, err)
+		pool.Put(first)
+		time.Sleep(5 * time.Millisecond)
+
+		second, err := pool.Get(addr, nil, newClient)
+		require.NoError(t, err)
+		require.NotSame(t, first, second)
+	})
+
+	t.Run("max per host", func(t *testing.T) {
+		addr, _ := upstream(t)
+		limits := limits
+		limits.MaxPerHost = 1
+		pool := NewPool(limits)
+
+		first, err := pool.Get(addr, nil, newClient)
+		require.NoError(t, err)
+		_, err = pool.Get(addr, nil, newClient)
+		require.ErrorIs(t, err, ErrPoolExhausted)
+
+		var handedOver atomic.Pointer[Conn]
+		done := make(chan struct{})
+		go func() {
+			conn, err := pool.Get(addr, nil, newClient)
+			require.NoError(t, err)
+			handedOver.Store(conn)
+			close(done)
+		}()
+
+		time.Sleep(10 * time.Millisecond)
+		pool.Put(first)
+		<-done
+		require.Same(t, first, handedOver.Load())
+
+		pool.Discard(first)
+		_, err = pool.Get(addr, nil, newClient)
+		require.NoError(t, err)
+	})
+
+	t.Run("preface", func(t *testing.T) {
+		addr, accepted := upstream(t)
+		limits := limits
+		limits.MaxPerHost = 1
+		pool := NewPool(limits)
+
+		first, err := pool.Get(addr, []byte("hello"), newClient)
+		require.NoError(t, err)
+		received := make([]byte, 5)
+		upstreamConn := <-accepted
+		_, err = upstreamConn.Read(received)
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(received))
+
+		pool.Put(first)
+		second, err := pool.Get(addr, []byte("hello"), newClient)
+		require.NoError(t, err)
+		require.Same(t, first, second)
+
+		// the idle connection with another preface is evicted to free the slot
+		pool.Put(second)
+		third, err := pool.Get(addr, []byte("bye"), newClient)
+		require.NoError(t, err)
+		require.NotSame(t, first, third)
+	})
+
+	t.Run("no handover to preface waiters", func(t *testing.T) {
+		addr, _ := upstream(t)
+		limits := limits
+		limits.MaxPerHost = 1
+		pool := NewPool(limits)
+
+		first, err := pool.Get(addr, nil, newClient)
+		require.NoError(t, err)
+
+		result := make(chan error, 1)
+		go func() {
+			conn, err := pool.Get(addr, []byte("hello"), newClient)
+			if err == nil && conn == first {
+				err = errors.New("the connection without the preface is handed over")
+			}
+
+			result <- err
+		}()
+
+		time.Sleep(10 * time.Millisecond)
+		pool.Put(first)
+		require.ErrorIs(t, <-result, ErrPoolExhausted)
+		require.Len(t, pool.host(addr).idle, 1)
+	})
+}
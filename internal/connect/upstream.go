@@ -0,0 +1,51 @@
+package connect
+
+import (
+	"at/internal/balance"
+	"at/internal/route"
+	"at/internal/server/tcp"
+	"errors"
+	"net"
+)
+
+// Pick obtains a connection to the backend, chosen by the upstream's balancer by the key. In
+// case it fails, the rest of healthy backends are tried in order. If there are no healthy
+// backends at all, every one of them is tried anyway, as health checks might be wrong. Fresh
+// connections are never taken from idle ones, and must be discarded after use
+func (p *Pool) Pick(
+	upstream *route.Upstream, key, preface []byte, fresh bool, newClient func(conn net.Conn) tcp.Client,
+) (conn *Conn, backend *balance.Backend, err error) {
+	dial := func(backend *balance.Backend) (conn *Conn, err error) {
+		if fresh {
+			conn, err = p.Dial(backend.Addr, preface, newClient)
+		} else {
+			conn, err = p.Get(backend.Addr, preface, newClient)
+		}
+
+		// failures are reported to the backend, so it leaves rotation if it's down
+		if err != nil && !errors.Is(err, ErrPoolExhausted) {
+			backend.Report(false)
+		}
+
+		return conn, err
+	}
+
+	picked := upstream.Balancer.Pick(key)
+	if picked != nil {
+		if conn, err = dial(picked); err == nil {
+			return conn, picked, nil
+		}
+	}
+
+	for _, backend = range upstream.Balancer.Backends() {
+		if backend == picked || (picked != nil && !backend.Healthy()) {
+			continue
+		}
+
+		if conn, err = dial(backend); err == nil {
+			return conn, backend, nil
+		}
+	}
+
+	return nil, nil, err
+}
@@ -0,0 +1,264 @@
+package forwarded
+
+import (
+	"at/internal/scan/http1"
+	"bytes"
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+const (
+	XForwardedFor   = "x-forwarded-for"
+	XForwardedProto = "x-forwarded-proto"
+	XForwardedHost  = "x-forwarded-host"
+	Forwarded       = "forwarded"
+)
+
+var ErrUnknownHeader = errors.New("must be x-forwarded-for, x-forwarded-proto, x-forwarded-host or forwarded")
+
+// Config tells, which headers describing the client are passed to upstreams
+type Config struct {
+	XForwardedFor, XForwardedProto, XForwardedHost, Forwarded bool
+	// Trusted are proxies in front of the forwarder. Their headers are kept, and the client is
+	// appended to them. Headers from other clients are stripped, as they might be forged
+	Trusted []netip.Prefix
+	// Proto is the protocol, the client has connected with
+	Proto string
+}
+
+// NewConfig enables headers by their names. Trusted are either addresses or CIDRs
+func NewConfig(headers []string, trusted []string, proto string) (*Config, error) {
+	c := &Config{Proto: proto}
+
+	for _, header := range headers {
+		switch strings.ToLower(header) {
+		case XForwardedFor:
+			c.XForwardedFor = true
+		case XForwardedProto:
+			c.XForwardedProto = true
+		case XForwardedHost:
+			c.XForwardedHost = true
+		case Forwarded:
+			c.Forwarded = true
+		default:
+			return nil, ErrUnknownHeader
+		}
+	}
+
+	for _, cidr := range trusted {
+		prefix, err := parsePrefix(cidr)
+		if err != nil {
+			return nil, err
+		}
+
+		c.Trusted = append(c.Trusted, prefix)
+	}
+
+	return c, nil
+}
+
+func parsePrefix(cidr string) (netip.Prefix, error) {
+	if strings.IndexByte(cidr, '/') != -1 {
+		return netip.ParsePrefix(cidr)
+	}
+
+	addr, err := netip.ParseAddr(cidr)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func (c *Config) trusts(client netip.Addr) bool {
+	for _, prefix := range c.Trusted {
+		if prefix.Contains(client) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Injector splices forwarding headers into requests. The request itself is never copied,
+// instead it's split into pieces around edited lines, so they can be written at once by
+// writev. Injector isn't safe for concurrent use
+type Injector struct {
+	config  *Config
+	buffers net.Buffers
+	// scratch holds injected bytes. It's reused between requests
+	scratch []byte
+}
+
+func NewInjector(config *Config) *Injector {
+	return &Injector{
+		config:  config,
+		scratch: make([]byte, 0, 256),
+	}
+}
+
+// Apply returns pieces of the request with forwarding headers applied. The header section of
+// the request must be complete and end at headersEnd, which is the offset of the terminating
+// empty line. Returned buffers are valid until the next call
+func (i *Injector) Apply(request []byte, headersEnd int, client netip.Addr, host string) net.Buffers {
+	var (
+		trusted = i.config.trusts(client)
+		// cut is the position in the request, everything before which is already added
+		cut int
+		// lastFor and lastForwarded are the ends of the last values of chains, that are
+		// appended to
+		lastFor, lastForwarded = -1, -1
+		hasProto, hasHost      bool
+	)
+
+	i.buffers = i.buffers[:0]
+	i.scratch = i.scratch[:0]
+
+	lines := http1.NewHeaderLines(request[:headersEnd])
+	for line, ok := lines.Next(); ok; line, ok = lines.Next() {
+		key := forwardingKey(line.Name)
+		if len(key) == 0 {
+			continue
+		}
+
+		if !trusted {
+			// forged headers are cut out completely
+			i.buffers = append(i.buffers, request[cut:line.Start])
+			cut = line.End
+			continue
+		}
+
+		switch key {
+		case XForwardedFor:
+			lastFor = valueEnd(request, line.End)
+		case Forwarded:
+			lastForwarded = valueEnd(request, line.End)
+		case XForwardedProto:
+			hasProto = true
+		case XForwardedHost:
+			hasHost = true
+		}
+	}
+
+	// the values are appended to the existing chains. Both of them might be present, so
+	// the earlier one must be spliced first
+	appendFor := func() {
+		start := len(i.scratch)
+		i.scratch = append(i.scratch, ", "...)
+		i.scratch = appendAddr(i.scratch, client)
+		i.buffers = append(i.buffers, request[cut:lastFor], i.scratch[start:])
+		cut = lastFor
+	}
+	appendForwarded := func() {
+		start := len(i.scratch)
+		i.scratch = append(i.scratch, ", "...)
+		i.scratch = i.appendForwardedElement(i.scratch, client, host)
+		i.buffers = append(i.buffers, request[cut:lastForwarded], i.scratch[start:])
+		cut = lastForwarded
+	}
+
+	if i.config.XForwardedFor && lastFor != -1 && i.config.Forwarded && lastForwarded != -1 && lastForwarded < lastFor {
+		appendForwarded()
+		appendFor()
+	} else {
+		if i.config.XForwardedFor && lastFor != -1 {
+			appendFor()
+		}
+
+		if i.config.Forwarded && lastForwarded != -1 {
+			appendForwarded()
+		}
+	}
+
+	// missing headers are added to the end of the header section
+	start := len(i.scratch)
+	if i.config.XForwardedFor && lastFor == -1 {
+		i.scratch = append(i.scratch, "X-Forwarded-For: "...)
+		i.scratch = appendAddr(i.scratch, client)
+		i.scratch = append(i.scratch, "\r\n"...)
+	}
+
+	if i.config.XForwardedProto && !hasProto {
+		i.scratch = append(i.scratch, "X-Forwarded-Proto: "...)
+		i.scratch = append(i.scratch, i.config.Proto...)
+		i.scratch = append(i.scratch, "\r\n"...)
+	}
+
+	if i.config.XForwardedHost && !hasHost {
+		i.scratch = append(i.scratch, "X-Forwarded-Host: "...)
+		i.scratch = append(i.scratch, host...)
+		i.scratch = append(i.scratch, "\r\n"...)
+	}
+
+	if i.config.Forwarded && lastForwarded == -1 {
+		i.scratch = append(i.scratch, "Forwarded: "...)
+		i.scratch = i.appendForwardedElement(i.scratch, client, host)
+		i.scratch = append(i.scratch, "\r\n"...)
+	}
+
+	i.buffers = append(i.buffers, request[cut:headersEnd], i.scratch[start:], request[headersEnd:])
+
+	return i.buffers
+}
+
+// appendForwardedElement appends RFC 7239 forwarded-element
+func (i *Injector) appendForwardedElement(b []byte, client netip.Addr, host string) []byte {
+	b = append(b, "for="...)
+	if client.Is6() {
+		b = append(b, `"[`...)
+		b = appendAddr(b, client)
+		b = append(b, `]"`...)
+	} else {
+		b = appendAddr(b, client)
+	}
+
+	b = append(b, ";proto="...)
+	b = append(b, i.config.Proto...)
+	b = append(b, `;host="`...)
+	for j := 0; j < len(host); j++ {
+		if host[j] == '"' || host[j] == '\\' {
+			b = append(b, '\\')
+		}
+
+		b = append(b, host[j])
+	}
+
+	return append(b, '"')
+}
+
+func appendAddr(b []byte, addr netip.Addr) []byte {
+	if !addr.IsValid() {
+		return append(b, "unknown"...)
+	}
+
+	return addr.AppendTo(b)
+}
+
+func forwardingKey(key []byte) string {
+	for _, known := range [...]string{XForwardedFor, XForwardedProto, XForwardedHost, Forwarded} {
+		if bytes.EqualFold(key, []byte(known)) {
+			return known
+		}
+	}
+
+	return ""
+}
+
+// valueEnd returns the end of the value of the line, that ends at lineEnd, excluding the
+// line ending and trailing whitespaces
+func valueEnd(request []byte, lineEnd int) int {
+	end := lineEnd
+	for end > 0 {
+		switch request[end-1] {
+		case '\n', '\r', ' ', '\t':
+			end--
+			continue
+		}
+
+		break
+	}
+
+	return end
+}
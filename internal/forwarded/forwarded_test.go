@@ -0,0 +1,83 @@
+package forwarded
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/require"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func apply(t *testing.T, config *Config, request, client string) string {
+	injector := NewInjector(config)
+	buffers := injector.Apply([]byte(request), strings.Index(request, "\r\n\r\n")+2, netip.MustParseAddr(client), "example.com")
+
+	return string(bytes.Join(buffers, nil))
+}
+
+func TestInjector(t *testing.T) {
+	all, err := NewConfig([]string{"X-Forwarded-For", "x-forwarded-proto", "x-forwarded-host", "Forwarded"}, []string{"10.0.0.0/8", "::1"}, "http")
+	require.NoError(t, err)
+
+	t.Run("fresh", func(t *testing.T) {
+		request := "GET / HTTP/1.1\r\nHost: example.com\r\n\r\nbody"
+		want := "GET / HTTP/1.1\r\nHost: example.com\r\n" +
+			"X-Forwarded-For: 192.168.0.1\r\n" +
+			"X-Forwarded-Proto: http\r\n" +
+			"X-Forwarded-Host: example.com\r\n" +
+			"Forwarded: for=192.168.0.1;proto=http;host=\"example.com\"\r\n" +
+			"\r\nbody"
+		require.Equal(t, want, apply(t, all, request, "192.168.0.1"))
+	})
+
+	t.Run("untrusted", func(t *testing.T) {
+		request := "GET / HTTP/1.1\r\nx-forwarded-for: 1.1.1.1\r\nHost: example.com\r\n" +
+			"X-Forwarded-Host: evil.com\r\nFORWARDED: for=1.1.1.1\r\nAccept: */*\r\n\r\n"
+		want := "GET / HTTP/1.1\r\nHost: example.com\r\nAccept: */*\r\n" +
+			"X-Forwarded-For: 192.168.0.1\r\n" +
+			"X-Forwarded-Proto: http\r\n" +
+			"X-Forwarded-Host: example.com\r\n" +
+			"Forwarded: for=192.168.0.1;proto=http;host=\"example.com\"\r\n" +
+			"\r\n"
+		require.Equal(t, want, apply(t, all, request, "192.168.0.1"))
+	})
+
+	t.Run("trusted", func(t *testing.T) {
+		request := "GET / HTTP/1.1\r\nForwarded: for=1.1.1.1\r\nHost: example.com\r\n" +
+			"X-Forwarded-For: 1.1.1.1 \r\nX-Forwarded-Proto: https\r\n\r\n"
+		want := "GET / HTTP/1.1\r\nForwarded: for=1.1.1.1, for=10.0.0.1;proto=http;host=\"example.com\"\r\n" +
+			"Host: example.com\r\nX-Forwarded-For: 1.1.1.1, 10.0.0.1 \r\nX-Forwarded-Proto: https\r\n" +
+			"X-Forwarded-Host: example.com\r\n" +
+			"\r\n"
+		require.Equal(t, want, apply(t, all, request, "10.0.0.1"))
+	})
+
+	t.Run("ipv6", func(t *testing.T) {
+		config, err := NewConfig([]string{"forwarded"}, nil, "http")
+		require.NoError(t, err)
+		request := "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"
+		want := "GET / HTTP/1.1\r\nHost: example.com\r\n" +
+			"Forwarded: for=\"[2001:db8::1]\";proto=http;host=\"example.com\"\r\n\r\n"
+		require.Equal(t, want, apply(t, config, request, "2001:db8::1"))
+	})
+
+	t.Run("reuse", func(t *testing.T) {
+		config, err := NewConfig([]string{"x-forwarded-for"}, nil, "http")
+		require.NoError(t, err)
+		injector := NewInjector(config)
+		for _, client := range []string{"1.1.1.1", "2.2.2.2"} {
+			request := []byte("GET / HTTP/1.1\r\n\r\n")
+			buffers := injector.Apply(request, 16, netip.MustParseAddr(client), "")
+			require.Equal(t, "GET / HTTP/1.1\r\nX-Forwarded-For: "+client+"\r\n\r\n", string(bytes.Join(buffers, nil)))
+		}
+	})
+
+	t.Run("config errors", func(t *testing.T) {
+		_, err := NewConfig([]string{"x-real-ip"}, nil, "http")
+		require.ErrorIs(t, err, ErrUnknownHeader)
+		_, err = NewConfig(nil, []string{"10.0.0.0/33"}, "http")
+		require.Error(t, err)
+		_, err = NewConfig(nil, []string{"localhost"}, "http")
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,140 @@
+package health
+
+import (
+	"at/internal/balance"
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	TCP  = "tcp"
+	HTTP = "http"
+	None = "none"
+)
+
+// Check describes the active health check of upstream's backends
+type Check struct {
+	// Kind is either tcp, that only establishes the connection, or http, that also requests
+	// the Path and expects the Status. None disables the check
+	Kind     string
+	Path     string
+	Status   int
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+// Run probes every backend with the interval until the context is done. Results are
+// reported to backends, so they leave and get back to rotation
+func Run(ctx context.Context, check Check, backends []*balance.Backend) {
+	if check.Kind == None {
+		return
+	}
+
+	probe := probeTCP
+	if check.Kind == HTTP {
+		probe = newHTTPProbe(check)
+	}
+
+	var wg sync.WaitGroup
+	for _, backend := range backends {
+		wg.Add(1)
+		go func(backend *balance.Backend) {
+			defer wg.Done()
+			watch(ctx, check, backend, probe)
+		}(backend)
+	}
+
+	wg.Wait()
+}
+
+type probeFunc func(ctx context.Context, addr string) bool
+
+// watch probes the backend and logs changes of its state along with its weight and requests
+// in flight. Backends might become unhealthy by failed requests too, such changes are logged
+// by the following probe
+func watch(ctx context.Context, check Check, backend *balance.Backend, probe probeFunc) {
+	ticker := time.NewTicker(check.Interval)
+	defer ticker.Stop()
+
+	healthy := backend.Healthy()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			probeCtx, cancel := context.WithTimeout(ctx, check.Timeout)
+			ok := probe(probeCtx, backend.Addr)
+			cancel()
+
+			if ctx.Err() != nil {
+				return
+			}
+
+			backend.Probe(ok)
+			if backend.Healthy() != healthy {
+				healthy = !healthy
+				logState(backend, healthy)
+			}
+		}
+	}
+}
+
+func logState(backend *balance.Backend, healthy bool) {
+	state := "unhealthy"
+	if healthy {
+		state = "healthy"
+	}
+
+	log.Printf(
+		"health: %s is %s, weight: %d, in flight: %d",
+		backend.Addr, state, backend.Weight(), backend.Inflight(),
+	)
+}
+
+func probeTCP(ctx context.Context, addr string) bool {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return false
+	}
+
+	_ = conn.Close()
+
+	return true
+}
+
+func newHTTPProbe(check Check) probeFunc {
+	client := &http.Client{
+		// every probe uses a fresh connection, so it checks the backend's ability to accept
+		// new ones, too
+		Transport: &http.Transport{DisableKeepAlives: true},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	return func(ctx context.Context, addr string) bool {
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+check.Path, nil)
+		if err != nil {
+			return false
+		}
+
+		response, err := client.Do(request)
+		if err != nil {
+			return false
+		}
+
+		_ = response.Body.Close()
+
+		if check.Status == 0 {
+			return response.StatusCode >= 200 && response.StatusCode < 300
+		}
+
+		return response.StatusCode == check.Status
+	}
+}
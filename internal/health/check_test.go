@@ -0,0 +1,51 @@
+package health
+
+import (
+	"at/internal/balance"
+	"context"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRun(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusServiceUnavailable)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/healthz", r.URL.Path)
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer server.Close()
+
+	// nothing listens on the address of the closed socket
+	sock, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	dead := sock.Addr().String()
+	require.NoError(t, sock.Close())
+
+	thresholds := balance.Thresholds{Healthy: 2, Unhealthy: 2}
+	alive := balance.NewBackend(strings.TrimPrefix(server.URL, "http://"), 1, thresholds)
+	down := balance.NewBackend(dead, 1, thresholds)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go Run(ctx, Check{Kind: TCP, Interval: time.Millisecond, Timeout: time.Second}, []*balance.Backend{down})
+	go Run(ctx, Check{
+		Kind:     HTTP,
+		Path:     "/healthz",
+		Interval: time.Millisecond,
+		Timeout:  time.Second,
+	}, []*balance.Backend{alive})
+
+	require.Eventually(t, func() bool { return !down.Healthy() && !alive.Healthy() }, time.Second, time.Millisecond)
+
+	status.Store(http.StatusOK)
+	require.Eventually(t, alive.Healthy, time.Second, time.Millisecond)
+	require.False(t, down.Healthy())
+}
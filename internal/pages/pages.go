@@ -0,0 +1,140 @@
+package pages
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// DefaultKey is the key of the template, that is used for status codes without their own one
+const DefaultKey = "default"
+
+const (
+	defaultContentType = "text/plain; charset=utf-8"
+	defaultTemplate    = "{{.Status}} {{.Reason}}\nrequest id: {{.RequestID}}\n"
+)
+
+var (
+	ErrBadKey         = errors.New("must be either a status code or default")
+	ErrBadContentType = errors.New("must not contain line breaks")
+)
+
+// Data is passed to templates
+type Data struct {
+	Status    int
+	Reason    string
+	RequestID string
+}
+
+// Pages renders error responses, that are sent by the forwarder itself
+type Pages struct {
+	contentType string
+	templates   map[int]*template.Template
+	fallback    *template.Template
+}
+
+// New parses templates, keyed by the status code or DefaultKey. Empty content type and
+// missing default template are replaced by built-in ones
+func New(contentType string, templates map[string]string) (*Pages, error) {
+	if len(contentType) == 0 {
+		contentType = defaultContentType
+	}
+
+	// the value is put into responses as is, so it must not break the header section
+	if strings.ContainsAny(contentType, "\r\n") {
+		return nil, ErrBadContentType
+	}
+
+	p := &Pages{
+		contentType: contentType,
+		templates:   make(map[int]*template.Template, len(templates)),
+		fallback:    template.Must(template.New(DefaultKey).Parse(defaultTemplate)),
+	}
+
+	for key, text := range templates {
+		tmpl, err := template.New(key).Parse(text)
+		if err != nil {
+			return nil, err
+		}
+
+		if key == DefaultKey {
+			p.fallback = tmpl
+			continue
+		}
+
+		status, err := strconv.Atoi(key)
+		if err != nil || status < 400 || status > 599 {
+			return nil, ErrBadKey
+		}
+
+		p.templates[status] = tmpl
+	}
+
+	return p, nil
+}
+
+// Default returns pages with built-in content type and template
+func Default() *Pages {
+	p, _ := New("", nil)
+	return p
+}
+
+// Render returns the whole response. The connection must be closed after it's sent
+func (p *Pages) Render(status int, requestID string) []byte {
+	return p.render(status, requestID, 0, true)
+}
+
+// RenderRetry is Render with Retry-After header, telling the client when to repeat the
+// request. The delay is rounded up to whole seconds. Such responses don't necessarily close
+// the connection, so Connection: close is added only if closing is set
+func (p *Pages) RenderRetry(status int, requestID string, retryAfter time.Duration, closing bool) []byte {
+	seconds := int64((retryAfter + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	return p.render(status, requestID, seconds, closing)
+}
+
+// render omits Retry-After, if it's zero
+func (p *Pages) render(status int, requestID string, retryAfter int64, closing bool) []byte {
+	tmpl, found := p.templates[status]
+	if !found {
+		tmpl = p.fallback
+	}
+
+	reason := http.StatusText(status)
+	var body bytes.Buffer
+	if err := tmpl.Execute(&body, Data{Status: status, Reason: reason, RequestID: requestID}); err != nil {
+		// partially rendered body is worse than none
+		body.Reset()
+	}
+
+	response := make([]byte, 0, 160+body.Len())
+	response = append(response, "HTTP/1.1 "...)
+	response = strconv.AppendInt(response, int64(status), 10)
+	response = append(response, ' ')
+	response = append(response, reason...)
+	response = append(response, "\r\nContent-Type: "...)
+	response = append(response, p.contentType...)
+	response = append(response, "\r\nContent-Length: "...)
+	response = strconv.AppendInt(response, int64(body.Len()), 10)
+	response = append(response, "\r\nX-Request-Id: "...)
+	response = append(response, requestID...)
+	if retryAfter > 0 {
+		response = append(response, "\r\nRetry-After: "...)
+		response = strconv.AppendInt(response, retryAfter, 10)
+	}
+
+	if closing {
+		response = append(response, "\r\nConnection: close"...)
+	}
+
+	response = append(response, "\r\n\r\n"...)
+
+	return append(response, body.Bytes()...)
+}
@@ -0,0 +1,39 @@
+package pages
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestPages(t *testing.T) {
+	pages, err := New("text/html", map[string]string{
+		"502":      "<h1>{{.Status}} {{.Reason}}</h1>",
+		DefaultKey: "oops: {{.RequestID}}",
+	})
+	require.NoError(t, err)
+
+	require.Equal(t,
+		"HTTP/1.1 502 Bad Gateway\r\nContent-Type: text/html\r\nContent-Length: 24\r\n"+
+			"X-Request-Id: abc\r\nConnection: close\r\n\r\n<h1>502 Bad Gateway</h1>",
+		string(pages.Render(502, "abc")),
+	)
+	require.Equal(t,
+		"HTTP/1.1 400 Bad Request\r\nContent-Type: text/html\r\nContent-Length: 9\r\n"+
+			"X-Request-Id: abc\r\nConnection: close\r\n\r\noops: abc",
+		string(pages.Render(400, "abc")),
+	)
+
+	require.Contains(t, string(Default().Render(504, "abc")), "\r\n\r\n504 Gateway Timeout\nrequest id: abc\n")
+	require.Contains(t, string(pages.RenderRetry(429, "abc", 1500*time.Millisecond, true)),
+		"X-Request-Id: abc\r\nRetry-After: 2\r\nConnection: close\r\n\r\n")
+	require.Contains(t, string(pages.RenderRetry(429, "abc", time.Millisecond, false)),
+		"X-Request-Id: abc\r\nRetry-After: 1\r\n\r\n")
+
+	_, err = New("text/html\r\nX-Injected: 1", nil)
+	require.ErrorIs(t, err, ErrBadContentType)
+	_, err = New("", map[string]string{"200": "ok"})
+	require.ErrorIs(t, err, ErrBadKey)
+	_, err = New("", map[string]string{"500": "{{.Status"})
+	require.Error(t, err)
+}
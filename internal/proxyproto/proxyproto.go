@@ -0,0 +1,359 @@
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+)
+
+const (
+	V1 = 1
+	V2 = 2
+)
+
+const (
+	// v1MaxLen is the longest possible v1 header, including CRLF
+	v1MaxLen = 107
+	// v2MaxLen limits the length of v2 header including TLVs. The protocol allows up to 64k,
+	// but there's no reason to accept that much
+	v2MaxLen     = 16 + 1024
+	v2HeaderLen  = 16
+	v2VersionCmd = 0x20
+	v2CmdLocal   = 0x0
+	v2CmdProxy   = 0x1
+	v2FamTCP4    = 0x11
+	v2FamTCP6    = 0x21
+	// tlvAuthority carries the host name, the client has requested, e.g. by SNI
+	tlvAuthority = 0x02
+)
+
+var (
+	ErrBadHeader     = errors.New("malformed PROXY protocol header")
+	ErrHeaderTooLong = errors.New("PROXY protocol header is too long")
+
+	v1Signature = []byte("PROXY ")
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// Header describes the original connection. Zero addresses mean, that they're unknown,
+// e.g. the connection was made by the proxy itself for health checking
+type Header struct {
+	Source, Destination netip.AddrPort
+	// Authority is the host name, the client has requested. It's transferred only by v2
+	Authority string
+}
+
+// HeaderOf returns the header, received over the connection, if any. Otherwise it's made
+// of the connection's own addresses
+func HeaderOf(conn net.Conn) Header {
+	if c, ok := conn.(*Conn); ok {
+		return c.header
+	}
+
+	return Header{
+		Source:      addrPort(conn.RemoteAddr()),
+		Destination: addrPort(conn.LocalAddr()),
+	}
+}
+
+func addrPort(addr net.Addr) netip.AddrPort {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.AddrPort()
+	}
+
+	return netip.AddrPort{}
+}
+
+func (h Header) known() bool {
+	return h.Source.IsValid() && h.Destination.IsValid() &&
+		h.Source.Addr().Unmap().Is4() == h.Destination.Addr().Unmap().Is4()
+}
+
+// Append encodes the header of the version
+func (h Header) Append(b []byte, version int) []byte {
+	if version == V1 {
+		return h.appendV1(b)
+	}
+
+	return h.appendV2(b)
+}
+
+func (h Header) appendV1(b []byte) []byte {
+	if !h.known() {
+		return append(b, "PROXY UNKNOWN\r\n"...)
+	}
+
+	src, dst := h.Source.Addr().Unmap(), h.Destination.Addr().Unmap()
+	if src.Is4() {
+		b = append(b, "PROXY TCP4 "...)
+	} else {
+		b = append(b, "PROXY TCP6 "...)
+	}
+
+	b = src.AppendTo(b)
+	b = append(b, ' ')
+	b = dst.AppendTo(b)
+	b = append(b, ' ')
+	b = strconv.AppendUint(b, uint64(h.Source.Port()), 10)
+	b = append(b, ' ')
+	b = strconv.AppendUint(b, uint64(h.Destination.Port()), 10)
+
+	return append(b, "\r\n"...)
+}
+
+func (h Header) appendV2(b []byte) []byte {
+	b = append(b, v2Signature...)
+	if !h.known() {
+		return append(b, v2VersionCmd|v2CmdLocal, 0, 0, 0)
+	}
+
+	src, dst := h.Source.Addr().Unmap(), h.Destination.Addr().Unmap()
+	fam, addrsLen := byte(v2FamTCP4), 12
+	if !src.Is4() {
+		fam, addrsLen = v2FamTCP6, 36
+	}
+
+	length := addrsLen
+	if len(h.Authority) > 0 {
+		length += 3 + len(h.Authority)
+	}
+
+	b = append(b, v2VersionCmd|v2CmdProxy, fam)
+	b = binary.BigEndian.AppendUint16(b, uint16(length))
+	b = append(b, src.AsSlice()...)
+	b = append(b, dst.AsSlice()...)
+	b = binary.BigEndian.AppendUint16(b, h.Source.Port())
+	b = binary.BigEndian.AppendUint16(b, h.Destination.Port())
+
+	if len(h.Authority) > 0 {
+		b = append(b, tlvAuthority)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(h.Authority)))
+		b = append(b, h.Authority...)
+	}
+
+	return b
+}
+
+// Conn is the connection, which PROXY protocol header is already consumed. Its remote
+// address is the original client's one
+type Conn struct {
+	net.Conn
+	header Header
+	// rest is data, that was received along with the header
+	rest []byte
+}
+
+// Accept reads the header of either version from the connection. It must be received
+// in the timeout
+func Accept(conn net.Conn, timeout time.Duration) (*Conn, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	header, rest, err := Read(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+
+	return &Conn{
+		Conn:   conn,
+		header: header,
+		rest:   rest,
+	}, nil
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if len(c.rest) > 0 {
+		n := copy(b, c.rest)
+		c.rest = c.rest[n:]
+
+		return n, nil
+	}
+
+	return c.Conn.Read(b)
+}
+
+// CloseWrite shuts down the writing side of the underlying connection, if it supports that
+func (c *Conn) CloseWrite() error {
+	if conn, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return conn.CloseWrite()
+	}
+
+	return c.Conn.Close()
+}
+
+// RemoteAddr returns the client's address. In case the header doesn't tell it, the address
+// of the proxy is returned
+func (c *Conn) RemoteAddr() net.Addr {
+	if !c.header.Source.IsValid() {
+		return c.Conn.RemoteAddr()
+	}
+
+	return net.TCPAddrFromAddrPort(c.header.Source)
+}
+
+// Read reads the header of either version. As the header is followed by the client's data,
+// it might be partially read, too. It's returned as rest
+func Read(r io.Reader) (header Header, rest []byte, err error) {
+	buff := make([]byte, 0, 256)
+	fill := func(n int) error {
+		if n > cap(buff) {
+			grown := make([]byte, len(buff), n)
+			copy(grown, buff)
+			buff = grown
+		}
+
+		for len(buff) < n {
+			read, err := r.Read(buff[len(buff):cap(buff)])
+			buff = buff[:len(buff)+read]
+			if err != nil {
+				if err == io.EOF {
+					return io.ErrUnexpectedEOF
+				}
+
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	if err = fill(len(v1Signature)); err != nil {
+		return header, nil, err
+	}
+
+	if bytes.HasPrefix(buff, v1Signature) {
+		for {
+			if end := bytes.IndexByte(buff, '\n'); end != -1 {
+				header, err = parseV1(buff[:end+1])
+				return header, buff[end+1:], err
+			}
+
+			if len(buff) >= v1MaxLen {
+				return header, nil, ErrHeaderTooLong
+			}
+
+			if err = fill(len(buff) + 1); err != nil {
+				return header, nil, err
+			}
+		}
+	}
+
+	if err = fill(v2HeaderLen); err != nil {
+		return header, nil, err
+	}
+
+	if !bytes.HasPrefix(buff, v2Signature) || buff[12]&0xf0 != v2VersionCmd {
+		return header, nil, ErrBadHeader
+	}
+
+	length := v2HeaderLen + int(binary.BigEndian.Uint16(buff[14:16]))
+	if length > v2MaxLen {
+		return header, nil, ErrHeaderTooLong
+	}
+
+	if err = fill(length); err != nil {
+		return header, nil, err
+	}
+
+	header, err = parseV2(buff[:length])
+
+	return header, buff[length:], err
+}
+
+// parseV1 parses the line, e.g. PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n
+func parseV1(line []byte) (header Header, err error) {
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return header, ErrBadHeader
+	}
+
+	fields := bytes.Split(line[len(v1Signature):len(line)-2], []byte(" "))
+	switch string(fields[0]) {
+	case "UNKNOWN":
+		// the rest of the line must be ignored
+		return header, nil
+	case "TCP4", "TCP6":
+	default:
+		return header, ErrBadHeader
+	}
+
+	if len(fields) != 5 {
+		return header, ErrBadHeader
+	}
+
+	src, err1 := netip.ParseAddr(string(fields[1]))
+	dst, err2 := netip.ParseAddr(string(fields[2]))
+	srcPort, err3 := strconv.ParseUint(string(fields[3]), 10, 16)
+	dstPort, err4 := strconv.ParseUint(string(fields[4]), 10, 16)
+	if err = errors.Join(err1, err2, err3, err4); err != nil || src.Is4() != (string(fields[0]) == "TCP4") {
+		return header, ErrBadHeader
+	}
+
+	header.Source = netip.AddrPortFrom(src, uint16(srcPort))
+	header.Destination = netip.AddrPortFrom(dst, uint16(dstPort))
+
+	return header, nil
+}
+
+func parseV2(data []byte) (header Header, err error) {
+	payload := data[v2HeaderLen:]
+
+	switch data[12] & 0x0f {
+	case v2CmdLocal:
+		// the connection is established by the proxy on its own, so the real addresses
+		// are used
+		return header, nil
+	case v2CmdProxy:
+	default:
+		return header, ErrBadHeader
+	}
+
+	var addrsLen int
+	switch data[13] {
+	case v2FamTCP4:
+		addrsLen = 12
+	case v2FamTCP6:
+		addrsLen = 36
+	default:
+		// unsupported families must be accepted, but their addresses are ignored
+		return header, nil
+	}
+
+	if len(payload) < addrsLen {
+		return header, ErrBadHeader
+	}
+
+	ipLen := (addrsLen - 4) / 2
+	src, _ := netip.AddrFromSlice(payload[:ipLen])
+	dst, _ := netip.AddrFromSlice(payload[ipLen : 2*ipLen])
+	header.Source = netip.AddrPortFrom(src, binary.BigEndian.Uint16(payload[2*ipLen:]))
+	header.Destination = netip.AddrPortFrom(dst, binary.BigEndian.Uint16(payload[2*ipLen+2:]))
+
+	for tlvs := payload[addrsLen:]; len(tlvs) > 0; {
+		if len(tlvs) < 3 {
+			return header, ErrBadHeader
+		}
+
+		length := 3 + int(binary.BigEndian.Uint16(tlvs[1:3]))
+		if len(tlvs) < length {
+			return header, ErrBadHeader
+		}
+
+		if tlvs[0] == tlvAuthority {
+			header.Authority = string(tlvs[3:length])
+		}
+
+		tlvs = tlvs[length:]
+	}
+
+	return header, nil
+}
@@ -0,0 +1,85 @@
+package proxyproto
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/require"
+	"net/netip"
+	"testing"
+	"testing/iotest"
+)
+
+func TestRead(t *testing.T) {
+	t.Run("v1", func(t *testing.T) {
+		data := "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\nGET / HTTP/1.1\r\n"
+		header, rest, err := Read(iotest.OneByteReader(bytes.NewReader([]byte(data))))
+		require.NoError(t, err)
+		require.Equal(t, netip.MustParseAddrPort("192.168.0.1:56324"), header.Source)
+		require.Equal(t, netip.MustParseAddrPort("192.168.0.11:443"), header.Destination)
+		require.Empty(t, rest)
+
+		header, rest, err = Read(bytes.NewReader([]byte(data)))
+		require.NoError(t, err)
+		require.Equal(t, netip.MustParseAddrPort("192.168.0.1:56324"), header.Source)
+		require.Equal(t, "GET / HTTP/1.1\r\n", string(rest))
+	})
+
+	t.Run("v1 unknown", func(t *testing.T) {
+		header, _, err := Read(bytes.NewReader([]byte("PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n")))
+		require.NoError(t, err)
+		require.Equal(t, Header{}, header)
+	})
+
+	t.Run("v2", func(t *testing.T) {
+		header := Header{
+			Source:      netip.MustParseAddrPort("[2001:db8::1]:56324"),
+			Destination: netip.MustParseAddrPort("[2001:db8::2]:443"),
+			Authority:   "example.com",
+		}
+		data := append(header.Append(nil, V2), "GET"...)
+
+		parsed, rest, err := Read(iotest.OneByteReader(bytes.NewReader(data)))
+		require.NoError(t, err)
+		require.Equal(t, header, parsed)
+		require.Empty(t, rest)
+
+		parsed, rest, err = Read(bytes.NewReader(data))
+		require.NoError(t, err)
+		require.Equal(t, header, parsed)
+		require.Equal(t, "GET", string(rest))
+	})
+
+	t.Run("v2 local", func(t *testing.T) {
+		header, _, err := Read(bytes.NewReader(Header{}.Append(nil, V2)))
+		require.NoError(t, err)
+		require.Equal(t, Header{}, header)
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		for _, data := range []string{
+			"GET / HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			"PROXY TCP4 192.168.0.1 192.168.0.11 56324\r\n",
+			"PROXY TCP4 ::1 ::1 1 2\r\n",
+			"PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\n",
+			"PROXY TCP5 192.168.0.1 192.168.0.11 56324 443\r\n",
+		} {
+			_, _, err := Read(bytes.NewReader([]byte(data)))
+			require.ErrorIs(t, err, ErrBadHeader, data)
+		}
+
+		_, _, err := Read(bytes.NewReader(bytes.Repeat([]byte("PROXY "), 20)))
+		require.ErrorIs(t, err, ErrHeaderTooLong)
+	})
+}
+
+func TestAppend(t *testing.T) {
+	header := Header{
+		Source:      netip.MustParseAddrPort("192.168.0.1:56324"),
+		Destination: netip.MustParseAddrPort("192.168.0.11:443"),
+	}
+	require.Equal(t, "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n", string(header.Append(nil, V1)))
+	require.Equal(t, "PROXY UNKNOWN\r\n", string(Header{}.Append(nil, V1)))
+
+	v2 := header.Append(nil, V2)
+	require.Len(t, v2, 16+12)
+	require.Equal(t, []byte{0x21, 0x11, 0, 12}, v2[12:16])
+}
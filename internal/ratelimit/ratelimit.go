@@ -0,0 +1,168 @@
+package ratelimit
+
+import (
+	"errors"
+	"hash/maphash"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// shards split buckets, so clients rarely contend for the same lock
+	shards = 64
+	// sweepInterval is how often every shard drops buckets, that are full again. Such buckets
+	// are no different from missing ones, so keys of gone clients don't pile up
+	sweepInterval = time.Minute
+)
+
+const (
+	keyIP           = "ip"
+	keyRoute        = "route"
+	keyHeaderPrefix = "header:"
+)
+
+var (
+	ErrBadLimit = errors.New("rate, period and burst must be positive")
+	ErrBadKey   = errors.New("key must be ip, route or header:<name>")
+)
+
+// Limit is the token bucket, that holds up to Burst tokens and gets a new one every
+// Interval. Every request takes a token, and is refused in case there's none
+type Limit struct {
+	Interval time.Duration
+	Burst    int
+}
+
+// NewLimit returns the limit of rate tokens per period, holding up to burst of them
+func NewLimit(rate int, per time.Duration, burst int) (Limit, error) {
+	if rate <= 0 || per <= 0 || burst <= 0 || per < time.Duration(rate) {
+		return Limit{}, ErrBadLimit
+	}
+
+	return Limit{Interval: per / time.Duration(rate), Burst: burst}, nil
+}
+
+// Limiter keeps buckets of clients by their keys. Limits are passed on every call, so they
+// can be changed without losing the state of buckets
+type Limiter struct {
+	seed   maphash.Seed
+	shards [shards]shard
+	// start makes times of buckets monotonic
+	start time.Time
+	now   func() time.Time
+}
+
+type shard struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Duration
+}
+
+// bucket is kept as the time, when it's full again. Every taken token postpones it by the
+// interval of the limit
+type bucket struct {
+	full time.Duration
+}
+
+func NewLimiter() *Limiter {
+	l := &Limiter{
+		seed:  maphash.MakeSeed(),
+		start: time.Now(),
+		now:   time.Now,
+	}
+
+	for i := range l.shards {
+		l.shards[i].buckets = make(map[string]*bucket)
+	}
+
+	return l
+}
+
+// Allow takes a token from the bucket of the key. In case there's none, the time until the
+// next one is returned
+func (l *Limiter) Allow(key []byte, limit Limit) (retryAfter time.Duration, ok bool) {
+	now := l.now().Sub(l.start)
+	s := &l.shards[maphash.Bytes(l.seed, key)%shards]
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now-s.swept >= sweepInterval {
+		s.sweep(now)
+	}
+
+	b, found := s.buckets[string(key)]
+	full := now
+	if found && b.full > now {
+		full = b.full
+	}
+
+	full += limit.Interval
+	// the bucket is empty, when it gets full in more than burst intervals
+	if excess := full - now - limit.Interval*time.Duration(limit.Burst); excess > 0 {
+		return excess, false
+	}
+
+	if !found {
+		b = new(bucket)
+		s.buckets[string(key)] = b
+	}
+
+	b.full = full
+
+	return 0, true
+}
+
+func (s *shard) sweep(now time.Duration) {
+	for key, b := range s.buckets {
+		if b.full <= now {
+			delete(s.buckets, key)
+		}
+	}
+
+	s.swept = now
+}
+
+// Rule limits requests, telling clients apart by the key
+type Rule struct {
+	limit   Limit
+	limiter *Limiter
+	// shared rules have a single bucket for all the clients
+	shared bool
+	header string
+}
+
+// NewRule returns the rule of the limit, that keeps buckets in the limiter. The key is either
+// ip, route, meaning a single bucket for all the requests, or header:<name>. Clients without
+// the header are told apart by ip
+func NewRule(limit Limit, key string, limiter *Limiter) (*Rule, error) {
+	r := &Rule{limit: limit, limiter: limiter}
+
+	switch header, isHeader := strings.CutPrefix(key, keyHeaderPrefix); {
+	case len(key) == 0, key == keyIP:
+	case key == keyRoute:
+		r.shared = true
+	case isHeader && len(header) > 0 && strings.IndexAny(header, " \t\r\n:") == -1:
+		r.header = header
+	default:
+		return nil, ErrBadKey
+	}
+
+	return r, nil
+}
+
+// Allow takes a token from the bucket of the key. The key of shared rules is ignored
+func (r *Rule) Allow(key []byte) (retryAfter time.Duration, ok bool) {
+	if r.shared {
+		key = nil
+	}
+
+	return r.limiter.Allow(key, r.limit)
+}
+
+// Header returns the name of the header, which value is the key. It's empty, unless the rule
+// is keyed by a header
+func (r *Rule) Header() string {
+	return r.header
+}
@@ -0,0 +1,83 @@
+package ratelimit
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	limiter := NewLimiter()
+	clock := limiter.start
+	limiter.now = func() time.Time { return clock }
+
+	limit, err := NewLimit(2, time.Second, 3)
+	require.NoError(t, err)
+	require.Equal(t, Limit{Interval: 500 * time.Millisecond, Burst: 3}, limit)
+
+	for i := 0; i < 3; i++ {
+		_, ok := limiter.Allow([]byte("a"), limit)
+		require.True(t, ok, i)
+	}
+
+	retryAfter, ok := limiter.Allow([]byte("a"), limit)
+	require.False(t, ok)
+	require.Equal(t, 500*time.Millisecond, retryAfter)
+	_, ok = limiter.Allow([]byte("b"), limit)
+	require.True(t, ok)
+
+	clock = clock.Add(200 * time.Millisecond)
+	retryAfter, ok = limiter.Allow([]byte("a"), limit)
+	require.False(t, ok)
+	require.Equal(t, 300*time.Millisecond, retryAfter)
+
+	clock = clock.Add(300 * time.Millisecond)
+	_, ok = limiter.Allow([]byte("a"), limit)
+	require.True(t, ok)
+	_, ok = limiter.Allow([]byte("a"), limit)
+	require.False(t, ok)
+
+	// the limit is passed on every call, so a larger burst applies at once
+	_, ok = limiter.Allow([]byte("a"), Limit{Interval: limit.Interval, Burst: 4})
+	require.True(t, ok)
+
+	// full buckets are dropped by sweeps
+	clock = clock.Add(sweepInterval)
+	for i := range limiter.shards {
+		limiter.shards[i].sweep(clock.Sub(limiter.start))
+		require.Empty(t, limiter.shards[i].buckets)
+	}
+
+	for _, invalid := range [][3]int{{0, 1, 1}, {1, 0, 1}, {1, 1, 0}, {2, 1, 1}} {
+		_, err = NewLimit(invalid[0], time.Duration(invalid[1]), invalid[2])
+		require.ErrorIs(t, err, ErrBadLimit, invalid)
+	}
+}
+
+func TestRule(t *testing.T) {
+	limit := Limit{Interval: time.Second, Burst: 1}
+
+	rule, err := NewRule(limit, "route", NewLimiter())
+	require.NoError(t, err)
+	_, ok := rule.Allow([]byte("a"))
+	require.True(t, ok)
+	_, ok = rule.Allow([]byte("b"))
+	require.False(t, ok)
+
+	rule, err = NewRule(limit, "header:X-Api-Key", NewLimiter())
+	require.NoError(t, err)
+	require.Equal(t, "X-Api-Key", rule.Header())
+	_, ok = rule.Allow([]byte("a"))
+	require.True(t, ok)
+	_, ok = rule.Allow([]byte("b"))
+	require.True(t, ok)
+
+	rule, err = NewRule(limit, "", NewLimiter())
+	require.NoError(t, err)
+	require.Empty(t, rule.Header())
+
+	for _, key := range []string{"header:", "header:X Key", "cookie:session", "IP"} {
+		_, err = NewRule(limit, key, nil)
+		require.ErrorIs(t, err, ErrBadKey, key)
+	}
+}
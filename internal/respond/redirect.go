@@ -0,0 +1,122 @@
+package respond
+
+import (
+	"at/internal/scan"
+	"bytes"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+var (
+	ErrBadRedirectStatus = errors.New("redirect status must be 301, 302, 303, 307 or 308")
+	ErrBadLocation       = errors.New("location must be non-empty without whitespaces, and without ? or # if the path is preserved")
+)
+
+// hostPlaceholder in the location is replaced with the host of the request
+const hostPlaceholder = "{host}"
+
+// HTTPS redirects requests to the same host, path and query over https. Status 308 keeps
+// the method and the body of the request
+var HTTPS, _ = NewRedirect(http.StatusPermanentRedirect, "https://"+hostPlaceholder, true, true)
+
+// Redirect responds with the redirect to the location
+type Redirect struct {
+	status int
+	// location is split around host placeholders
+	location []string
+	// hasQuery is set in case the location already has the query, so the preserved one is
+	// joined to it
+	hasQuery                    bool
+	preservePath, preserveQuery bool
+}
+
+// NewRedirect returns the redirect to the location, where {host} is replaced with the host
+// of the request. The path and the query of the request are appended, if preserved
+func NewRedirect(status int, location string, preservePath, preserveQuery bool) (*Redirect, error) {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return nil, ErrBadRedirectStatus
+	}
+
+	if len(location) == 0 || strings.IndexFunc(location, isSpaceOrControl) != -1 ||
+		(preservePath && strings.ContainsAny(location, "?#")) {
+		return nil, ErrBadLocation
+	}
+
+	if preservePath {
+		// the path starts with its own slash
+		location = strings.TrimSuffix(location, "/")
+	}
+
+	return &Redirect{
+		status:        status,
+		location:      strings.Split(location, hostPlaceholder),
+		hasQuery:      strings.IndexByte(location, '?') != -1,
+		preservePath:  preservePath,
+		preserveQuery: preserveQuery,
+	}, nil
+}
+
+func (r *Redirect) Response(host string, request scan.Request, closing bool) []byte {
+	response := appendStatusLine(make([]byte, 0, 128), r.status)
+	response = append(response, "Location: "...)
+	for i, part := range r.location {
+		if i > 0 {
+			response = appendHost(response, host)
+		}
+
+		response = append(response, part...)
+	}
+
+	start, end := request.PathBounds()
+	if r.preservePath {
+		if path := request.Path(); len(path) > 0 {
+			response = append(response, path...)
+		} else {
+			response = append(response, '/')
+		}
+	}
+
+	if r.preserveQuery && start != -1 && end < len(request.Target) && request.Target[end] == '?' {
+		query := request.Target[end+1:]
+		if fragment := bytes.IndexByte(query, '#'); fragment != -1 {
+			query = query[:fragment]
+		}
+
+		if len(query) > 0 {
+			if r.hasQuery {
+				response = append(response, '&')
+			} else {
+				response = append(response, '?')
+			}
+
+			response = append(response, query...)
+		}
+	}
+
+	response = append(response, "\r\nContent-Length: 0\r\n"...)
+	if closing {
+		response = append(response, "Connection: close\r\n"...)
+	}
+
+	return append(response, "\r\n"...)
+}
+
+// appendHost appends the host, enclosing IPv6 addresses in brackets
+func appendHost(b []byte, host string) []byte {
+	if strings.IndexByte(host, ':') == -1 {
+		return append(b, host...)
+	}
+
+	b = append(b, '[')
+	b = append(b, host...)
+
+	return append(b, ']')
+}
+
+func isSpaceOrControl(r rune) bool {
+	return r <= ' ' || r == 0x7f
+}
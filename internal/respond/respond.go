@@ -0,0 +1,119 @@
+package respond
+
+import (
+	"at/internal/scan"
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrBadStatus = errors.New("status must be between 200 and 599")
+	ErrBadHeader = errors.New("header name must be a non-empty token and value must not contain line breaks")
+	ErrReserved  = errors.New("headers Content-Length, Transfer-Encoding and Connection are set by the forwarder")
+	ErrNoBody    = errors.New("responses with status 204 or 304 must not have a body")
+)
+
+var (
+	headMethod = []byte("HEAD")
+	// reserved headers describe the connection, so they're set by the forwarder only
+	reserved = []string{"content-length", "transfer-encoding", "connection"}
+)
+
+// Responder answers requests by the forwarder itself instead of forwarding them
+type Responder interface {
+	// Response returns the whole response to the request to the host, which is canonical.
+	// Closing is set in case the connection is closed after the response, so it must tell
+	// so. The returned slice must not be modified
+	Response(host string, request scan.Request, closing bool) []byte
+}
+
+// Fixed is the response, that is the same for every request. It's rendered beforehand
+type Fixed struct {
+	// responses are indexed by whether the request is HEAD and whether the connection is
+	// closed afterwards
+	responses [2][2][]byte
+}
+
+// NewFixed returns the response with the status, headers, sorted by their names, and the
+// body. Content-Length is set by the forwarder
+func NewFixed(status int, headers map[string]string, body []byte) (*Fixed, error) {
+	if status < 200 || status > 599 {
+		return nil, ErrBadStatus
+	}
+
+	noBody := status == http.StatusNoContent || status == http.StatusNotModified
+	if noBody && len(body) > 0 {
+		return nil, ErrNoBody
+	}
+
+	names := make([]string, 0, len(headers))
+	for name, value := range headers {
+		if len(name) == 0 || strings.ContainsAny(name, " \t\r\n:") || strings.ContainsAny(value, "\r\n") {
+			return nil, fmt.Errorf("%s: %w", name, ErrBadHeader)
+		}
+
+		for _, header := range reserved {
+			if strings.EqualFold(name, header) {
+				return nil, fmt.Errorf("%s: %w", name, ErrReserved)
+			}
+		}
+
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	head := appendStatusLine(nil, status)
+	for _, name := range names {
+		head = append(head, name...)
+		head = append(head, ": "...)
+		head = append(head, headers[name]...)
+		head = append(head, "\r\n"...)
+	}
+
+	if status != http.StatusNoContent {
+		head = append(head, "Content-Length: "...)
+		head = strconv.AppendInt(head, int64(len(body)), 10)
+		head = append(head, "\r\n"...)
+	}
+
+	f := new(Fixed)
+	for _, closing := range []int{0, 1} {
+		response := append([]byte(nil), head...)
+		if closing == 1 {
+			response = append(response, "Connection: close\r\n"...)
+		}
+
+		response = append(response, "\r\n"...)
+		f.responses[1][closing] = response
+		f.responses[0][closing] = append(response[:len(response):len(response)], body...)
+	}
+
+	return f, nil
+}
+
+func (f *Fixed) Response(_ string, request scan.Request, closing bool) []byte {
+	return f.responses[index(bytes.Equal(request.Method, headMethod))][index(closing)]
+}
+
+func appendStatusLine(b []byte, status int) []byte {
+	b = append(b, "HTTP/1.1 "...)
+	b = strconv.AppendInt(b, int64(status), 10)
+	b = append(b, ' ')
+	b = append(b, http.StatusText(status)...)
+
+	return append(b, "\r\n"...)
+}
+
+func index(flag bool) int {
+	if flag {
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,63 @@
+package respond
+
+import (
+	"at/internal/scan"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+func request(method, target string) scan.Request {
+	return scan.Request{Method: []byte(method), Target: []byte(target), Version: []byte("HTTP/1.1")}
+}
+
+func TestFixed(t *testing.T) {
+	f, err := NewFixed(410, map[string]string{"Content-Type": "text/plain", "Cache-Control": "no-store"}, []byte("gone"))
+	require.NoError(t, err)
+
+	head := "HTTP/1.1 410 Gone\r\nCache-Control: no-store\r\nContent-Type: text/plain\r\nContent-Length: 4\r\n"
+	require.Equal(t, head+"\r\ngone", string(f.Response("example.com", request("GET", "/"), false)))
+	require.Equal(t, head+"Connection: close\r\n\r\ngone", string(f.Response("", request("POST", "/"), true)))
+	require.Equal(t, head+"\r\n", string(f.Response("", request("HEAD", "/"), false)))
+
+	f, err = NewFixed(204, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, "HTTP/1.1 204 No Content\r\n\r\n", string(f.Response("", request("GET", "/"), false)))
+
+	_, err = NewFixed(101, nil, nil)
+	require.ErrorIs(t, err, ErrBadStatus)
+	_, err = NewFixed(304, nil, []byte("body"))
+	require.ErrorIs(t, err, ErrNoBody)
+	_, err = NewFixed(200, map[string]string{"connection": "close"}, nil)
+	require.ErrorIs(t, err, ErrReserved)
+	_, err = NewFixed(200, map[string]string{"X-Bad": "a\r\nb"}, nil)
+	require.ErrorIs(t, err, ErrBadHeader)
+}
+
+func TestRedirect(t *testing.T) {
+	location := func(r *Redirect, host, target string) string {
+		lines := strings.Split(string(r.Response(host, request("GET", target), false)), "\r\n")
+		return strings.TrimPrefix(lines[1], "Location: ")
+	}
+
+	r, err := NewRedirect(301, "https://new.example.com/", true, true)
+	require.NoError(t, err)
+	require.Equal(t, "https://new.example.com/billing?id=1", location(r, "example.com", "/billing?id=1#top"))
+	require.Equal(t, "https://new.example.com/", location(r, "example.com", "http://example.com"))
+
+	r, err = NewRedirect(301, "https://{host}/maintenance?from=web", false, true)
+	require.NoError(t, err)
+	require.Equal(t, "https://example.com/maintenance?from=web&a=b", location(r, "example.com", "/x?a=b"))
+	require.Equal(t, "https://[::1]/maintenance?from=web", location(r, "::1", "/x"))
+
+	response := HTTPS.Response("example.com", request("POST", "/upload?x=1"), true)
+	require.Equal(t, "HTTP/1.1 308 Permanent Redirect\r\nLocation: https://example.com/upload?x=1\r\n"+
+		"Content-Length: 0\r\nConnection: close\r\n\r\n", string(response))
+
+	_, err = NewRedirect(200, "/", false, false)
+	require.ErrorIs(t, err, ErrBadRedirectStatus)
+	_, err = NewRedirect(302, "https://example.com/?a", true, false)
+	require.ErrorIs(t, err, ErrBadLocation)
+	_, err = NewRedirect(302, "https://example.com/a b", false, false)
+	require.ErrorIs(t, err, ErrBadLocation)
+}
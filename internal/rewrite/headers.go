@@ -0,0 +1,180 @@
+package rewrite
+
+import (
+	"at/internal/scan/http1"
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrBadName  = errors.New("header name must be a non-empty token")
+	ErrBadValue = errors.New("header value must not contain line breaks")
+	ErrFraming  = errors.New("framing headers, Content-Length and Transfer-Encoding, must not be rewritten")
+)
+
+// framing headers delimit the request body. The scanner has already relied on them, so
+// editing them would make the upstream see different requests
+var framing = []string{"content-length", "transfer-encoding"}
+
+// Headers edits the header section of requests. Headers are removed first, then renamed,
+// set and added. Headers is immutable and safe for concurrent use
+type Headers struct {
+	// remove holds lowercased names of dropped lines. Set headers are dropped, too
+	remove [][]byte
+	rename []renaming
+	// lines are complete header lines, that are appended to the header section
+	lines []byte
+}
+
+type renaming struct {
+	from, to []byte
+}
+
+// NewHeaders returns rules, that remove headers, rename them keeping values, set them
+// replacing any present values and add them alongside present ones. Names are
+// case-insensitive. Headers are set and added in the order of their names
+func NewHeaders(remove []string, rename, set, add map[string]string) (*Headers, error) {
+	h := new(Headers)
+
+	for _, name := range remove {
+		if err := checkName(name); err != nil {
+			return nil, err
+		}
+
+		h.remove = append(h.remove, []byte(strings.ToLower(name)))
+	}
+
+	for _, from := range sortedKeys(rename) {
+		to := rename[from]
+		if err := checkName(from); err != nil {
+			return nil, err
+		}
+
+		if err := checkName(to); err != nil {
+			return nil, err
+		}
+
+		h.rename = append(h.rename, renaming{from: []byte(strings.ToLower(from)), to: []byte(to)})
+	}
+
+	for _, headers := range []map[string]string{set, add} {
+		for _, name := range sortedKeys(headers) {
+			if err := checkName(name); err != nil {
+				return nil, err
+			}
+
+			value := headers[name]
+			if strings.ContainsAny(value, "\r\n") {
+				return nil, fmt.Errorf("%s: %w", name, ErrBadValue)
+			}
+
+			h.lines = append(h.lines, name...)
+			h.lines = append(h.lines, ": "...)
+			h.lines = append(h.lines, value...)
+			h.lines = append(h.lines, "\r\n"...)
+		}
+	}
+
+	for name := range set {
+		h.remove = append(h.remove, []byte(strings.ToLower(name)))
+	}
+
+	return h, nil
+}
+
+// Touches reports whether any rule applies to the request. The header section must be
+// complete and end at headersEnd, which is the offset of the terminating empty line
+func (h *Headers) Touches(request []byte, headersEnd int) bool {
+	if len(h.lines) > 0 {
+		return true
+	}
+
+	lines := http1.NewHeaderLines(request[:headersEnd])
+	for line, ok := lines.Next(); ok; line, ok = lines.Next() {
+		if h.removes(line.Name) || h.renames(line.Name) != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Append appends the request with rules applied to dst and returns it with the new offset
+// of the end of the header section. The request line isn't appended, so it might be
+// rewritten on its own. The rest of the request is copied as a whole, so it's better to
+// check whether rules touch it at all beforehand
+func (h *Headers) Append(dst, request []byte, headersEnd int) (rewritten []byte, end int) {
+	// cut is the position in the request, everything before which is already appended
+	cut := bytes.IndexByte(request, '\n') + 1
+
+	lines := http1.NewHeaderLines(request[:headersEnd])
+	for line, ok := lines.Next(); ok; line, ok = lines.Next() {
+		switch to := h.renames(line.Name); {
+		case h.removes(line.Name):
+			dst = append(dst, request[cut:line.Start]...)
+		case to != nil:
+			dst = append(dst, request[cut:line.Start]...)
+			dst = append(dst, to...)
+			dst = append(dst, request[line.Start+len(line.Name):line.End]...)
+		default:
+			continue
+		}
+
+		cut = line.End
+	}
+
+	dst = append(dst, request[cut:headersEnd]...)
+	dst = append(dst, h.lines...)
+	end = len(dst)
+
+	return append(dst, request[headersEnd:]...), end
+}
+
+func (h *Headers) removes(name []byte) bool {
+	for _, removed := range h.remove {
+		if bytes.EqualFold(removed, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// renames returns the new name of the header, or nil if it's kept as is
+func (h *Headers) renames(name []byte) []byte {
+	for _, r := range h.rename {
+		if bytes.EqualFold(r.from, name) {
+			return r.to
+		}
+	}
+
+	return nil
+}
+
+func checkName(name string) error {
+	if len(name) == 0 || strings.ContainsAny(name, " \t\r\n:") {
+		return fmt.Errorf("%q: %w", name, ErrBadName)
+	}
+
+	for _, header := range framing {
+		if strings.EqualFold(name, header) {
+			return fmt.Errorf("%s: %w", name, ErrFraming)
+		}
+	}
+
+	return nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,86 @@
+package rewrite
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+func TestHeaders(t *testing.T) {
+	apply := func(h *Headers, request string) (string, bool) {
+		headersEnd := bytes.Index([]byte(request), []byte("\r\n\r\n")) + 2
+		if !h.Touches([]byte(request), headersEnd) {
+			return request, false
+		}
+
+		line := request[:strings.IndexByte(request, '\n')+1]
+		rewritten, end := h.Append([]byte(line), []byte(request), headersEnd)
+		require.Equal(t, "\r\n", string(rewritten[end:end+2]))
+
+		return string(rewritten), true
+	}
+
+	t.Run("remove and rename", func(t *testing.T) {
+		h, err := NewHeaders(
+			[]string{"Proxy-Authorization"}, map[string]string{"x-old": "X-New"}, nil, nil,
+		)
+		require.NoError(t, err)
+
+		rewritten, touched := apply(h, "GET / HTTP/1.1\r\nHost: a\r\nproxy-authorization: secret\r\n"+
+			"X-Old: 1\r\nAccept: */*\r\nPROXY-AUTHORIZATION: again\r\n\r\nbody")
+		require.True(t, touched)
+		require.Equal(t, "GET / HTTP/1.1\r\nHost: a\r\nX-New: 1\r\nAccept: */*\r\n\r\nbody", rewritten)
+
+		// continuation lines go away along with the folded header
+		rewritten, touched = apply(h, "GET / HTTP/1.1\r\nProxy-Authorization: a\r\n b\r\nHost: a\r\n\r\n")
+		require.True(t, touched)
+		require.Equal(t, "GET / HTTP/1.1\r\nHost: a\r\n\r\n", rewritten)
+
+		// nothing to remove or rename, so the request isn't copied
+		request := "GET / HTTP/1.1\r\nHost: a\r\n\r\n"
+		rewritten, touched = apply(h, request)
+		require.False(t, touched)
+		require.Equal(t, request, rewritten)
+	})
+
+	t.Run("set and add", func(t *testing.T) {
+		h, err := NewHeaders(
+			nil, nil, map[string]string{"X-Env": "prod", "Host": "api.internal"}, map[string]string{"X-Tag": "a"},
+		)
+		require.NoError(t, err)
+
+		rewritten, touched := apply(h, "POST /x HTTP/1.1\r\nhost: example.com\r\nX-Tag: b\r\n"+
+			"Content-Length: 2\r\nx-env: dev\r\n\r\nhi")
+		require.True(t, touched)
+		require.Equal(t, "POST /x HTTP/1.1\r\nX-Tag: b\r\nContent-Length: 2\r\n"+
+			"Host: api.internal\r\nX-Env: prod\r\nX-Tag: a\r\n\r\nhi", rewritten)
+	})
+
+	t.Run("bare line feeds", func(t *testing.T) {
+		h, err := NewHeaders([]string{"X-Drop"}, nil, nil, map[string]string{"X-Add": "1"})
+		require.NoError(t, err)
+
+		request := []byte("GET / HTTP/1.1\nHost: a\nX-Drop: 1\n\n")
+		rewritten, end := h.Append(nil, request, len(request)-1)
+		require.Equal(t, "Host: a\nX-Add: 1\r\n\n", string(rewritten))
+		require.Equal(t, len(rewritten)-1, end)
+	})
+
+	t.Run("bad rules", func(t *testing.T) {
+		_, err := NewHeaders([]string{"Bad Name"}, nil, nil, nil)
+		require.ErrorIs(t, err, ErrBadName)
+
+		_, err = NewHeaders(nil, map[string]string{"X-Old": ""}, nil, nil)
+		require.ErrorIs(t, err, ErrBadName)
+
+		_, err = NewHeaders(nil, nil, map[string]string{"X-Env": "a\r\nX-Forged: 1"}, nil)
+		require.ErrorIs(t, err, ErrBadValue)
+
+		_, err = NewHeaders([]string{"transfer-encoding"}, nil, nil, nil)
+		require.ErrorIs(t, err, ErrFraming)
+
+		_, err = NewHeaders(nil, map[string]string{"X-Length": "Content-Length"}, nil, nil)
+		require.ErrorIs(t, err, ErrFraming)
+	})
+}
@@ -0,0 +1,96 @@
+package rewrite
+
+import (
+	"at/internal/scan"
+	"bytes"
+	"errors"
+	"regexp"
+	"strings"
+)
+
+var (
+	ErrBadPrefix      = errors.New("prefix must start with a slash and must not contain whitespaces, ? or #")
+	ErrBadReplacement = errors.New("replacement must be used along with the regex and must not contain whitespaces")
+)
+
+var rootPath = []byte("/")
+
+// Path rewrites the path of request targets. The prefix is stripped first, then matches of
+// the regex are replaced and finally the prefix is added. The query is kept as is. Path is
+// immutable and safe for concurrent use
+type Path struct {
+	// strip and prefix are kept without the trailing slash
+	strip       []byte
+	regex       *regexp.Regexp
+	replacement []byte
+	prefix      []byte
+}
+
+// NewPath returns rules, that strip the prefix, replace matches of the regex with the
+// replacement, which might refer to capture groups ($1), and add the prefix. The stripped
+// prefix must end at the segment boundary, so /billing strips /billing and /billing/a, but
+// not /billings. Empty rules are omitted
+func NewPath(stripPrefix, regex, replacement, addPrefix string) (*Path, error) {
+	p := new(Path)
+
+	for _, prefix := range []string{stripPrefix, addPrefix} {
+		if len(prefix) > 0 && (prefix[0] != '/' || strings.ContainsAny(prefix, " \t\r\n?#")) {
+			return nil, ErrBadPrefix
+		}
+	}
+
+	p.strip = []byte(strings.TrimSuffix(stripPrefix, "/"))
+	p.prefix = []byte(strings.TrimSuffix(addPrefix, "/"))
+
+	if len(replacement) > 0 && (len(regex) == 0 || strings.ContainsAny(replacement, " \t\r\n")) {
+		return nil, ErrBadReplacement
+	}
+
+	if len(regex) > 0 {
+		compiled, err := regexp.Compile(regex)
+		if err != nil {
+			return nil, err
+		}
+
+		p.regex, p.replacement = compiled, []byte(replacement)
+	}
+
+	return p, nil
+}
+
+// Rewrite appends the target of the request with the path rewritten to dst. In case no rule
+// applies, dst is returned as is and rewritten is false
+func (p *Path) Rewrite(dst []byte, request scan.Request) (_ []byte, rewritten bool) {
+	start, end := request.PathBounds()
+	if start == -1 {
+		return dst, false
+	}
+
+	path := request.Target[start:end]
+	if len(path) == 0 {
+		path = rootPath
+	}
+
+	if len(p.strip) > 0 && bytes.HasPrefix(path, p.strip) &&
+		(len(path) == len(p.strip) || path[len(p.strip)] == '/') {
+		path, rewritten = path[len(p.strip):], true
+	}
+
+	if p.regex != nil && p.regex.Match(path) {
+		path, rewritten = p.regex.ReplaceAll(path, p.replacement), true
+	}
+
+	if !rewritten && len(p.prefix) == 0 {
+		return dst, false
+	}
+
+	dst = append(dst, request.Target[:start]...)
+	dst = append(dst, p.prefix...)
+	if len(path) == 0 || path[0] != '/' {
+		dst = append(dst, '/')
+	}
+
+	dst = append(dst, path...)
+
+	return append(dst, request.Target[end:]...), true
+}
@@ -0,0 +1,76 @@
+package rewrite
+
+import (
+	"at/internal/scan"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestPath(t *testing.T) {
+	rewrite := func(p *Path, target string) string {
+		rewritten, ok := p.Rewrite(nil, scan.Request{Target: []byte(target)})
+		if !ok {
+			require.Empty(t, rewritten)
+			return target
+		}
+
+		return string(rewritten)
+	}
+
+	t.Run("strip prefix", func(t *testing.T) {
+		p, err := NewPath("/billing/", "", "", "")
+		require.NoError(t, err)
+
+		for target, rewritten := range map[string]string{
+			"/billing/invoices?id=1":       "/invoices?id=1",
+			"/billing":                     "/",
+			"/billing?x":                   "/?x",
+			"/billings":                    "/billings",
+			"/api/billing":                 "/api/billing",
+			"http://example.com/billing/a": "http://example.com/a",
+			"example.com:443":              "example.com:443",
+		} {
+			require.Equal(t, rewritten, rewrite(p, target), target)
+		}
+	})
+
+	t.Run("add prefix", func(t *testing.T) {
+		p, err := NewPath("/billing", "", "", "/v1/")
+		require.NoError(t, err)
+
+		for target, rewritten := range map[string]string{
+			"/billing/invoices":  "/v1/invoices",
+			"/users?id=1":        "/v1/users?id=1",
+			"/":                  "/v1/",
+			"http://example.com": "http://example.com/v1/",
+		} {
+			require.Equal(t, rewritten, rewrite(p, target), target)
+		}
+	})
+
+	t.Run("regex", func(t *testing.T) {
+		p, err := NewPath("", `^/users/(\d+)/avatar$`, "/avatars/$1.png", "")
+		require.NoError(t, err)
+
+		require.Equal(t, "/avatars/42.png?size=2", rewrite(p, "/users/42/avatar?size=2"))
+		require.Equal(t, "/users/me/avatar", rewrite(p, "/users/me/avatar"))
+
+		p, err = NewPath("", `\.html$`, "", "")
+		require.NoError(t, err)
+		require.Equal(t, "/about", rewrite(p, "/about.html"))
+	})
+
+	t.Run("bad rules", func(t *testing.T) {
+		_, err := NewPath("billing", "", "", "")
+		require.ErrorIs(t, err, ErrBadPrefix)
+
+		_, err = NewPath("", "", "", "/v1?x")
+		require.ErrorIs(t, err, ErrBadPrefix)
+
+		_, err = NewPath("", "", "/x", "")
+		require.ErrorIs(t, err, ErrBadReplacement)
+
+		_, err = NewPath("", "(", "", "")
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,72 @@
+package route
+
+import (
+	"errors"
+	"golang.org/x/net/idna"
+	"net/netip"
+	"strings"
+)
+
+var ErrBadHost = errors.New("host must be a domain name or an IP address, optionally followed by :port")
+
+// Canonical splits the authority (example.com:8080) into the canonical host and the port.
+// The host is lowercased and stripped of the trailing dot. Internationalized domain names
+// are converted to punycode. IPv6 literals lose their brackets and are formatted, as
+// netip does. Canonical doesn't allocate, unless the host is an IPv6 literal, or it's
+// not lowercase or not ASCII
+func Canonical(authority string) (host, port string, err error) {
+	host = authority
+
+	switch colon := strings.LastIndexByte(authority, ':'); {
+	case strings.HasPrefix(authority, "["):
+		end := strings.IndexByte(authority, ']')
+		if end == -1 || (end+1 < len(authority) && authority[end+1] != ':') {
+			return "", "", ErrBadHost
+		}
+
+		addr, err := netip.ParseAddr(authority[1:end])
+		if err != nil || !addr.Is6() {
+			return "", "", ErrBadHost
+		}
+
+		if end+1 < len(authority) {
+			port = authority[end+2:]
+		}
+
+		host = addr.String()
+	case colon == -1:
+	case strings.IndexByte(authority[:colon], ':') == -1:
+		host, port = authority[:colon], authority[colon+1:]
+	default:
+		// IPv6 address without brackets, so there's no port
+		addr, err := netip.ParseAddr(authority)
+		if err != nil || !addr.Is6() {
+			return "", "", ErrBadHost
+		}
+
+		host = addr.String()
+	}
+
+	for i := 0; i < len(port); i++ {
+		if port[i] < '0' || port[i] > '9' {
+			return "", "", ErrBadHost
+		}
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if len(host) == 0 {
+		return "", "", ErrBadHost
+	}
+
+	for i := 0; i < len(host); i++ {
+		if host[i] >= 0x80 {
+			if host, err = idna.Lookup.ToASCII(host); err != nil {
+				return "", "", ErrBadHost
+			}
+
+			break
+		}
+	}
+
+	return host, port, nil
+}
@@ -0,0 +1,32 @@
+package route
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestCanonical(t *testing.T) {
+	for authority, want := range map[string][2]string{
+		"example.com":           {"example.com", ""},
+		"Example.COM:8080":      {"example.com", "8080"},
+		"example.com.":          {"example.com", ""},
+		"example.com.:443":      {"example.com", "443"},
+		"example.com:":          {"example.com", ""},
+		"www.example.com":       {"www.example.com", ""},
+		"[::1]:80":              {"::1", "80"},
+		"[0:0::1]":              {"::1", ""},
+		"2001:DB8::1":           {"2001:db8::1", ""},
+		"127.0.0.1:80":          {"127.0.0.1", "80"},
+		"Bücher.example":        {"xn--bcher-kva.example", ""},
+		"xn--bcher-kva.example": {"xn--bcher-kva.example", ""},
+	} {
+		host, port, err := Canonical(authority)
+		require.NoError(t, err, authority)
+		require.Equal(t, want, [2]string{host, port}, authority)
+	}
+
+	for _, authority := range []string{"", ":80", "example.com:http", "[::1", "[::1]x", "[127.0.0.1]", "a::b::c"} {
+		_, _, err := Canonical(authority)
+		require.ErrorIs(t, err, ErrBadHost, authority)
+	}
+}
@@ -0,0 +1,94 @@
+package route
+
+import (
+	"at/internal/scan"
+	"bytes"
+	"errors"
+	"regexp"
+	"strings"
+)
+
+var (
+	ErrBadPath   = errors.New("path must start with a slash, * is allowed only at the end: /api/*")
+	ErrBadMethod = errors.New("method must be a non-empty token")
+)
+
+// Matcher tells whether the request belongs to the route by its method and path. Zero
+// matcher matches any request
+type Matcher struct {
+	// methods are allowed methods. Empty means any
+	methods [][]byte
+	// path is matched exactly, or as a prefix in case prefix is set
+	path   []byte
+	prefix bool
+	// pathRegex must match the path, if set
+	pathRegex *regexp.Regexp
+}
+
+// NewMatcher returns the matcher of requests with any of methods and the path. The path is
+// either exact (/login) or a prefix (/api/*). The regex must match the path, too. Empty
+// conditions are omitted
+func NewMatcher(methods []string, path, pathRegex string) (Matcher, error) {
+	var m Matcher
+
+	for _, method := range methods {
+		if len(method) == 0 || strings.ContainsAny(method, " \t\r\n") {
+			return m, ErrBadMethod
+		}
+
+		m.methods = append(m.methods, []byte(strings.ToUpper(method)))
+	}
+
+	if len(path) > 0 {
+		if path[0] != '/' || strings.IndexByte(path[:len(path)-1], '*') != -1 {
+			return m, ErrBadPath
+		}
+
+		m.path = []byte(strings.TrimSuffix(path, "*"))
+		m.prefix = strings.HasSuffix(path, "*")
+	}
+
+	if len(pathRegex) > 0 {
+		regex, err := regexp.Compile(pathRegex)
+		if err != nil {
+			return m, err
+		}
+
+		m.pathRegex = regex
+	}
+
+	return m, nil
+}
+
+// Any reports whether the matcher has no conditions
+func (m Matcher) Any() bool {
+	return len(m.methods) == 0 && m.path == nil && m.pathRegex == nil
+}
+
+func (m Matcher) Match(request scan.Request) bool {
+	if len(m.methods) > 0 && !m.matchMethod(request.Method) {
+		return false
+	}
+
+	path := request.Path()
+
+	switch {
+	case m.path == nil:
+	case m.prefix && !bytes.HasPrefix(path, m.path):
+		return false
+	case !m.prefix && !bytes.Equal(path, m.path):
+		return false
+	}
+
+	return m.pathRegex == nil || m.pathRegex.Match(path)
+}
+
+func (m Matcher) matchMethod(method []byte) bool {
+	for _, allowed := range m.methods {
+		if bytes.Equal(allowed, method) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,67 @@
+package route
+
+import (
+	"at/internal/scan"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func request(method, target string) scan.Request {
+	return scan.Request{Method: []byte(method), Target: []byte(target), Version: []byte("HTTP/1.1")}
+}
+
+func TestMatcher(t *testing.T) {
+	for _, tc := range []struct {
+		name              string
+		methods           []string
+		path, pathRegex   string
+		matched, unwanted []scan.Request
+	}{
+		{
+			name:    "any",
+			matched: []scan.Request{request("GET", "/"), request("CONNECT", "example.com:443")},
+		},
+		{
+			name:     "prefix",
+			path:     "/api/*",
+			matched:  []scan.Request{request("GET", "/api/"), request("POST", "/api/users?id=1")},
+			unwanted: []scan.Request{request("GET", "/api"), request("GET", "/static/api/")},
+		},
+		{
+			name:     "exact",
+			path:     "/login",
+			matched:  []scan.Request{request("GET", "/login"), request("GET", "http://example.com/login?next=/")},
+			unwanted: []scan.Request{request("GET", "/login/"), request("GET", "/")},
+		},
+		{
+			name:      "regex and methods",
+			methods:   []string{"get", "HEAD"},
+			pathRegex: `\.(css|js)$`,
+			matched:   []scan.Request{request("GET", "/static/app.js"), request("HEAD", "/a.css?v=2")},
+			unwanted:  []scan.Request{request("POST", "/static/app.js"), request("GET", "/app.json")},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			matcher, err := NewMatcher(tc.methods, tc.path, tc.pathRegex)
+			require.NoError(t, err)
+			require.Equal(t, len(tc.unwanted) == 0, matcher.Any())
+
+			for _, r := range tc.matched {
+				require.True(t, matcher.Match(r), string(r.Target))
+			}
+
+			for _, r := range tc.unwanted {
+				require.False(t, matcher.Match(r), string(r.Target))
+			}
+		})
+	}
+
+	_, err := NewMatcher(nil, "api/*", "")
+	require.ErrorIs(t, err, ErrBadPath)
+	_, err = NewMatcher(nil, "/api/*/users", "")
+	require.ErrorIs(t, err, ErrBadPath)
+	_, err = NewMatcher([]string{""}, "", "")
+	require.ErrorIs(t, err, ErrBadMethod)
+	_, err = NewMatcher(nil, "", "(")
+	require.Error(t, err)
+}
@@ -0,0 +1,336 @@
+package route
+
+import (
+	"at/internal/balance"
+	"at/internal/health"
+	"at/internal/ratelimit"
+	"at/internal/respond"
+	"at/internal/rewrite"
+	"at/internal/scan"
+	"errors"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+var (
+	ErrEmptyHost      = errors.New("empty host")
+	ErrBadWildcard    = errors.New("wildcard is allowed only as the leftmost label: *.example.com")
+	ErrNoAddrs        = errors.New("upstream has no addresses")
+	ErrDuplicateRoute = errors.New("route is already defined")
+	ErrWildcardPort   = errors.New("port is allowed only for exact hosts")
+)
+
+// Upstream is a named set of backends, requests are forwarded to. The balancer chooses
+// one of them for every request
+type Upstream struct {
+	Name     string
+	Balancer balance.Balancer
+	// Check is the active health check of backends
+	Check health.Check
+	// ProxyProtocol is the version of PROXY protocol header, that new connections start
+	// with. Zero disables it
+	ProxyProtocol int
+	// Headers rewrites request headers before forwarding. It's nil if there are no rules
+	Headers *rewrite.Headers
+	// Path rewrites the path of the request target before forwarding. It's nil if there are
+	// no rules
+	Path *rewrite.Path
+	// Respond answers requests by the forwarder itself instead of forwarding them. It's set
+	// for redirect and fixed response routes, which have no backends
+	Respond respond.Responder
+	// HTTPSOnly redirects requests over plain connections to https. Requests over TLS are
+	// handled as usual
+	HTTPSOnly bool
+	// RateLimit limits requests of the route. It's nil if there's no limit
+	RateLimit *ratelimit.Rule
+}
+
+// hasBackends reports whether requests can be routed to the upstream, either forwarded to
+// its backends or responded by the forwarder itself
+func (u *Upstream) hasBackends() bool {
+	return u.Respond != nil || (u.Balancer != nil && len(u.Balancer.Backends()) > 0)
+}
+
+// Table maps hosts to upstreams. Exact hosts are looked up first, then wildcard ones,
+// from the longest suffix to the shortest, and finally the default route, if any
+type Table struct {
+	exact map[string]*rules
+	// wildcard is keyed by the suffix including the leading dot, e.g. .example.com
+	wildcard map[string]*rules
+	fallback *Upstream
+	// unknownHostStatus is a status code, that is responded with to requests which host
+	// isn't matched by any route
+	unknownHostStatus int
+	// passthrough holds routes of TLS connections, that are forwarded without termination.
+	// They're looked up by SNI
+	passthrough *Table
+	// raw holds upstreams of unrecognized traffic on sniffing listeners by name
+	raw map[string]*Upstream
+}
+
+// NewTable returns an empty routing table. Requests to unknown hosts will be responded
+// with the unknownHostStatus, which must be either 421 Misdirected Request or 404 Not Found
+func NewTable(unknownHostStatus int) *Table {
+	if unknownHostStatus != http.StatusNotFound {
+		unknownHostStatus = http.StatusMisdirectedRequest
+	}
+
+	table := newTable(unknownHostStatus)
+	table.passthrough = newTable(unknownHostStatus)
+	table.raw = make(map[string]*Upstream)
+
+	return table
+}
+
+func newTable(unknownHostStatus int) *Table {
+	return &Table{
+		exact:             make(map[string]*rules),
+		wildcard:          make(map[string]*rules),
+		unknownHostStatus: unknownHostStatus,
+	}
+}
+
+// Passthrough returns the table of TLS passthrough routes. They're independent of HTTP
+// ones, so the same host might be routed differently by both
+func (t *Table) Passthrough() *Table {
+	return t.passthrough
+}
+
+// AddRaw makes the upstream available by its name for connections, that are neither HTTP
+// nor TLS
+func (t *Table) AddRaw(name string, upstream *Upstream) error {
+	if !upstream.hasBackends() {
+		return ErrNoAddrs
+	}
+
+	t.raw[name] = upstream
+
+	return nil
+}
+
+// Raw returns the upstream for unrecognized connections, added by AddRaw
+func (t *Table) Raw(name string) (*Upstream, bool) {
+	upstream, found := t.raw[name]
+	return upstream, found
+}
+
+// Add adds a new route. Host is either exact (example.com) or a wildcard (*.example.com).
+// Wildcard matches any number of labels, but not the domain itself. Exact hosts might be
+// followed by the port (example.com:8080), so the route takes precedence over the one of
+// the host alone on that port. Hosts are canonicalized, see Canonical
+func (t *Table) Add(host string, upstream *Upstream) error {
+	return t.AddMatching(host, Matcher{}, upstream)
+}
+
+// AddMatching adds a new route of requests to the host, that are matched by the matcher.
+// Routes of the same host are tried in the order they're added, except for the one without
+// conditions, that is always tried the last
+func (t *Table) AddMatching(host string, matcher Matcher, upstream *Upstream) error {
+	if !upstream.hasBackends() {
+		return ErrNoAddrs
+	}
+
+	host, wildcard := strings.CutPrefix(host, "*.")
+	switch {
+	case len(host) == 0 && !wildcard:
+		return ErrEmptyHost
+	case len(host) == 0 || strings.IndexByte(host, '*') != -1:
+		return ErrBadWildcard
+	}
+
+	host, port, err := Canonical(host)
+	switch {
+	case err != nil:
+		return err
+	case wildcard && len(port) > 0:
+		return ErrWildcardPort
+	case wildcard:
+		return add(t.wildcard, "."+host, matcher, upstream)
+	case len(port) > 0:
+		return add(t.exact, host+":"+port, matcher, upstream)
+	default:
+		return add(t.exact, host, matcher, upstream)
+	}
+}
+
+// SetDefault sets the route for requests, which host isn't matched by any other route
+func (t *Table) SetDefault(upstream *Upstream) error {
+	if !upstream.hasBackends() {
+		return ErrNoAddrs
+	}
+
+	t.fallback = upstream
+
+	return nil
+}
+
+// Lookup returns an upstream for the host, routed regardless of the request and the port.
+// The host is expected to be canonical
+func (t *Table) Lookup(host string) (*Upstream, bool) {
+	return t.match(host, "", nil)
+}
+
+// Match returns an upstream for the request to the host and the port, which might be empty.
+// Routes of the most specific host are tried first, and in case none of them matches the
+// request, less specific hosts are tried further. The host and the port are expected to be
+// canonical, as returned by Canonical
+func (t *Table) Match(host, port string, request scan.Request) (*Upstream, bool) {
+	return t.match(host, port, &request)
+}
+
+func (t *Table) match(host, port string, request *scan.Request) (*Upstream, bool) {
+	if len(port) > 0 {
+		if upstream := t.exact[host+":"+port].match(request); upstream != nil {
+			return upstream, true
+		}
+	}
+
+	if upstream := t.exact[host].match(request); upstream != nil {
+		return upstream, true
+	}
+
+	for dot := strings.IndexByte(host, '.'); dot != -1; {
+		suffix := host[dot:]
+		if upstream := t.wildcard[suffix].match(request); upstream != nil {
+			return upstream, true
+		}
+
+		next := strings.IndexByte(suffix[1:], '.')
+		if next == -1 {
+			break
+		}
+
+		dot += next + 1
+	}
+
+	return t.fallback, t.fallback != nil
+}
+
+// Upstreams returns all the upstreams, that are routed to. Every upstream is returned once,
+// even if multiple routes point at it, possibly with different PROXY protocol versions.
+// Routes, that are responded by the forwarder itself, have no upstreams
+func (t *Table) Upstreams() []*Upstream {
+	var (
+		upstreams []*Upstream
+		seen      = make(map[balance.Balancer]bool)
+	)
+
+	collect := func(upstream *Upstream) {
+		if upstream != nil && upstream.Balancer != nil && !seen[upstream.Balancer] {
+			seen[upstream.Balancer] = true
+			upstreams = append(upstreams, upstream)
+		}
+	}
+
+	for _, r := range t.exact {
+		r.each(collect)
+	}
+
+	for _, r := range t.wildcard {
+		r.each(collect)
+	}
+
+	collect(t.fallback)
+
+	for _, upstream := range t.raw {
+		collect(upstream)
+	}
+
+	if t.passthrough != nil {
+		for _, upstream := range t.passthrough.Upstreams() {
+			collect(upstream)
+		}
+	}
+
+	return upstreams
+}
+
+// UnknownHostStatus returns a status code, that must be responded with in case the Lookup
+// didn't find a route
+func (t *Table) UnknownHostStatus() int {
+	return t.unknownHostStatus
+}
+
+func add(routes map[string]*rules, key string, matcher Matcher, upstream *Upstream) error {
+	r, found := routes[key]
+	if !found {
+		r = new(rules)
+		routes[key] = r
+	}
+
+	if !matcher.Any() {
+		r.conditional = append(r.conditional, rule{matcher: matcher, upstream: upstream})
+		return nil
+	}
+
+	if r.any != nil {
+		return ErrDuplicateRoute
+	}
+
+	r.any = upstream
+
+	return nil
+}
+
+// rules are routes of the same host
+type rules struct {
+	conditional []rule
+	// any is the route of requests, that aren't matched by conditional ones
+	any *Upstream
+}
+
+type rule struct {
+	matcher  Matcher
+	upstream *Upstream
+}
+
+// match returns nil in case no route matches the request. Nil request is matched only by
+// the route without conditions
+func (r *rules) match(request *scan.Request) *Upstream {
+	if r == nil {
+		return nil
+	}
+
+	if request != nil {
+		for _, rule := range r.conditional {
+			if rule.matcher.Match(*request) {
+				return rule.upstream
+			}
+		}
+	}
+
+	return r.any
+}
+
+func (r *rules) each(fn func(upstream *Upstream)) {
+	for _, rule := range r.conditional {
+		fn(rule.upstream)
+	}
+
+	fn(r.any)
+}
+
+// Routes holds the current routing table, that can be atomically replaced on reload.
+// Connections look the table up on every request, so they pick the new one up starting
+// from the next request
+type Routes struct {
+	table atomic.Pointer[Table]
+}
+
+func NewRoutes(table *Table) *Routes {
+	routes := new(Routes)
+	routes.table.Store(table)
+
+	return routes
+}
+
+// Table returns the current routing table
+func (r *Routes) Table() *Table {
+	return r.table.Load()
+}
+
+// Swap replaces the routing table
+func (r *Routes) Swap(table *Table) {
+	r.table.Store(table)
+}
@@ -0,0 +1,149 @@
+package route
+
+import (
+	"at/internal/balance"
+	"at/internal/scan"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func newUpstream(name, addr string) *Upstream {
+	balancer, _ := balance.New(balance.RoundRobin, []*balance.Backend{balance.NewBackend(addr, 1, balance.Thresholds{})}, "")
+
+	return &Upstream{Name: name, Balancer: balancer}
+}
+
+func TestTable(t *testing.T) {
+	var (
+		exact    = newUpstream("exact", "127.0.0.1:1")
+		wildcard = newUpstream("wildcard", "127.0.0.1:2")
+		deeper   = newUpstream("deeper", "127.0.0.1:3")
+		fallback = newUpstream("fallback", "127.0.0.1:4")
+	)
+
+	table := NewTable(0)
+	require.NoError(t, table.Add("Example.com", exact))
+	require.NoError(t, table.Add("*.example.com", wildcard))
+	require.NoError(t, table.Add("*.api.example.com", deeper))
+	require.ErrorIs(t, table.Add("example.com", exact), ErrDuplicateRoute)
+	require.ErrorIs(t, table.Add("a.*.com", exact), ErrBadWildcard)
+	require.ErrorIs(t, table.Add("*.", exact), ErrBadWildcard)
+	require.ErrorIs(t, table.Add("empty.com", &Upstream{}), ErrNoAddrs)
+
+	for host, want := range map[string]*Upstream{
+		"example.com":           exact,
+		"www.example.com":       wildcard,
+		"a.b.example.com":       wildcard,
+		"v1.api.example.com":    deeper,
+		"api.example.com":       wildcard,
+		"example.org":           nil,
+		"notexample.com":        nil,
+		"com":                   nil,
+		"a.b.c.api.example.com": deeper,
+	} {
+		upstream, found := table.Lookup(host)
+		require.Equal(t, want != nil, found, host)
+		require.Equal(t, want, upstream, host)
+	}
+
+	require.Equal(t, 421, table.UnknownHostStatus())
+	require.NoError(t, table.SetDefault(fallback))
+	upstream, found := table.Lookup("example.org")
+	require.True(t, found)
+	require.Equal(t, fallback, upstream)
+
+	require.NoError(t, table.Add("example.net", exact))
+	require.ElementsMatch(t, []*Upstream{exact, wildcard, deeper, fallback}, table.Upstreams())
+
+	// upstreams, that differ only by PROXY protocol, share backends
+	withProxy := *fallback
+	withProxy.ProxyProtocol = 2
+	require.NoError(t, table.Add("example.io", &withProxy))
+	require.Len(t, table.Upstreams(), 4)
+
+	passthrough := newUpstream("passthrough", "127.0.0.1:5")
+	require.NoError(t, table.Passthrough().Add("example.com", passthrough))
+	upstream, found = table.Passthrough().Lookup("example.com")
+	require.True(t, found)
+	require.Equal(t, passthrough, upstream)
+	require.Len(t, table.Upstreams(), 5)
+
+	raw := newUpstream("ssh", "127.0.0.1:6")
+	require.NoError(t, table.AddRaw("ssh", raw))
+	upstream, found = table.Raw("ssh")
+	require.True(t, found)
+	require.Equal(t, raw, upstream)
+	_, found = table.Raw("web")
+	require.False(t, found)
+	require.Len(t, table.Upstreams(), 6)
+}
+
+func TestMatch(t *testing.T) {
+	var (
+		api      = newUpstream("api", "127.0.0.1:1")
+		static   = newUpstream("static", "127.0.0.1:2")
+		web      = newUpstream("web", "127.0.0.1:3")
+		fallback = newUpstream("fallback", "127.0.0.1:4")
+	)
+
+	apiPath, _ := NewMatcher(nil, "/api/*", "")
+	staticPath, _ := NewMatcher([]string{"GET"}, "/static/*", "")
+
+	table := NewTable(0)
+	require.NoError(t, table.Add("example.com", web))
+	require.NoError(t, table.AddMatching("example.com", apiPath, api))
+	require.NoError(t, table.AddMatching("*.example.com", staticPath, static))
+	require.NoError(t, table.SetDefault(fallback))
+
+	for _, tc := range []struct {
+		host    string
+		request scan.Request
+		want    *Upstream
+	}{
+		{"example.com", request("GET", "/api/users"), api},
+		{"example.com", request("GET", "/"), web},
+		{"www.example.com", request("GET", "/static/app.js"), static},
+		{"www.example.com", request("POST", "/static/app.js"), fallback},
+		{"example.com", request("GET", "/static/app.js"), web},
+	} {
+		upstream, found := table.Match(tc.host, "", tc.request)
+		require.True(t, found)
+		require.Equal(t, tc.want, upstream, tc.host+string(tc.request.Target))
+	}
+
+	// routes with conditions are never looked up regardless of the request
+	upstream, _ := table.Lookup("example.com")
+	require.Equal(t, web, upstream)
+	upstream, _ = table.Lookup("www.example.com")
+	require.Equal(t, fallback, upstream)
+	require.ElementsMatch(t, []*Upstream{api, static, web, fallback}, table.Upstreams())
+}
+
+func TestPorts(t *testing.T) {
+	var (
+		web   = newUpstream("web", "127.0.0.1:1")
+		admin = newUpstream("admin", "127.0.0.1:2")
+	)
+
+	table := NewTable(0)
+	require.NoError(t, table.Add("Example.com.", web))
+	require.NoError(t, table.Add("example.com:8080", admin))
+	require.NoError(t, table.Add("bücher.example", web))
+	require.ErrorIs(t, table.Add("EXAMPLE.com", web), ErrDuplicateRoute)
+	require.ErrorIs(t, table.Add("*.example.com:8080", web), ErrWildcardPort)
+	require.ErrorIs(t, table.Add("example.com:http", web), ErrBadHost)
+
+	for _, tc := range []struct {
+		host, port string
+		want       *Upstream
+	}{
+		{"example.com", "", web},
+		{"example.com", "80", web},
+		{"example.com", "8080", admin},
+		{"xn--bcher-kva.example", "", web},
+	} {
+		upstream, found := table.Match(tc.host, tc.port, request("GET", "/"))
+		require.True(t, found)
+		require.Equal(t, tc.want, upstream, tc.host+":"+tc.port)
+	}
+}
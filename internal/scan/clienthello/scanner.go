@@ -0,0 +1,255 @@
+package clienthello
+
+import (
+	"at/internal/scan"
+	"encoding/binary"
+	"errors"
+)
+
+var (
+	_ scan.Scanner = NewScanner()
+
+	ErrNotHandshake = errors.New("not a TLS handshake")
+	ErrBadHello     = errors.New("malformed TLS ClientHello")
+	ErrTooLong      = errors.New("TLS ClientHello is too long")
+)
+
+const (
+	recordHeaderLen     = 5
+	recordTypeHandshake = 0x16
+	// maxRecordLen is the maximal length of TLSCiphertext fragment
+	maxRecordLen = 16384 + 2048
+	// maxHelloLen limits the ClientHello message. Usually it fits in a single record, but
+	// post-quantum key shares might make it span a few
+	maxHelloLen = 64 * 1024
+
+	handshakeHeaderLen   = 4
+	handshakeClientHello = 0x01
+
+	extensionServerName = 0
+	extensionALPN       = 16
+	serverNameHostName  = 0
+)
+
+// Scanner finds the server name in the ClientHello, that starts TLS connection. Like the
+// HTTP scanner, it can be fed by pieces of arbitrary size. The stream isn't decrypted, so
+// the only "request" is the ClientHello itself
+type Scanner struct {
+	header    [recordHeaderLen]byte
+	headerLen int
+	// recordLeft is the number of bytes of the current record's fragment, that aren't
+	// received yet
+	recordLeft int
+	// hello is handshake messages collected from records so far
+	hello []byte
+	sni   string
+	alpn  []string
+}
+
+func NewScanner() *Scanner {
+	return &Scanner{
+		hello: make([]byte, 0, 512),
+	}
+}
+
+// Scan returns the server name along with the end of the ClientHello, as soon as it's
+// received. The server name is empty in case the client didn't send it
+func (s *Scanner) Scan(data []byte) (to string, endsAt int, err error) {
+	originalDataLen := len(data)
+
+	for len(data) > 0 {
+		if s.recordLeft == 0 {
+			n := copy(s.header[s.headerLen:], data)
+			s.headerLen += n
+			data = data[n:]
+			if s.headerLen < recordHeaderLen {
+				break
+			}
+
+			if s.header[0] != recordTypeHandshake {
+				return "", -1, ErrNotHandshake
+			}
+
+			s.headerLen = 0
+			s.recordLeft = int(binary.BigEndian.Uint16(s.header[3:]))
+			if s.recordLeft == 0 || s.recordLeft > maxRecordLen {
+				return "", -1, ErrBadHello
+			}
+
+			continue
+		}
+
+		n := s.recordLeft
+		if len(data) < n {
+			n = len(data)
+		}
+
+		s.hello = append(s.hello, data[:n]...)
+		data = data[n:]
+		s.recordLeft -= n
+
+		if len(s.hello) < handshakeHeaderLen {
+			continue
+		}
+
+		if s.hello[0] != handshakeClientHello {
+			return "", -1, ErrNotHandshake
+		}
+
+		helloLen := handshakeHeaderLen + (int(s.hello[1])<<16 | int(s.hello[2])<<8 | int(s.hello[3]))
+		if helloLen > maxHelloLen {
+			return "", -1, ErrTooLong
+		}
+
+		if len(s.hello) >= helloLen {
+			if err = s.parse(s.hello[handshakeHeaderLen:helloLen]); err != nil {
+				return "", -1, err
+			}
+
+			return s.sni, originalDataLen - len(data), nil
+		}
+	}
+
+	return "", -1, nil
+}
+
+// ALPN returns protocols, offered by the client. It's valid only after the ClientHello
+// is scanned
+func (s *Scanner) ALPN() []string {
+	return s.alpn
+}
+
+func (s *Scanner) Release() {
+	s.headerLen = 0
+	s.recordLeft = 0
+	s.hello = s.hello[:0]
+	s.sni = ""
+	s.alpn = nil
+}
+
+// parse walks through the ClientHello body up to extensions
+func (s *Scanner) parse(body []byte) error {
+	// legacy_version and random
+	body, ok := skip(body, 2+32)
+	// legacy_session_id, cipher_suites and legacy_compression_methods
+	body, ok = skipVector(body, 1, ok)
+	body, ok = skipVector(body, 2, ok)
+	body, ok = skipVector(body, 1, ok)
+	if !ok {
+		return ErrBadHello
+	}
+
+	if len(body) == 0 {
+		// extensions are optional
+		return nil
+	}
+
+	extensions, rest, ok := vector(body, 2)
+	if !ok || len(rest) > 0 {
+		return ErrBadHello
+	}
+
+	for len(extensions) > 0 {
+		if len(extensions) < 2 {
+			return ErrBadHello
+		}
+
+		kind := binary.BigEndian.Uint16(extensions)
+		var data []byte
+		data, extensions, ok = vector(extensions[2:], 2)
+		if !ok {
+			return ErrBadHello
+		}
+
+		switch kind {
+		case extensionServerName:
+			if err := s.parseServerName(data); err != nil {
+				return err
+			}
+		case extensionALPN:
+			if err := s.parseALPN(data); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *Scanner) parseServerName(data []byte) error {
+	names, _, ok := vector(data, 2)
+	if !ok {
+		return ErrBadHello
+	}
+
+	for len(names) > 0 {
+		kind := names[0]
+		var name []byte
+		name, names, ok = vector(names[1:], 2)
+		if !ok {
+			return ErrBadHello
+		}
+
+		if kind == serverNameHostName {
+			s.sni = string(name)
+			return nil
+		}
+	}
+
+	return nil
+}
+
+func (s *Scanner) parseALPN(data []byte) error {
+	protocols, _, ok := vector(data, 2)
+	if !ok {
+		return ErrBadHello
+	}
+
+	for len(protocols) > 0 {
+		var protocol []byte
+		if protocol, protocols, ok = vector(protocols, 1); !ok {
+			return ErrBadHello
+		}
+
+		s.alpn = append(s.alpn, string(protocol))
+	}
+
+	return nil
+}
+
+// vector splits off the vector, prefixed by its length of lenSize bytes
+func vector(data []byte, lenSize int) (value, rest []byte, ok bool) {
+	if len(data) < lenSize {
+		return nil, nil, false
+	}
+
+	var length int
+	for _, b := range data[:lenSize] {
+		length = length<<8 | int(b)
+	}
+
+	data = data[lenSize:]
+	if len(data) < length {
+		return nil, nil, false
+	}
+
+	return data[:length], data[length:], true
+}
+
+func skipVector(data []byte, lenSize int, ok bool) ([]byte, bool) {
+	if !ok {
+		return nil, false
+	}
+
+	_, rest, ok := vector(data, lenSize)
+
+	return rest, ok
+}
+
+func skip(data []byte, n int) ([]byte, bool) {
+	if len(data) < n {
+		return nil, false
+	}
+
+	return data[n:], true
+}
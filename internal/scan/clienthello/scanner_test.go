@@ -0,0 +1,100 @@
+package clienthello
+
+import (
+	"crypto/tls"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+)
+
+// clientHello returns the first flight of the real TLS client
+func clientHello(t *testing.T, sni string, alpn ...string) []byte {
+	client, server := net.Pipe()
+	go func() {
+		_ = tls.Client(client, &tls.Config{ServerName: sni, NextProtos: alpn, InsecureSkipVerify: true}).Handshake()
+	}()
+	defer func() {
+		_ = server.Close()
+		_ = client.Close()
+	}()
+
+	buff := make([]byte, 64*1024)
+	n, err := server.Read(buff)
+	require.NoError(t, err)
+
+	return buff[:n]
+}
+
+func TestScanner(t *testing.T) {
+	t.Run("all at once", func(t *testing.T) {
+		hello := clientHello(t, "example.com", "h2", "http/1.1")
+		scanner := NewScanner()
+		data := append(hello, "garbage"...)
+		sni, endsAt, err := scanner.Scan(data)
+		require.NoError(t, err)
+		require.Equal(t, "example.com", sni)
+		require.Equal(t, len(hello), endsAt)
+		require.Equal(t, []string{"h2", "http/1.1"}, scanner.ALPN())
+	})
+
+	t.Run("byte by byte", func(t *testing.T) {
+		hello := clientHello(t, "example.com")
+		scanner := NewScanner()
+		for i := 0; i < len(hello)-1; i++ {
+			sni, endsAt, err := scanner.Scan(hello[i : i+1])
+			require.NoError(t, err)
+			require.Empty(t, sni)
+			require.Equal(t, -1, endsAt)
+		}
+
+		sni, endsAt, err := scanner.Scan(hello[len(hello)-1:])
+		require.NoError(t, err)
+		require.Equal(t, "example.com", sni)
+		require.Equal(t, 1, endsAt)
+		require.Empty(t, scanner.ALPN())
+	})
+
+	t.Run("split into records", func(t *testing.T) {
+		hello := clientHello(t, "example.com")
+		fragment := hello[5:]
+		half := len(fragment) / 2
+		split := append([]byte{0x16, 3, 1, byte(half >> 8), byte(half)}, fragment[:half]...)
+		rest := len(fragment) - half
+		split = append(split, 0x16, 3, 1, byte(rest>>8), byte(rest))
+		split = append(split, fragment[half:]...)
+
+		sni, endsAt, err := NewScanner().Scan(split)
+		require.NoError(t, err)
+		require.Equal(t, "example.com", sni)
+		require.Equal(t, len(split), endsAt)
+	})
+
+	t.Run("no sni", func(t *testing.T) {
+		hello := clientHello(t, "")
+		sni, endsAt, err := NewScanner().Scan(hello)
+		require.NoError(t, err)
+		require.Empty(t, sni)
+		require.Equal(t, len(hello), endsAt)
+	})
+
+	t.Run("release", func(t *testing.T) {
+		scanner := NewScanner()
+		_, _, err := scanner.Scan(clientHello(t, "a.com")[:10])
+		require.NoError(t, err)
+		scanner.Release()
+		sni, _, err := scanner.Scan(clientHello(t, "b.com"))
+		require.NoError(t, err)
+		require.Equal(t, "b.com", sni)
+	})
+
+	t.Run("not tls", func(t *testing.T) {
+		_, _, err := NewScanner().Scan([]byte("GET / HTTP/1.1\r\n\r\n"))
+		require.ErrorIs(t, err, ErrNotHandshake)
+		_, _, err = NewScanner().Scan([]byte{0x16, 3, 1, 0, 4, 0x02, 0, 0, 0})
+		require.ErrorIs(t, err, ErrNotHandshake)
+		_, _, err = NewScanner().Scan([]byte{0x16, 3, 1, 0, 4, 0x01, 0, 0, 0})
+		require.ErrorIs(t, err, ErrBadHello)
+		_, _, err = NewScanner().Scan([]byte{0x16, 3, 1, 0, 4, 0x01, 0xff, 0, 0})
+		require.ErrorIs(t, err, ErrTooLong)
+	})
+}
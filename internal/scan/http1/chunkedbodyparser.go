@@ -2,64 +2,205 @@ package http1
 
 import (
 	"bytes"
-	"errors"
 	"fmt"
 )
 
+const (
+	// maxChunkSizeDigits limits the number of hex digits in the chunk size, so it cannot
+	// overflow the int
+	maxChunkSizeDigits = 15
+	// maxChunkExtensionsLen limits the length of extensions of a single chunk
+	maxChunkExtensionsLen = 4096
+	// maxTrailersLen limits the length of the whole trailer section, including line endings
+	// and the terminating empty line
+	maxTrailersLen = 16 * 1024
+)
+
 type chunkedBodyScanner struct {
-	state       chunkedState
-	chunkLength int
+	// strict enables the strict validation of chunk-size lines: bare LFs and malformed
+	// extensions are rejected instead of being silently skipped
+	strict        bool
+	state         chunkedState
+	chunkLength   int
+	sizeDigits    int
+	extensionsLen int
+	trailersLen   int
+	// trailerLineLen is the length of the current trailer line, that is split between
+	// multiple reads, and prevByte is its last byte
+	trailerLineLen int
+	prevByte       byte
 }
 
-func newChunkedScanner() *chunkedBodyScanner {
-	return new(chunkedBodyScanner)
+func newChunkedScanner(strict bool) *chunkedBodyScanner {
+	return &chunkedBodyScanner{
+		strict: strict,
+	}
 }
 
+// Parse returns the offset of the first byte after the chunked body in data, or -1 in
+// case the body isn't completed yet
 func (c *chunkedBodyScanner) Parse(data []byte) (endsAt int, err error) {
+	originalDataLen := len(data)
+
 	switch c.state {
 	case eChunkLength:
 		goto chunkLength
+	case eChunkLengthCR:
+		goto chunkLengthCR
+	case eChunkExtensionStart, eChunkExtensionNameStart, eChunkExtensionName,
+		eChunkExtensionAfterName, eChunkExtensionValueStart, eChunkExtensionToken,
+		eChunkExtensionQuoted, eChunkExtensionQuotedPair, eChunkExtensionAfterValue:
+		goto chunkExtension
 	case eChunkBody:
 		goto chunkBody
-	case eLastChunk:
-		goto lastChunk
+	case eChunkBodyEnd:
+		goto chunkBodyEnd
+	case eChunkBodyCR:
+		goto chunkBodyCR
+	case eTrailers:
+		goto trailers
 	default:
 		panic(fmt.Errorf("BUG: unknown state for chunked body: %d", c.state))
 	}
 
 chunkLength:
 	for i, digit := range data {
-		if digit == '\r' {
+		decoded, ishex := unhex(digit)
+		if ishex {
+			if c.sizeDigits++; c.sizeDigits > maxChunkSizeDigits {
+				return -1, ErrBadChunkSize
+			}
+
+			c.chunkLength = (c.chunkLength << 4) | int(decoded)
 			continue
-		} else if digit == '\n' {
+		}
+
+		if c.sizeDigits == 0 {
+			return -1, ErrBadChunkSize
+		}
+
+		switch digit {
+		case '\r':
+			data = data[i+1:]
+			c.state = eChunkLengthCR
+			goto chunkLengthCR
+		case '\n':
+			if c.strict {
+				return -1, ErrBareLF
+			}
+
 			data = data[i+1:]
 			goto chunkLengthEnd
+		case ';', ' ', '\t':
+			data = data[i:]
+			c.state = eChunkExtensionStart
+			goto chunkExtension
+		default:
+			return -1, ErrBadChunkSize
 		}
+	}
 
-		decoded, ishex := unhex(digit)
-		if !ishex {
-			return -1, errors.New("bad chunk length char")
+	return -1, nil
+
+chunkExtension:
+	if !c.strict {
+		// extensions are of no interest for us, so just skip them
+		lf := bytes.IndexByte(data, '\n')
+		if lf == -1 {
+			if c.extensionsLen += len(data); c.extensionsLen > maxChunkExtensionsLen {
+				return -1, ErrChunkExtensionsTooLong
+			}
+
+			return -1, nil
+		}
+
+		if c.extensionsLen += lf; c.extensionsLen > maxChunkExtensionsLen {
+			return -1, ErrChunkExtensionsTooLong
+		}
+
+		data = data[lf+1:]
+		goto chunkLengthEnd
+	}
+
+	for i, char := range data {
+		if c.extensionsLen++; c.extensionsLen > maxChunkExtensionsLen {
+			return -1, ErrChunkExtensionsTooLong
+		}
+
+		if char == '\r' {
+			switch c.state {
+			case eChunkExtensionNameStart, eChunkExtensionValueStart,
+				eChunkExtensionQuoted, eChunkExtensionQuotedPair:
+				return -1, ErrBadChunkExtension
+			}
+
+			data = data[i+1:]
+			c.state = eChunkLengthCR
+			goto chunkLengthCR
 		}
 
-		c.chunkLength = (c.chunkLength << 4) | int(decoded)
+		if c.state, err = nextExtensionState(c.state, char); err != nil {
+			return -1, err
+		}
 	}
 
 	return -1, nil
 
+chunkLengthCR:
+	if len(data) == 0 {
+		return -1, nil
+	}
+
+	if data[0] != '\n' {
+		return -1, ErrBadChunkSize
+	}
+
+	data = data[1:]
+
 chunkLengthEnd:
+	c.sizeDigits = 0
+	c.extensionsLen = 0
+
 	if c.chunkLength > 0 {
 		c.state = eChunkBody
 		goto chunkBody
 	}
 
-	c.state = eLastChunk
-	goto lastChunk
+	c.state = eTrailers
+	goto trailers
 
 chunkBody:
-	if len(data) > c.chunkLength {
-		rest := data[c.chunkLength:]
+	if len(data) >= c.chunkLength {
+		data = data[c.chunkLength:]
 		c.chunkLength = 0
-		lf := bytes.IndexByte(rest, '\n')
+		c.state = eChunkBodyEnd
+		goto chunkBodyEnd
+	}
+
+	c.chunkLength -= len(data)
+
+	return -1, nil
+
+chunkBodyEnd:
+	if len(data) == 0 {
+		return -1, nil
+	}
+
+	if c.strict {
+		switch data[0] {
+		case '\r':
+			data = data[1:]
+			c.state = eChunkBodyCR
+			goto chunkBodyCR
+		case '\n':
+			return -1, ErrBareLF
+		default:
+			return -1, ErrBadRequest
+		}
+	}
+
+	{
+		lf := bytes.IndexByte(data, '\n')
 		if lf == -1 {
 			return -1, nil
 		}
@@ -69,21 +210,140 @@ chunkBody:
 		goto chunkLength
 	}
 
-	c.chunkLength -= len(data)
+chunkBodyCR:
+	if len(data) == 0 {
+		return -1, nil
+	}
 
-	return -1, nil
+	if data[0] != '\n' {
+		return -1, ErrBadRequest
+	}
 
-lastChunk:
-	{
+	data = data[1:]
+	c.state = eChunkLength
+	goto chunkLength
+
+trailers:
+	// the trailer section is a sequence of field lines, terminated by an empty line. Trailer
+	// fields are forwarded as is, so we only need to find where they end
+	for {
 		lf := bytes.IndexByte(data, '\n')
 		if lf == -1 {
+			if c.trailersLen += len(data); c.trailersLen > maxTrailersLen {
+				return -1, ErrTrailersTooLong
+			}
+
+			if len(data) > 0 {
+				c.trailerLineLen += len(data)
+				c.prevByte = data[len(data)-1]
+			}
+
 			return -1, nil
 		}
 
-		return lf + 1, nil
+		if c.trailersLen += lf + 1; c.trailersLen > maxTrailersLen {
+			return -1, ErrTrailersTooLong
+		}
+
+		lineLen := c.trailerLineLen + lf
+		endsWithCR := lineLen > 0 && c.prevByte == '\r'
+		if lf > 0 {
+			endsWithCR = data[lf-1] == '\r'
+		}
+
+		if c.strict && !endsWithCR {
+			return -1, ErrBareLF
+		}
+
+		data = data[lf+1:]
+		c.trailerLineLen = 0
+
+		if lineLen == 0 || (lineLen == 1 && endsWithCR) {
+			return originalDataLen - len(data), nil
+		}
 	}
 }
 
+func (c *chunkedBodyScanner) Release() {
+	c.chunkLength = 0
+	c.sizeDigits = 0
+	c.extensionsLen = 0
+	c.trailersLen = 0
+	c.trailerLineLen = 0
+	c.prevByte = 0
+	c.state = eChunkLength
+}
+
+// nextExtensionState validates a single byte of chunk extensions:
+//
+//	chunk-ext = *( BWS ";" BWS ext-name [ BWS "=" BWS ext-val ] )
+//
+// CR is handled by the caller, as it terminates the chunk-size line
+func nextExtensionState(state chunkedState, char byte) (chunkedState, error) {
+	isSpace := char == ' ' || char == '\t'
+
+	switch state {
+	case eChunkExtensionStart, eChunkExtensionAfterValue:
+		switch {
+		case isSpace:
+			return state, nil
+		case char == ';':
+			return eChunkExtensionNameStart, nil
+		}
+	case eChunkExtensionNameStart:
+		switch {
+		case isSpace:
+			return state, nil
+		case isTokenChar(char):
+			return eChunkExtensionName, nil
+		}
+	case eChunkExtensionName, eChunkExtensionAfterName:
+		switch {
+		case isSpace:
+			return eChunkExtensionAfterName, nil
+		case char == ';':
+			return eChunkExtensionNameStart, nil
+		case char == '=':
+			return eChunkExtensionValueStart, nil
+		case state == eChunkExtensionName && isTokenChar(char):
+			return state, nil
+		}
+	case eChunkExtensionValueStart:
+		switch {
+		case isSpace:
+			return state, nil
+		case char == '"':
+			return eChunkExtensionQuoted, nil
+		case isTokenChar(char):
+			return eChunkExtensionToken, nil
+		}
+	case eChunkExtensionToken:
+		switch {
+		case isSpace:
+			return eChunkExtensionAfterValue, nil
+		case char == ';':
+			return eChunkExtensionNameStart, nil
+		case isTokenChar(char):
+			return state, nil
+		}
+	case eChunkExtensionQuoted:
+		switch {
+		case char == '"':
+			return eChunkExtensionAfterValue, nil
+		case char == '\\':
+			return eChunkExtensionQuotedPair, nil
+		case !isControlChar(char):
+			return state, nil
+		}
+	case eChunkExtensionQuotedPair:
+		if !isControlChar(char) {
+			return eChunkExtensionQuoted, nil
+		}
+	}
+
+	return state, ErrBadChunkExtension
+}
+
 func unhex(char byte) (byte, bool) {
 	switch {
 	case '0' <= char && char <= '9':
@@ -96,3 +356,24 @@ func unhex(char byte) (byte, bool) {
 
 	return 0, false
 }
+
+// isTokenChar reports whether the char is a tchar, as defined by RFC 9110, 5.6.2
+func isTokenChar(char byte) bool {
+	switch {
+	case 'a' <= char && char <= 'z', 'A' <= char && char <= 'Z', '0' <= char && char <= '9':
+		return true
+	}
+
+	switch char {
+	case '!', '#', '$', '%', '&', '\'', '*', '+', '-', '.', '^', '_', '`', '|', '~':
+		return true
+	}
+
+	return false
+}
+
+// isControlChar reports whether the char is a control one. HTAB is not considered as such,
+// as it's allowed in quoted strings
+func isControlChar(char byte) bool {
+	return (char < 0x20 && char != '\t') || char == 0x7f
+}
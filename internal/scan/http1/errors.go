@@ -6,4 +6,21 @@ var (
 	ErrBadRequest = errors.New("bad syntax")
 	ErrTooLong    = errors.New("host value is too long")
 	ErrNoHost     = errors.New("no host value is presented")
+	ErrURITooLong = errors.New("request line is too long")
+
+	ErrBadResponse = errors.New("malformed upstream response")
+
+	ErrChunkExtensionsTooLong = errors.New("chunk extensions are too long")
+	ErrTrailersTooLong        = errors.New("trailer section is too long")
+
+	// errors below are returned by the strict scanner, except bad chunk size, that is
+	// also returned by the ordinary one
+	ErrConflictingLength     = errors.New("both content-length and transfer-encoding are presented")
+	ErrContentLengthMismatch = errors.New("differing content-length values")
+	ErrBadContentLength      = errors.New("whitespaces inside content-length value")
+	ErrObsFold               = errors.New("obsolete line folding")
+	ErrSpaceBeforeColon      = errors.New("whitespace between header key and colon")
+	ErrBareLF                = errors.New("line is not terminated by CRLF")
+	ErrBadChunkSize          = errors.New("bad chunk size")
+	ErrBadChunkExtension     = errors.New("bad chunk extension")
 )
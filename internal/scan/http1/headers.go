@@ -0,0 +1,130 @@
+package http1
+
+import (
+	"bytes"
+)
+
+// HeaderLine is a field line of the request head
+type HeaderLine struct {
+	Name []byte
+	// Value is neither trimmed nor unfolded, but excludes the line ending
+	Value []byte
+	// Start and End are positions of the line in the head. End follows the line ending
+	// of the last obs-fold continuation line, so the range covers the whole field
+	Start, End int
+}
+
+// HeaderLines iterates over field lines of the request head. Lines without a colon are
+// skipped, obs-fold continuation lines belong to the preceding one. The head may be
+// incomplete, in this case only lines terminated by LF are visited
+type HeaderLines struct {
+	head []byte
+	pos  int
+}
+
+func NewHeaderLines(head []byte) HeaderLines {
+	// skip the request line
+	pos := bytes.IndexByte(head, '\n') + 1
+	if pos == 0 {
+		pos = len(head)
+	}
+
+	return HeaderLines{head: head, pos: pos}
+}
+
+// Next returns the next field line. It's false at the end of the header section, or of the
+// head if it's incomplete
+func (h *HeaderLines) Next() (line HeaderLine, ok bool) {
+	for {
+		start := h.pos
+		firstEnd := h.lineEnd(start)
+		if firstEnd == -1 || isEmptyLine(h.head[start:firstEnd]) {
+			h.pos = len(h.head)
+			return HeaderLine{}, false
+		}
+
+		end := firstEnd
+		for end < len(h.head) && (h.head[end] == ' ' || h.head[end] == '\t') {
+			if end = h.lineEnd(end); end == -1 {
+				h.pos = len(h.head)
+				return HeaderLine{}, false
+			}
+		}
+
+		h.pos = end
+		// a continuation line without a preceding field can't be attributed to anything
+		if h.head[start] == ' ' || h.head[start] == '\t' {
+			continue
+		}
+
+		colon := bytes.IndexByte(h.head[start:firstEnd], ':')
+		if colon == -1 {
+			continue
+		}
+
+		valueEnd := end - 1
+		if valueEnd > start && h.head[valueEnd-1] == '\r' {
+			valueEnd--
+		}
+
+		return HeaderLine{
+			Name:  h.head[start : start+colon],
+			Value: h.head[start+colon+1 : valueEnd],
+			Start: start,
+			End:   end,
+		}, true
+	}
+}
+
+// lineEnd returns the position right after the LF, terminating the line at start, or -1 if
+// there's none
+func (h *HeaderLines) lineEnd(start int) int {
+	lf := bytes.IndexByte(h.head[start:], '\n')
+	if lf == -1 {
+		return -1
+	}
+
+	return start + lf + 1
+}
+
+// FindHeader returns the value of the first header with the key in the request head. The
+// head may be incomplete, in this case only headers received so far are looked up
+func FindHeader(head []byte, key string) (value []byte, found bool) {
+	lines := NewHeaderLines(head)
+	for line, ok := lines.Next(); ok; line, ok = lines.Next() {
+		if bytes.EqualFold(line.Name, []byte(key)) {
+			return trimSpaces(line.Value), true
+		}
+	}
+
+	return nil, false
+}
+
+// SetHost appends the request to dst with Host header lines replaced by the single one with
+// the host, which follows the request line. The header section must be complete and end at
+// headersEnd, its new end is returned along
+func SetHost(dst, request []byte, headersEnd int, host string) (_ []byte, end int) {
+	// cut is the position in the request, everything before which is already appended
+	cut := bytes.IndexByte(request, '\n') + 1
+	dst = append(dst, request[:cut]...)
+	dst = append(dst, "Host: "...)
+	dst = append(dst, host...)
+	dst = append(dst, "\r\n"...)
+
+	lines := NewHeaderLines(request[:headersEnd])
+	for line, ok := lines.Next(); ok; line, ok = lines.Next() {
+		if bytes.EqualFold(line.Name, hostKey[:len(hostKey)-1]) {
+			dst = append(dst, request[cut:line.Start]...)
+			cut = line.End
+		}
+	}
+
+	dst = append(dst, request[cut:headersEnd]...)
+	end = len(dst)
+
+	return append(dst, request[headersEnd:]...), end
+}
+
+func isEmptyLine(line []byte) bool {
+	return len(line) == 1 || (len(line) == 2 && line[0] == '\r')
+}
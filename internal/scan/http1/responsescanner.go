@@ -0,0 +1,435 @@
+package http1
+
+import (
+	"bytes"
+)
+
+var (
+	connectionKey = []byte("connection:")
+	// this variable must hold the value of the LONGEST response key, including a colon at the end
+	maxResponseKeyLen = len(transferEncodingKey)
+
+	closeToken     = []byte("close")
+	keepAliveToken = []byte("keep-alive")
+
+	responseKeys = [...][]byte{
+		eContentLength:    contentLengthKey,
+		eTransferEncoding: transferEncodingKey,
+		eConnection:       connectionKey,
+	}
+)
+
+// statusLinePrefixLen is the length of the status line part, that is of interest: the protocol
+// version, the status code and the character following it. The reason phrase is skipped
+const statusLinePrefixLen = len("HTTP/1.1 200 ")
+
+// responseHeader is a header, that is of interest for the response scanner
+type responseHeader int
+
+const (
+	eContentLength responseHeader = iota
+	eTransferEncoding
+	eConnection
+)
+
+// ResponseScanner finds where the upstream's response ends, so responses to pipelined
+// requests can be delivered to the client in order and upstream connections can be reused
+type ResponseScanner struct {
+	state responseState
+	// head is set when the response is to the HEAD request, so it has no body regardless
+	// of its headers
+	head          bool
+	status        int
+	minorVersion  byte
+	keepAlive     bool
+	closeBody     bool
+	hasLength     bool
+	contentLength int
+	hasEncoding   bool
+	isChunked     bool
+	// lineBuffer holds the beginning of the status line, or the element of the header value,
+	// which is being scanned. Values of list headers are scanned element by element, so
+	// their length isn't limited
+	lineBuffer []byte
+	keyBuffer  []byte
+	// valueHeader is the header, which value is being scanned
+	valueHeader responseHeader
+	// elementTooLong is set in case the element doesn't fit into the lineBuffer, so it's
+	// known not to be any of expected ones
+	elementTooLong bool
+	// closeOption and keepAliveOption are set as soon as the Connection header value, that
+	// is being scanned, turns out to contain the option
+	closeOption     bool
+	keepAliveOption bool
+	chunkedScanner  *chunkedBodyScanner
+}
+
+func NewResponseScanner() *ResponseScanner {
+	return &ResponseScanner{
+		keyBuffer:      make([]byte, 0, maxResponseKeyLen),
+		lineBuffer:     make([]byte, 0, 256),
+		chunkedScanner: newChunkedScanner(false),
+	}
+}
+
+// Begin prepares the scanner for the response to the next request
+func (r *ResponseScanner) Begin(head bool) {
+	r.head = head
+	r.closeBody = false
+	r.chunkedScanner.Release()
+	r.beginMessage()
+}
+
+// beginMessage resets the per-message state. It's also used after interim responses, as
+// they're followed by the final one for the same request
+func (r *ResponseScanner) beginMessage() {
+	r.state = eStatusLine
+	r.status = 0
+	r.minorVersion = 0
+	r.keepAlive = true
+	r.hasLength = false
+	r.contentLength = 0
+	r.hasEncoding = false
+	r.isChunked = false
+	r.lineBuffer = r.lineBuffer[:0]
+	r.elementTooLong = false
+	r.closeOption, r.keepAliveOption = false, false
+	r.keyBuffer = r.keyBuffer[:0]
+}
+
+// Status returns the status code of the final response. Valid only after its status line
+// is scanned
+func (r *ResponseScanner) Status() int {
+	return r.status
+}
+
+// CloseDelimited reports whether the response body ends only when the connection is closed.
+// Valid only after the response headers are scanned
+func (r *ResponseScanner) CloseDelimited() bool {
+	return r.closeBody
+}
+
+// KeepAlive reports whether the upstream connection can be reused after the response
+func (r *ResponseScanner) KeepAlive() bool {
+	return r.keepAlive && !r.closeBody
+}
+
+// Scan returns the offset of the first byte after the response in data, or -1 in case
+// the response isn't completed yet. Close-delimited responses never complete
+func (r *ResponseScanner) Scan(data []byte) (endsAt int, err error) {
+	var (
+		pos             int
+		originalDataLen = len(data)
+	)
+
+	switch r.state {
+	case eStatusLine:
+		goto statusLine
+	case eResponseHeaderKey:
+		goto headerKey
+	case eResponseHeaderKeyCR:
+		goto headerKeyCR
+	case eResponseKnownHeaderValue:
+		goto knownHeaderValue
+	case eResponseOtherHeaderValue:
+		goto otherHeaderValue
+	case eResponseBody:
+		goto body
+	default:
+		panic("BUG: unknown response scan state")
+	}
+
+statusLine:
+	pos = bytes.IndexByte(data, '\n')
+	if pos == -1 {
+		r.bufferStatusLine(data)
+
+		return -1, nil
+	}
+
+	r.bufferStatusLine(data[:pos])
+	if err = r.parseStatusLine(r.lineBuffer); err != nil {
+		return -1, err
+	}
+
+	r.lineBuffer = r.lineBuffer[:0]
+	data = data[pos+1:]
+	r.state = eResponseHeaderKey
+
+headerKey:
+	if len(data) == 0 {
+		return -1, nil
+	}
+
+	switch data[0] {
+	case '\r':
+		data = data[1:]
+		r.state = eResponseHeaderKeyCR
+		goto headerKeyCR
+	case '\n':
+		data = data[1:]
+		goto headersEnd
+	}
+
+	{
+		buffered := len(r.keyBuffer)
+		keyPart := data
+		if len(keyPart) > maxResponseKeyLen-buffered {
+			keyPart = keyPart[:maxResponseKeyLen-buffered]
+		}
+
+		r.keyBuffer = append(r.keyBuffer, keyPart...)
+
+		for header, key := range responseKeys {
+			if hasKey(r.keyBuffer, key) {
+				data = data[len(key)-buffered:]
+				r.valueHeader = responseHeader(header)
+				r.state = eResponseKnownHeaderValue
+				goto knownHeaderValue
+			}
+		}
+
+		if len(r.keyBuffer) == maxResponseKeyLen || bytes.IndexByte(r.keyBuffer, ':') != -1 {
+			r.state = eResponseOtherHeaderValue
+			goto otherHeaderValue
+		}
+	}
+
+	return -1, nil
+
+headerKeyCR:
+	if len(data) == 0 {
+		return -1, nil
+	}
+
+	if data[0] != '\n' {
+		return -1, ErrBadResponse
+	}
+
+	data = data[1:]
+	goto headersEnd
+
+knownHeaderValue:
+	for {
+		pos = r.elementEnd(data)
+		if pos == -1 {
+			r.bufferElement(data)
+
+			return -1, nil
+		}
+
+		r.bufferElement(data[:pos])
+		if err = r.applyElement(trimSpaces(r.lineBuffer)); err != nil {
+			return -1, err
+		}
+
+		r.lineBuffer = r.lineBuffer[:0]
+		r.elementTooLong = false
+		if data[pos] == '\n' {
+			break
+		}
+
+		data = data[pos+1:]
+	}
+
+	r.applyOptions()
+	data = data[pos+1:]
+	r.keyBuffer = r.keyBuffer[:0]
+	r.state = eResponseHeaderKey
+	goto headerKey
+
+otherHeaderValue:
+	pos = bytes.IndexByte(data, '\n')
+	if pos == -1 {
+		return -1, nil
+	}
+
+	data = data[pos+1:]
+	r.keyBuffer = r.keyBuffer[:0]
+	r.state = eResponseHeaderKey
+	goto headerKey
+
+headersEnd:
+	switch {
+	case r.status >= 100 && r.status < 200 && r.status != 101:
+		// interim response, the final one is going to follow it
+		r.beginMessage()
+		if len(data) == 0 {
+			return -1, nil
+		}
+
+		goto statusLine
+	case r.head, r.status == 101, r.status == 204, r.status == 304:
+		return originalDataLen - len(data), nil
+	case r.hasEncoding && r.isChunked:
+		r.contentLength = 0
+	case r.hasEncoding:
+		// RFC 9112, 6.3: in case chunked isn't the final coding of a response, it's
+		// delimited by closing the connection
+		r.closeBody = true
+	case !r.hasLength:
+		r.closeBody = true
+	}
+
+	r.state = eResponseBody
+
+body:
+	switch {
+	case r.closeBody:
+		return -1, nil
+	case r.isChunked:
+		endsAt, err = r.chunkedScanner.Parse(data)
+		if endsAt == -1 || err != nil {
+			return -1, err
+		}
+
+		return originalDataLen - len(data) + endsAt, nil
+	case len(data) >= r.contentLength:
+		return originalDataLen - len(data) + r.contentLength, nil
+	default:
+		r.contentLength -= len(data)
+
+		return -1, nil
+	}
+}
+
+// parseStatusLine parses the protocol version and the status code:
+//
+//	status-line = HTTP-version SP status-code SP [ reason-phrase ]
+func (r *ResponseScanner) parseStatusLine(line []byte) error {
+	const prefix = "HTTP/1."
+
+	if len(line) < len(prefix)+5 || string(line[:len(prefix)]) != prefix {
+		return ErrBadResponse
+	}
+
+	line = line[len(prefix):]
+	if line[0] < '0' || line[0] > '9' || line[1] != ' ' {
+		return ErrBadResponse
+	}
+
+	r.minorVersion = line[0] - '0'
+	// HTTP/1.0 connections are closed by default
+	r.keepAlive = r.minorVersion > 0
+
+	status := 0
+	for _, char := range line[2:5] {
+		if char < '0' || char > '9' {
+			return ErrBadResponse
+		}
+
+		status = status*10 + int(char-'0')
+	}
+
+	if status < 100 || (len(line) > 5 && line[5] != ' ' && line[5] != '\r') {
+		return ErrBadResponse
+	}
+
+	r.status = status
+
+	return nil
+}
+
+// bufferStatusLine appends the part of the status line to the lineBuffer, unless its
+// interesting prefix is already there
+func (r *ResponseScanner) bufferStatusLine(part []byte) {
+	if room := statusLinePrefixLen - len(r.lineBuffer); len(part) > room {
+		part = part[:room]
+	}
+
+	r.lineBuffer = append(r.lineBuffer, part...)
+}
+
+// elementEnd returns the position of either the LF or, in case the value is a list, the comma
+// terminating its element. It's -1 if data contains neither
+func (r *ResponseScanner) elementEnd(data []byte) int {
+	if r.valueHeader == eContentLength {
+		return bytes.IndexByte(data, '\n')
+	}
+
+	return bytes.IndexAny(data, ",\n")
+}
+
+// bufferElement appends the part of the element to the lineBuffer, unless it's too long
+func (r *ResponseScanner) bufferElement(part []byte) {
+	if r.elementTooLong {
+		return
+	}
+
+	if len(r.lineBuffer)+len(part) > cap(r.lineBuffer) {
+		r.elementTooLong = true
+		return
+	}
+
+	r.lineBuffer = append(r.lineBuffer, part...)
+}
+
+// applyElement applies the element of the header value. Content-Length has the only element,
+// which is the whole value
+func (r *ResponseScanner) applyElement(element []byte) error {
+	switch r.valueHeader {
+	case eContentLength:
+		length, ok := parseContentLength(element)
+		if !ok || r.elementTooLong || (r.hasLength && length != r.contentLength) {
+			return ErrBadResponse
+		}
+
+		r.hasLength = true
+		r.contentLength = length
+	case eTransferEncoding:
+		// only the last coding matters
+		r.hasEncoding = true
+		r.isChunked = !r.elementTooLong && equalfold(element, chunkedCoding)
+	case eConnection:
+		r.closeOption = r.closeOption || (!r.elementTooLong && equalfold(element, closeToken))
+		r.keepAliveOption = r.keepAliveOption || (!r.elementTooLong && equalfold(element, keepAliveToken))
+	}
+
+	return nil
+}
+
+// applyOptions applies the Connection header value as soon as it's completely scanned
+func (r *ResponseScanner) applyOptions() {
+	if r.closeOption {
+		r.keepAlive = false
+	} else if r.keepAliveOption {
+		r.keepAlive = true
+	}
+
+	r.closeOption, r.keepAliveOption = false, false
+}
+
+func parseContentLength(value []byte) (length int, ok bool) {
+	if len(value) == 0 || len(value) > maxContentLengthDigits {
+		return 0, false
+	}
+
+	for _, char := range value {
+		if char < '0' || char > '9' {
+			return 0, false
+		}
+
+		length = length*10 + int(char-'0')
+	}
+
+	return length, true
+}
+
+// hasToken reports whether the comma-separated list contains the token, case-insensitively.
+// The token must be in lower case
+func hasToken(list, token []byte) bool {
+	for len(list) > 0 {
+		var element []byte
+		if comma := bytes.IndexByte(list, ','); comma != -1 {
+			element, list = list[:comma], list[comma+1:]
+		} else {
+			element, list = list, nil
+		}
+
+		if equalfold(trimSpaces(element), token) {
+			return true
+		}
+	}
+
+	return false
+}
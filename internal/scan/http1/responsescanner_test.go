@@ -0,0 +1,119 @@
+package http1
+
+import (
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+func TestResponseScanner(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		response  string
+		head      bool
+		keepAlive bool
+	}{
+		{
+			name:      "content-length",
+			response:  "HTTP/1.1 200 OK\r\nContent-Length: 13\r\n\r\nHello, world!",
+			keepAlive: true,
+		},
+		{
+			name: "chunked with trailers",
+			response: "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n" +
+				"5\r\nHello\r\n0\r\nGrpc-Status: 0\r\n\r\n",
+			keepAlive: true,
+		},
+		{
+			name:      "interim responses",
+			response:  "HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 103 Early Hints\r\nLink: </a>\r\n\r\nHTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok",
+			keepAlive: true,
+		},
+		{
+			name:      "head",
+			response:  "HTTP/1.1 200 OK\r\nContent-Length: 13\r\n\r\n",
+			head:      true,
+			keepAlive: true,
+		},
+		{
+			name:      "no content",
+			response:  "HTTP/1.1 204 No Content\r\nContent-Length: 13\r\n\r\n",
+			keepAlive: true,
+		},
+		{
+			name:      "not modified",
+			response:  "HTTP/1.1 304 Not Modified\r\nTransfer-Encoding: chunked\r\n\r\n",
+			keepAlive: true,
+		},
+		{
+			name:     "connection close",
+			response: "HTTP/1.1 200 OK\r\nConnection: keep-alive, Close\r\nContent-Length: 2\r\n\r\nok",
+		},
+		{
+			name:     "http/1.0",
+			response: "HTTP/1.0 200 OK\r\nContent-Length: 2\r\n\r\nok",
+		},
+		{
+			name:      "long reason phrase",
+			response:  "HTTP/1.1 200 " + strings.Repeat("OK", 512) + "\r\nContent-Length: 2\r\n\r\nok",
+			keepAlive: true,
+		},
+		{
+			name: "long token lists",
+			response: "HTTP/1.1 200 OK\r\nConnection: " + strings.Repeat("x-option, ", 64) + "close\r\n" +
+				"Transfer-Encoding: " + strings.Repeat("gzip, ", 64) + strings.Repeat("x", 512) + ", chunked\r\n\r\n" +
+				"0\r\n\r\n",
+		},
+		{
+			name:      "http/1.0 keep-alive",
+			response:  "HTTP/1.0 200 OK\r\nConnection: keep-alive\r\nContent-Length: 2\r\n\r\nok",
+			keepAlive: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			scan := NewResponseScanner()
+			scan.Begin(tc.head)
+			data := []byte(tc.response + "HTTP/1.1 200 OK\r\n")
+			endsAt, err := scan.Scan(data)
+			require.NoError(t, err)
+			require.Equal(t, len(tc.response), endsAt)
+			require.Equal(t, tc.keepAlive, scan.KeepAlive())
+
+			scan.Begin(tc.head)
+			for i := 0; i < len(tc.response)-1; i++ {
+				endsAt, err = scan.Scan(data[i : i+1])
+				require.NoError(t, err)
+				require.Equal(t, -1, endsAt, "ended too early at %d", i)
+			}
+
+			endsAt, err = scan.Scan(data[len(tc.response)-1:])
+			require.NoError(t, err)
+			require.Equal(t, 1, endsAt)
+		})
+	}
+
+	t.Run("close-delimited", func(t *testing.T) {
+		scan := NewResponseScanner()
+		scan.Begin(false)
+		endsAt, err := scan.Scan([]byte("HTTP/1.1 200 OK\r\nTransfer-Encoding: gzip\r\n\r\nbody"))
+		require.NoError(t, err)
+		require.Equal(t, -1, endsAt)
+		require.True(t, scan.CloseDelimited())
+		require.False(t, scan.KeepAlive())
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		for _, response := range []string{
+			"HTTP/2 200 OK\r\n\r\n",
+			"HTTP/1.1 2xx OK\r\n\r\n",
+			"HTTP/1.1 200 OK\r\nContent-Length: 1\r\nContent-Length: 2\r\n\r\n",
+			"HTTP/1.1 200 OK\r\nContent-Length: -1\r\n\r\n",
+			"HTTP/1.1 200OK\r\n\r\n",
+		} {
+			scan := NewResponseScanner()
+			scan.Begin(false)
+			_, err := scan.Scan([]byte(response))
+			require.ErrorIs(t, err, ErrBadResponse, response)
+		}
+	})
+}
@@ -9,29 +9,97 @@ import (
 var (
 	_ scan.Scanner = NewScanner()
 
-	hostKey          = []byte("host:")
-	contentLengthKey = []byte("content-length:")
+	hostKey             = []byte("host:")
+	contentLengthKey    = []byte("content-length:")
+	transferEncodingKey = []byte("transfer-encoding:")
+	upgradeKey          = []byte("upgrade:")
 	// this variable must hold the value of the LONGEST key, including a colon at the end
-	maxKeyLen = len(contentLengthKey)
+	maxKeyLen = len(transferEncodingKey)
+
+	chunkedCoding = []byte("chunked")
+
+	connectMethod = []byte("CONNECT")
+	httpScheme    = []byte("http://")
+	httpsScheme   = []byte("https://")
+	http10        = []byte("HTTP/1.0")
 )
 
+// maxRequestLineLen limits the request line, as it's buffered until it's complete
+const maxRequestLineLen = 8 * 1024
+
+// maxContentLengthDigits limits the number of digits in the Content-Length value, so it
+// cannot overflow the int
+const maxContentLengthDigits = 18
+
 type Scanner struct {
+	// strict enables the request smuggling hardening: every ambiguity in the request framing,
+	// which may be resolved differently by the backend, results in an error
+	strict        bool
 	contentLength int
-	// TODO: to check, whether request's body is chunked, we need to parse
-	//  the value of the Transfer-Encoding header
-	isChunked       bool
-	state           parserState
-	headerKeyBuffer []byte
-	hostValueBuffer []byte
-	host            string
-	chunkedScanner  *chunkedBodyScanner
+	// lengthValue and lengthDigits hold the Content-Length header value being parsed, so
+	// duplicated headers can be compared against each other. lengthEnded is set as soon as
+	// whitespaces follow the digits
+	lengthValue      int
+	lengthDigits     int
+	lengthEnded      bool
+	hasContentLength bool
+	hasHost          bool
+	// isChunked is set in case the last coding in the last met Transfer-Encoding header
+	// is chunked
+	isChunked           bool
+	hasTransferEncoding bool
+	// hasUpgrade is set in case the request asks to switch protocols by the Upgrade header
+	hasUpgrade bool
+	// connectionClose and connectionKeepAlive are set in case the Connection header has the
+	// respective option
+	connectionClose     bool
+	connectionKeepAlive bool
+	// lineBuffer holds the request line, as it might be split between multiple reads
+	lineBuffer []byte
+	request    scan.Request
+	isConnect  bool
+	// hostFromTarget is set in case the host is taken from the request target, so the Host
+	// header is ignored
+	hostFromTarget        bool
+	state                 parserState
+	headerKeyBuffer       []byte
+	hostValueBuffer       []byte
+	encodingValueBuffer   []byte
+	connectionValueBuffer []byte
+	host                  string
+	chunkedScanner        *chunkedBodyScanner
+	// prevByte is the last byte of the previous data, in case it ended in the middle of the
+	// line. Used to find out, whether a line, split between multiple reads, ends with CRLF
+	prevByte byte
+	// offset is the number of bytes of the request, scanned before the current data
+	offset int
+	// headersEnd is the offset of the empty line, terminating the header section, from the
+	// beginning of the request
+	headersEnd int
 }
 
 func NewScanner() *Scanner {
+	return newScanner(false)
+}
+
+// NewStrictScanner returns a scanner, that rejects requests whose framing might be
+// interpreted differently by the backends: Content-Length together with Transfer-Encoding,
+// differing or whitespace-separated Content-Length values, multiple Host headers, obs-folded
+// header lines, whitespaces before the colon, bare LF line endings and malformed chunk-size lines
+func NewStrictScanner() *Scanner {
+	return newScanner(true)
+}
+
+func newScanner(strict bool) *Scanner {
 	return &Scanner{
-		headerKeyBuffer: make([]byte, 0, maxKeyLen),
-		hostValueBuffer: make([]byte, 0, 4096),
-		chunkedScanner:  newChunkedScanner(),
+		headersEnd:            -1,
+		strict:                strict,
+		headerKeyBuffer:       make([]byte, 0, maxKeyLen),
+		hostValueBuffer:       make([]byte, 0, 4096),
+		lineBuffer:            make([]byte, 0, 256),
+		encodingValueBuffer:   make([]byte, 0, 256),
+		connectionValueBuffer: make([]byte, 0, 256),
+		chunkedScanner:        newChunkedScanner(strict),
 	}
 }
 
@@ -39,19 +107,30 @@ func (s *Scanner) Scan(data []byte) (to string, endsAt int, err error) {
 	var (
 		pos             int
 		originalDataLen = len(data)
+		offset          = s.offset
 	)
 
+	s.offset += len(data)
+
 	switch s.state {
 	case eRequestLine:
 		goto requestLine
 	case eHeaderKey:
 		goto headerKey
+	case eHeaderKeyCR:
+		goto headerKeyCR
 	case eHostValue:
 		goto hostValue
 	case eContentLengthValue:
 		goto contentLengthValue
 	case eContentLengthValueCR:
 		goto contentLengthValueCR
+	case eTransferEncodingValue:
+		goto transferEncodingValue
+	case eConnectionValue:
+		goto connectionValue
+	case eOtherHeaderKey:
+		goto otherHeaderKey
 	case eOtherHeaderValue:
 		goto otherHeaderValue
 	case eBody:
@@ -63,9 +142,26 @@ func (s *Scanner) Scan(data []byte) (to string, endsAt int, err error) {
 requestLine:
 	pos = bytes.IndexByte(data, '\n')
 	if pos == -1 {
+		if err = s.bufferLine(data); err != nil {
+			return "", -1, err
+		}
+
+		s.rememberLastByte(data)
 		return "", -1, nil
 	}
 
+	if s.strict && s.isBareLF(data, pos) {
+		return "", -1, ErrBareLF
+	}
+
+	if err = s.bufferLine(data[:pos]); err != nil {
+		return "", -1, err
+	}
+
+	if err = s.parseRequestLine(); err != nil {
+		return "", -1, err
+	}
+
 	data = data[pos+1:]
 	s.state = eHeaderKey
 	// no goto, as headerKey is anyway just below. Just let it fall through without any extra
@@ -78,39 +174,93 @@ headerKey:
 
 	switch data[0] {
 	case '\r':
+		// the CR might be the last byte of the data, so the position is remembered now
+		s.headersEnd = offset + originalDataLen - len(data)
 		data = data[1:]
 		s.state = eHeaderKeyCR
 		goto headerKeyCR
 	case '\n':
+		if s.strict {
+			return "", -1, ErrBareLF
+		}
+
 		if len(s.host) == 0 {
 			return "", -1, ErrNoHost
 		}
 
+		s.headersEnd = offset + originalDataLen - len(data)
 		data = data[1:]
 		s.state = eBody
 		goto body
+	case ' ', '\t':
+		if s.strict && len(s.headerKeyBuffer) == 0 {
+			return "", -1, ErrObsFold
+		}
 	}
 
-	s.headerKeyBuffer = append(s.headerKeyBuffer, data[:maxKeyLen-len(s.headerKeyBuffer)]...)
+	{
+		// the key may be split between multiple reads, so the part of it that is already
+		// buffered must be taken into account when skipping the key in current data
+		buffered := len(s.headerKeyBuffer)
+		keyPart := data
+		if len(keyPart) > maxKeyLen-buffered {
+			keyPart = keyPart[:maxKeyLen-buffered]
+		}
 
-	if len(s.headerKeyBuffer) >= len(hostKey) && s.headerKeyBuffer[len(hostKey)-1] == ':' {
-		if !equalfold(s.headerKeyBuffer[:len(hostKey)], hostKey) {
+		s.headerKeyBuffer = append(s.headerKeyBuffer, keyPart...)
+
+		switch {
+		case hasKey(s.headerKeyBuffer, hostKey):
+			if s.strict && s.hasHost {
+				return "", -1, ErrBadRequest
+			}
+
+			data = data[len(hostKey)-buffered:]
+			s.hasHost = true
+			if s.hostFromTarget {
+				// RFC 9112, 3.2.2: the host of the absolute-form target wins over the header
+				s.state = eOtherHeaderValue
+				goto otherHeaderValue
+			}
+
+			s.hostValueBuffer = s.hostValueBuffer[:0]
+			s.state = eHostValue
+			goto hostValue
+		case hasKey(s.headerKeyBuffer, contentLengthKey):
+			data = data[len(contentLengthKey)-buffered:]
+			s.lengthValue, s.lengthDigits, s.lengthEnded = 0, 0, false
+			s.state = eContentLengthValue
+			goto contentLengthValue
+		case hasKey(s.headerKeyBuffer, transferEncodingKey):
+			data = data[len(transferEncodingKey)-buffered:]
+			s.state = eTransferEncodingValue
+			goto transferEncodingValue
+		case hasKey(s.headerKeyBuffer, connectionKey):
+			data = data[len(connectionKey)-buffered:]
+			s.state = eConnectionValue
+			goto connectionValue
+		case hasKey(s.headerKeyBuffer, upgradeKey):
+			// the value doesn't matter, as the upstream decides whether to switch anyway
+			data = data[len(upgradeKey)-buffered:]
+			s.hasUpgrade = true
 			s.state = eOtherHeaderValue
 			goto otherHeaderValue
-		}
+		case len(s.headerKeyBuffer) == maxKeyLen || bytes.IndexByte(s.headerKeyBuffer, ':') != -1:
+			// neither of known keys can be matched anymore
+			if s.strict {
+				// the byte before the current data, in case the key is split
+				s.prevByte = 0
+				if buffered > 0 {
+					s.prevByte = s.headerKeyBuffer[buffered-1]
+				}
+
+				s.state = eOtherHeaderKey
+				goto otherHeaderKey
+			}
 
-		data = data[len(hostKey):]
-		s.state = eHostValue
-		goto hostValue
-	} else if len(s.headerKeyBuffer) >= len(contentLengthKey) {
-		if !equalfold(s.headerKeyBuffer, contentLengthKey) {
 			s.state = eOtherHeaderValue
 			goto otherHeaderValue
 		}
-
-		data = data[len(contentLengthKey):]
-		s.state = eContentLengthValue
-		goto contentLengthValue
 	}
 
 	return s.host, -1, nil
@@ -124,20 +274,65 @@ headerKeyCR:
 		return "", -1, ErrBadRequest
 	}
 
-	if len(s.hostValueBuffer) == 0 {
+	if len(s.host) == 0 {
 		return "", -1, ErrNoHost
 	}
 
+	if s.strict && s.hasContentLength && s.hasTransferEncoding {
+		return "", -1, ErrConflictingLength
+	}
+
 	data = data[1:]
 	s.state = eBody
 	goto body
 
+otherHeaderKey:
+	// the key is validated by the strict scanner only. Known keys are matched only when they
+	// are immediately followed by the colon, so they'll end up here otherwise, too
+	pos = bytes.IndexByte(data, ':')
+	if pos == -1 {
+		if bytes.IndexByte(data, '\n') != -1 {
+			return "", -1, ErrBadRequest
+		}
+
+		s.rememberLastByte(data)
+		return s.host, -1, nil
+	}
+
+	if bytes.IndexByte(data[:pos], '\n') != -1 {
+		return "", -1, ErrBadRequest
+	}
+
+	{
+		beforeColon := s.prevByte
+		if pos > 0 {
+			beforeColon = data[pos-1]
+		}
+
+		switch beforeColon {
+		case 0:
+			// empty header key
+			return "", -1, ErrBadRequest
+		case ' ', '\t':
+			return "", -1, ErrSpaceBeforeColon
+		}
+	}
+
+	data = data[pos+1:]
+	s.prevByte = ':'
+	s.state = eOtherHeaderValue
+
 otherHeaderValue:
 	pos = bytes.IndexByte(data, '\n')
 	if pos == -1 {
+		s.rememberLastByte(data)
 		return s.host, -1, nil
 	}
 
+	if s.strict && s.isBareLF(data, pos) {
+		return "", -1, ErrBareLF
+	}
+
 	data = data[pos+1:]
 	s.headerKeyBuffer = s.headerKeyBuffer[:0]
 	s.state = eHeaderKey
@@ -156,17 +351,17 @@ hostValue:
 	}
 
 	{
-		value := trimPrefixSpaces(data[:pos])
-		if value[len(value)-1] == '\r' {
-			value = value[:len(value)-1]
+		if len(s.hostValueBuffer)+pos > cap(s.hostValueBuffer) {
+			return "", -1, ErrTooLong
 		}
 
-		if len(s.hostValueBuffer)+len(value) > cap(s.hostValueBuffer) {
-			return "", -1, ErrTooLong
+		// the value is trimmed only now, as it might be split between multiple reads
+		s.hostValueBuffer = append(s.hostValueBuffer, data[:pos]...)
+		if s.strict && !endsWithCR(s.hostValueBuffer) {
+			return "", -1, ErrBareLF
 		}
 
-		s.hostValueBuffer = append(s.hostValueBuffer, value...)
-		s.host = uf.B2S(s.hostValueBuffer)
+		s.host = uf.B2S(trimSpaces(s.hostValueBuffer))
 		data = data[pos+1:]
 		s.headerKeyBuffer = s.headerKeyBuffer[:0]
 		s.state = eHeaderKey
@@ -180,15 +375,32 @@ contentLengthValue:
 
 	for i, char := range data {
 		if char == ' ' {
+			s.lengthEnded = s.lengthDigits > 0
 			continue
 		}
 
 		if char < '0' || char > '9' {
 			data = data[i:]
-			break
+			goto contentLengthValueEnd
 		}
 
-		s.contentLength = s.contentLength*10 + int(char) - '0'
+		// digits, separated by whitespaces, might be read by the backend as either number
+		if s.lengthEnded {
+			return "", -1, ErrBadContentLength
+		}
+
+		if s.lengthDigits++; s.lengthDigits > maxContentLengthDigits {
+			return "", -1, ErrBadRequest
+		}
+
+		s.lengthValue = s.lengthValue*10 + int(char) - '0'
+	}
+
+	return s.host, -1, nil
+
+contentLengthValueEnd:
+	if err = s.setContentLength(); err != nil {
+		return "", -1, err
 	}
 
 	switch data[0] {
@@ -197,6 +409,10 @@ contentLengthValue:
 		s.state = eContentLengthValueCR
 		goto contentLengthValueCR
 	case '\n':
+		if s.strict {
+			return "", -1, ErrBareLF
+		}
+
 		data = data[1:]
 		s.headerKeyBuffer = s.headerKeyBuffer[:0]
 		s.state = eHeaderKey
@@ -220,10 +436,79 @@ contentLengthValueCR:
 	s.state = eHeaderKey
 	goto headerKey
 
+transferEncodingValue:
+	pos = bytes.IndexByte(data, '\n')
+	if pos == -1 {
+		if len(s.encodingValueBuffer)+len(data) > cap(s.encodingValueBuffer) {
+			return "", -1, ErrTooLong
+		}
+
+		s.encodingValueBuffer = append(s.encodingValueBuffer, data...)
+
+		return s.host, -1, nil
+	}
+
+	if len(s.encodingValueBuffer)+pos > cap(s.encodingValueBuffer) {
+		return "", -1, ErrTooLong
+	}
+
+	s.encodingValueBuffer = append(s.encodingValueBuffer, data[:pos]...)
+	if s.strict && !endsWithCR(s.encodingValueBuffer) {
+		return "", -1, ErrBareLF
+	}
+
+	s.isChunked = lastCodingIsChunked(s.encodingValueBuffer)
+	s.hasTransferEncoding = true
+	s.encodingValueBuffer = s.encodingValueBuffer[:0]
+	data = data[pos+1:]
+	s.headerKeyBuffer = s.headerKeyBuffer[:0]
+	s.state = eHeaderKey
+	goto headerKey
+
+connectionValue:
+	pos = bytes.IndexByte(data, '\n')
+	if pos == -1 {
+		if len(s.connectionValueBuffer)+len(data) > cap(s.connectionValueBuffer) {
+			return "", -1, ErrTooLong
+		}
+
+		s.connectionValueBuffer = append(s.connectionValueBuffer, data...)
+
+		return s.host, -1, nil
+	}
+
+	if len(s.connectionValueBuffer)+pos > cap(s.connectionValueBuffer) {
+		return "", -1, ErrTooLong
+	}
+
+	s.connectionValueBuffer = append(s.connectionValueBuffer, data[:pos]...)
+	if s.strict && !endsWithCR(s.connectionValueBuffer) {
+		return "", -1, ErrBareLF
+	}
+
+	// options are accumulated, as they might be split between multiple headers
+	s.connectionClose = s.connectionClose || hasToken(s.connectionValueBuffer, closeToken)
+	s.connectionKeepAlive = s.connectionKeepAlive || hasToken(s.connectionValueBuffer, keepAliveToken)
+	s.connectionValueBuffer = s.connectionValueBuffer[:0]
+	data = data[pos+1:]
+	s.headerKeyBuffer = s.headerKeyBuffer[:0]
+	s.state = eHeaderKey
+	goto headerKey
+
 body:
+	if s.hasTransferEncoding && !s.isChunked {
+		// RFC 9112, 6.3: in case chunked isn't the final coding of a request, its length
+		// cannot be determined reliably
+		return "", -1, ErrBadRequest
+	}
+
 	if s.isChunked {
 		endsAt, err = s.chunkedScanner.Parse(data)
-		return s.host, originalDataLen - endsAt, err
+		if endsAt == -1 || err != nil {
+			return s.host, -1, err
+		}
+
+		return s.host, originalDataLen - len(data) + endsAt, nil
 	}
 
 	if len(data) >= s.contentLength {
@@ -235,14 +520,205 @@ body:
 	return s.host, -1, nil
 }
 
+// HeadersEnd returns the offset of the empty line, that terminates the header section, from
+// the beginning of the request. It's -1 until the whole header section is scanned
+func (s *Scanner) HeadersEnd() int {
+	if s.state != eBody {
+		return -1
+	}
+
+	return s.headersEnd
+}
+
+// Request returns the request line. It's available as soon as the host is returned
+func (s *Scanner) Request() scan.Request {
+	return s.request
+}
+
+// TargetHost returns the host of the absolute-form target, which wins over the Host header.
+// It's empty for other forms and CONNECT requests
+func (s *Scanner) TargetHost() string {
+	if !s.hostFromTarget || s.isConnect {
+		return ""
+	}
+
+	return s.host
+}
+
+// Connect reports whether the request is CONNECT. The host is the destination of the tunnel
+// in this case, taken from the request target
+func (s *Scanner) Connect() bool {
+	return s.isConnect
+}
+
+// Upgrade reports whether the request carries the Upgrade header. In case the upstream
+// agrees to switch protocols, the connection isn't HTTP anymore after the request
+func (s *Scanner) Upgrade() bool {
+	return s.hasUpgrade
+}
+
+// KeepAlive reports whether the connection persists after the request. RFC 9112, 9.3: the
+// close option of the Connection header ends it, while HTTP/1.0 requires the keep-alive one.
+// Valid only until the scanner is released
+func (s *Scanner) KeepAlive() bool {
+	if bytes.Equal(s.request.Version, http10) {
+		return !s.connectionClose && s.connectionKeepAlive
+	}
+
+	return !s.connectionClose
+}
+
 func (s *Scanner) Release() {
+	s.offset = 0
+	s.headersEnd = -1
 	s.contentLength = 0
+	s.lengthValue, s.lengthDigits, s.lengthEnded = 0, 0, false
+	s.hasContentLength = false
+	s.hasHost = false
+	s.prevByte = 0
 	s.hostValueBuffer = s.hostValueBuffer[:0]
 	s.host = ""
 	s.isChunked = false
+	s.hasTransferEncoding = false
+	s.hasUpgrade = false
+	s.lineBuffer = s.lineBuffer[:0]
+	s.request = scan.Request{}
+	s.isConnect = false
+	s.hostFromTarget = false
+	s.headerKeyBuffer = s.headerKeyBuffer[:0]
+	s.encodingValueBuffer = s.encodingValueBuffer[:0]
+	s.connectionClose, s.connectionKeepAlive = false, false
+	s.connectionValueBuffer = s.connectionValueBuffer[:0]
+	s.chunkedScanner.Release()
 	s.state = eRequestLine
 }
 
+// bufferLine appends the part of the request line to the buffer
+func (s *Scanner) bufferLine(part []byte) error {
+	if len(s.lineBuffer)+len(part) > maxRequestLineLen {
+		return ErrURITooLong
+	}
+
+	s.lineBuffer = append(s.lineBuffer, part...)
+
+	return nil
+}
+
+// parseRequestLine splits the buffered request line. In case the target is CONNECT or
+// absolute-form, the host is taken from it. Missing parts are left empty
+func (s *Scanner) parseRequestLine() error {
+	line := s.lineBuffer
+	if endsWithCR(line) {
+		line = line[:len(line)-1]
+	}
+
+	sp := bytes.IndexByte(line, ' ')
+	if sp == -1 {
+		s.request.Method = line
+		return nil
+	}
+
+	s.request.Method, line = line[:sp], line[sp+1:]
+	s.request.Target = line
+	if sp = bytes.IndexByte(line, ' '); sp != -1 {
+		s.request.Target, s.request.Version = line[:sp], line[sp+1:]
+	}
+
+	s.isConnect = bytes.Equal(s.request.Method, connectMethod)
+	authority := targetAuthority(s.request.Target)
+	if s.isConnect {
+		authority = s.request.Target
+	}
+
+	if len(authority) == 0 {
+		return nil
+	}
+
+	if len(authority) > cap(s.hostValueBuffer) {
+		return ErrTooLong
+	}
+
+	s.hostValueBuffer = append(s.hostValueBuffer[:0], authority...)
+	s.host = uf.B2S(s.hostValueBuffer)
+	s.hostFromTarget = true
+
+	return nil
+}
+
+// targetAuthority returns the authority of the absolute-form target with http or https
+// scheme. Otherwise, it's empty
+func targetAuthority(target []byte) []byte {
+	scheme := httpScheme
+	if len(target) > len("http") && target[len("http")]|0x20 == 's' {
+		scheme = httpsScheme
+	}
+
+	if !hasKey(target, scheme) {
+		return nil
+	}
+
+	authority := target[len(scheme):]
+	if end := bytes.IndexAny(authority, "/?#"); end != -1 {
+		authority = authority[:end]
+	}
+
+	return authority
+}
+
+// setContentLength applies just parsed Content-Length value. Non-strict scanner just
+// takes the last one in case of duplicates
+func (s *Scanner) setContentLength() error {
+	if s.strict {
+		if s.lengthDigits == 0 {
+			return ErrBadRequest
+		}
+
+		if s.hasContentLength && s.lengthValue != s.contentLength {
+			return ErrContentLengthMismatch
+		}
+	}
+
+	s.contentLength = s.lengthValue
+	s.hasContentLength = true
+
+	return nil
+}
+
+func (s *Scanner) rememberLastByte(data []byte) {
+	if len(data) > 0 {
+		s.prevByte = data[len(data)-1]
+	}
+}
+
+// isBareLF reports whether the LF at data[pos] isn't preceded by CR. The CR might also be
+// the last byte of the previous data
+func (s *Scanner) isBareLF(data []byte, pos int) bool {
+	if pos > 0 {
+		return data[pos-1] != '\r'
+	}
+
+	return s.prevByte != '\r'
+}
+
+func endsWithCR(b []byte) bool {
+	return len(b) > 0 && b[len(b)-1] == '\r'
+}
+
+// lastCodingIsChunked reports whether the last coding in a comma-separated list of
+// transfer codings is chunked. Codings parameters are not taken into account, as chunked
+// has none
+func lastCodingIsChunked(value []byte) bool {
+	if comma := bytes.LastIndexByte(value, ','); comma != -1 {
+		value = value[comma+1:]
+	}
+
+	return equalfold(trimSpaces(value), chunkedCoding)
+}
+
+func hasKey(buffer, key []byte) bool {
+	return len(buffer) >= len(key) && equalfold(buffer[:len(key)], key)
+}
+
 func trimPrefixSpaces(b []byte) []byte {
 	for i, char := range b {
 		if char != ' ' {
@@ -253,6 +729,20 @@ func trimPrefixSpaces(b []byte) []byte {
 	return b[:0]
 }
 
+func trimSpaces(b []byte) []byte {
+	b = trimPrefixSpaces(b)
+	for len(b) > 0 {
+		switch b[len(b)-1] {
+		case ' ', '\t', '\r':
+			b = b[:len(b)-1]
+		default:
+			return b
+		}
+	}
+
+	return b
+}
+
 func equalfold(a, b []byte) bool {
 	if len(a) != len(b) {
 		return false
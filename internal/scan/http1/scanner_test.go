@@ -1,7 +1,9 @@
 package http1
 
 import (
+	"bytes"
 	"github.com/stretchr/testify/require"
+	"strings"
 	"testing"
 )
 
@@ -28,4 +30,423 @@ func TestScanner(t *testing.T) {
 		require.Equal(t, "www.google.com", host)
 		require.Equal(t, "rest", request[endsAt:])
 	})
+
+	t.Run("chunked body", func(t *testing.T) {
+		request := "POST / HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\n" +
+			"d\r\nHello, world!\r\n0\r\n\r\nrest"
+		scan := NewScanner()
+		host, endsAt, err := scan.Scan([]byte(request))
+		require.NoError(t, err)
+		require.Equal(t, "example.com", host)
+		require.Equal(t, "rest", request[endsAt:])
+	})
+
+	t.Run("chunked as the final coding", func(t *testing.T) {
+		request := "POST / HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: gzip, Chunked\r\n\r\n" +
+			"5\r\nHello\r\n0\r\n\r\nrest"
+		scan := NewScanner()
+		_, endsAt, err := scan.Scan([]byte(request))
+		require.NoError(t, err)
+		require.Equal(t, "rest", request[endsAt:])
+	})
+
+	t.Run("chunked is not the final coding", func(t *testing.T) {
+		request := "POST / HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked, gzip\r\n\r\n"
+		scan := NewScanner()
+		_, _, err := scan.Scan([]byte(request))
+		require.EqualError(t, err, ErrBadRequest.Error())
+	})
+
+	t.Run("chunked body byte by byte", func(t *testing.T) {
+		request := "POST / HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\n" +
+			"d\r\nHello, world!\r\n5\r\nHello\r\n0\r\n\r\n"
+		scan := NewScanner()
+		for i := 0; i < len(request)-1; i++ {
+			_, endsAt, err := scan.Scan([]byte{request[i]})
+			require.NoError(t, err)
+			require.Equal(t, -1, endsAt, "ended too early at %d", i)
+		}
+
+		host, endsAt, err := scan.Scan([]byte{request[len(request)-1]})
+		require.NoError(t, err)
+		require.Equal(t, "example.com", host)
+		require.Equal(t, 1, endsAt)
+	})
+
+	t.Run("whitespace inside content-length", func(t *testing.T) {
+		// the backend might read digits, separated by whitespaces, as either number
+		request := "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 1 2\r\n\r\nHello, world"
+		for _, scan := range []*Scanner{NewScanner(), NewStrictScanner()} {
+			_, _, err := scan.Scan([]byte(request))
+			require.ErrorIs(t, err, ErrBadContentLength)
+		}
+
+		scan := NewScanner()
+		for i := 0; i < len(request); i++ {
+			if _, _, err := scan.Scan([]byte{request[i]}); err != nil {
+				require.ErrorIs(t, err, ErrBadContentLength)
+				return
+			}
+		}
+
+		require.Fail(t, "the request is accepted")
+	})
+
+	t.Run("pipelined chunked requests", func(t *testing.T) {
+		request := "POST / HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\n" +
+			"5\r\nHello\r\n0\r\n\r\n"
+		data := []byte(request + request)
+		scan := NewScanner()
+		_, endsAt, err := scan.Scan(data)
+		require.NoError(t, err)
+		require.Equal(t, len(request), endsAt)
+		scan.Release()
+
+		_, endsAt, err = scan.Scan(data[endsAt:])
+		require.NoError(t, err)
+		require.Equal(t, len(request), endsAt)
+	})
+}
+
+func TestStrictScanner(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		request string
+		err     error
+	}{
+		{
+			name:    "content-length with transfer-encoding",
+			request: "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\nTransfer-Encoding: chunked\r\n\r\n",
+			err:     ErrConflictingLength,
+		},
+		{
+			name:    "differing content-length",
+			request: "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\nContent-Length: 6\r\n\r\n",
+			err:     ErrContentLengthMismatch,
+		},
+		{
+			name:    "obs-fold",
+			request: "GET / HTTP/1.1\r\nHost: a\r\nX-Folded: a\r\n b\r\n\r\n",
+			err:     ErrObsFold,
+		},
+		{
+			name:    "whitespace before colon",
+			request: "GET / HTTP/1.1\r\nHost : a\r\n\r\n",
+			err:     ErrSpaceBeforeColon,
+		},
+		{
+			name:    "bare lf in request line",
+			request: "GET / HTTP/1.1\nHost: a\r\n\r\n",
+			err:     ErrBareLF,
+		},
+		{
+			name:    "bare lf in header",
+			request: "GET / HTTP/1.1\r\nHost: a\r\nAccept: */*\n\r\n",
+			err:     ErrBareLF,
+		},
+		{
+			name:    "multiple hosts",
+			request: "GET / HTTP/1.1\r\nHost: a\r\nHost: b\r\n\r\n",
+			err:     ErrBadRequest,
+		},
+		{
+			name: "bad chunk extension",
+			request: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n" +
+				"5;=bad\r\nHello\r\n0\r\n\r\n",
+			err: ErrBadChunkExtension,
+		},
+		{
+			name: "bare lf after chunk",
+			request: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n" +
+				"5\r\nHello\n0\r\n\r\n",
+			err: ErrBareLF,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, err := NewStrictScanner().Scan([]byte(tc.request))
+			require.ErrorIs(t, err, tc.err)
+		})
+	}
+
+	t.Run("valid request byte by byte", func(t *testing.T) {
+		request := "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 5\r\nContent-Length:  5 \r\n" +
+			"Accept: */*\r\n\r\nHello"
+		scan := NewStrictScanner()
+		for i := 0; i < len(request)-1; i++ {
+			_, endsAt, err := scan.Scan([]byte{request[i]})
+			require.NoError(t, err)
+			require.Equal(t, -1, endsAt)
+		}
+
+		host, endsAt, err := scan.Scan([]byte{request[len(request)-1]})
+		require.NoError(t, err)
+		require.Equal(t, "example.com", host)
+		require.Equal(t, 1, endsAt)
+	})
+
+	t.Run("chunk extensions", func(t *testing.T) {
+		request := "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n" +
+			"5 ; name=value;quoted=\"a \\\" b\"\r\nHello\r\n0;last\r\n\r\nrest"
+		_, endsAt, err := NewStrictScanner().Scan([]byte(request))
+		require.NoError(t, err)
+		require.Equal(t, "rest", request[endsAt:])
+	})
+}
+
+func TestChunkedTrailers(t *testing.T) {
+	const head = "POST / HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\n"
+
+	t.Run("trailers", func(t *testing.T) {
+		request := head + "5;ext=value\r\nHello\r\n0\r\nGrpc-Status: 0\r\nGrpc-Message: OK\r\n\r\nrest"
+		_, endsAt, err := NewScanner().Scan([]byte(request))
+		require.NoError(t, err)
+		require.Equal(t, "rest", request[endsAt:])
+	})
+
+	t.Run("trailers byte by byte", func(t *testing.T) {
+		request := head + "5\r\nHello\r\n0\r\nGrpc-Status: 0\r\nGrpc-Message: OK\r\n\r\n"
+		for _, scan := range []*Scanner{NewScanner(), NewStrictScanner()} {
+			for i := 0; i < len(request)-1; i++ {
+				_, endsAt, err := scan.Scan([]byte{request[i]})
+				require.NoError(t, err)
+				require.Equal(t, -1, endsAt, "ended too early at %d", i)
+			}
+
+			_, endsAt, err := scan.Scan([]byte{request[len(request)-1]})
+			require.NoError(t, err)
+			require.Equal(t, 1, endsAt)
+		}
+	})
+
+	t.Run("too long extensions", func(t *testing.T) {
+		request := head + "5;ext=" + strings.Repeat("a", maxChunkExtensionsLen) + "\r\nHello\r\n0\r\n\r\n"
+		_, _, err := NewScanner().Scan([]byte(request))
+		require.ErrorIs(t, err, ErrChunkExtensionsTooLong)
+	})
+
+	t.Run("too long trailers", func(t *testing.T) {
+		request := head + "0\r\n" + strings.Repeat("X-Trailer: value\r\n", maxTrailersLen/10) + "\r\n"
+		_, _, err := NewScanner().Scan([]byte(request))
+		require.ErrorIs(t, err, ErrTrailersTooLong)
+	})
+}
+
+func TestFindHeader(t *testing.T) {
+	head := []byte("GET / HTTP/1.1\r\nHost: example.com\r\nX-User:  42 \r\n\r\nX-Body: 1\r\n")
+
+	value, found := FindHeader(head, "x-user")
+	require.True(t, found)
+	require.Equal(t, "42", string(value))
+
+	_, found = FindHeader(head, "X-Body")
+	require.False(t, found)
+
+	_, found = FindHeader(head[:len("GET / HTTP/1.1\r\nHost: example.com\r\nX-Us")], "X-User")
+	require.False(t, found)
+}
+
+func TestHeaderLines(t *testing.T) {
+	collect := func(head string) (lines []string) {
+		it := NewHeaderLines([]byte(head))
+		for line, ok := it.Next(); ok; line, ok = it.Next() {
+			require.Equal(t, string(line.Name)+":"+string(line.Value), strings.TrimRight(head[line.Start:line.End], "\r\n"))
+			lines = append(lines, string(line.Name)+"="+string(line.Value))
+		}
+
+		return lines
+	}
+
+	require.Equal(t,
+		[]string{"Host= example.com", "X-Folded= a\r\n b\r\n\tc", "X-Bare= lf"},
+		collect("GET / HTTP/1.1\r\nHost: example.com\r\nno colon\r\nX-Folded: a\r\n b\r\n\tc\r\nX-Bare: lf\n\r\nX-Body: 1\r\n"),
+	)
+	// continuation lines without a preceding field are skipped along with it
+	require.Equal(t, []string{"Host= example.com"}, collect("GET / HTTP/1.1\r\n X-Fold: 1\r\nHost: example.com\r\n\r\n"))
+	// the last line isn't complete until LF, and the last field until the next line starts
+	require.Equal(t, []string{"Host= example.com"}, collect("GET / HTTP/1.1\r\nHost: example.com\r\nX-User: 42"))
+	require.Equal(t, []string{"Host= example.com"}, collect("GET / HTTP/1.1\r\nHost: example.com\r\nX-User: 4\r\n 2"))
+	require.Empty(t, collect("GET / HTTP/1.1"))
+}
+
+func TestSetHost(t *testing.T) {
+	request := []byte("GET http://a.com/ HTTP/1.1\r\nhost: b.com\r\nAccept: */*\r\nHOST: c.com\r\n\r\nbody")
+	headersEnd := bytes.Index(request, []byte("\r\n\r\n")) + 2
+
+	rewritten, end := SetHost(nil, request, headersEnd, "a.com")
+	require.Equal(t, "GET http://a.com/ HTTP/1.1\r\nHost: a.com\r\nAccept: */*\r\n\r\nbody", string(rewritten))
+	require.Equal(t, "\r\nbody", string(rewritten[end:]))
+
+	request = []byte("GET http://a.com/ HTTP/1.1\r\n\r\n")
+	rewritten, end = SetHost(nil, request, len(request)-2, "a.com")
+	require.Equal(t, "GET http://a.com/ HTTP/1.1\r\nHost: a.com\r\n\r\n", string(rewritten))
+	require.Equal(t, len(rewritten)-2, end)
+}
+
+func TestHeadersEnd(t *testing.T) {
+	const head = "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 5\r\n"
+	request := head + "\r\nHello"
+
+	t.Run("all at once", func(t *testing.T) {
+		scan := NewScanner()
+		_, endsAt, err := scan.Scan([]byte(request))
+		require.NoError(t, err)
+		require.Equal(t, len(request), endsAt)
+		require.Equal(t, len(head), scan.HeadersEnd())
+
+		scan.Release()
+		require.Equal(t, -1, scan.HeadersEnd())
+	})
+
+	t.Run("byte by byte", func(t *testing.T) {
+		scan := NewScanner()
+		for i := 0; i < len(request); i++ {
+			_, _, err := scan.Scan([]byte{request[i]})
+			require.NoError(t, err)
+
+			if i <= len(head) {
+				require.Equal(t, -1, scan.HeadersEnd(), i)
+			} else {
+				require.Equal(t, len(head), scan.HeadersEnd(), i)
+			}
+		}
+	})
+}
+
+func TestUpgrade(t *testing.T) {
+	const request = "GET /chat HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n"
+
+	for _, scan := range []*Scanner{NewScanner(), NewStrictScanner()} {
+		_, endsAt, err := scan.Scan([]byte(request))
+		require.NoError(t, err)
+		require.Equal(t, len(request), endsAt)
+		require.True(t, scan.Upgrade())
+
+		scan.Release()
+		require.False(t, scan.Upgrade())
+
+		for i := 0; i < len(request); i++ {
+			_, _, err = scan.Scan([]byte{request[i]})
+			require.NoError(t, err)
+		}
+
+		require.True(t, scan.Upgrade())
+		scan.Release()
+
+		_, _, err = scan.Scan([]byte("GET / HTTP/1.1\r\nHost: example.com\r\nUpgrade-Insecure-Requests: 1\r\n\r\n"))
+		require.NoError(t, err)
+		require.False(t, scan.Upgrade())
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		request   string
+		keepAlive bool
+	}{
+		{"http/1.1", "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", true},
+		{"http/1.1 close", "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: Close\r\n\r\n", false},
+		{"close among options", "GET / HTTP/1.1\r\nConnection: te\r\nHost: example.com\r\nconnection: x, close \r\n\r\n", false},
+		{"http/1.0", "GET / HTTP/1.0\r\nHost: example.com\r\n\r\n", false},
+		{"http/1.0 keep-alive", "GET / HTTP/1.0\r\nHost: example.com\r\nConnection: keep-alive\r\n\r\n", true},
+		{"http/1.0 keep-alive and close", "GET / HTTP/1.0\r\nHost: example.com\r\nConnection: keep-alive, close\r\n\r\n", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, scan := range []*Scanner{NewScanner(), NewStrictScanner()} {
+				_, endsAt, err := scan.Scan([]byte(tc.request))
+				require.NoError(t, err)
+				require.Equal(t, len(tc.request), endsAt)
+				require.Equal(t, tc.keepAlive, scan.KeepAlive())
+				scan.Release()
+
+				for i := 0; i < len(tc.request); i++ {
+					_, _, err = scan.Scan([]byte{tc.request[i]})
+					require.NoError(t, err)
+				}
+
+				require.Equal(t, tc.keepAlive, scan.KeepAlive())
+				scan.Release()
+			}
+		})
+	}
+
+	_, _, err := NewScanner().Scan([]byte("GET / HTTP/1.1\r\nHost: example.com\r\nConnection: " + strings.Repeat("a,", 200) + "\r\n\r\n"))
+	require.ErrorIs(t, err, ErrTooLong)
+}
+
+func TestRequestTarget(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		request string
+		host    string
+		connect bool
+		// absolute is set when the host is taken from the absolute-form target
+		absolute bool
+	}{
+		{"origin-form", "GET /path HTTP/1.1\r\nHost: example.com\r\n\r\n", "example.com", false, false},
+		{"absolute-form", "GET http://api.example.com/path HTTP/1.1\r\nHost: other.com\r\n\r\n", "api.example.com", false, true},
+		{"absolute-form with port", "GET HTTPS://api.example.com:8443?q HTTP/1.1\r\n\r\n", "api.example.com:8443", false, true},
+		{"absolute-form without path", "OPTIONS http://example.com HTTP/1.1\r\n\r\n", "example.com", false, true},
+		{"other scheme", "GET ftp://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n", "example.com", false, false},
+		{"connect", "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n", "example.com:443", true, false},
+		{"long path", "GET /" + strings.Repeat("a", 4096) + " HTTP/1.1\r\nHost: example.com\r\n\r\n", "example.com", false, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, scan := range []*Scanner{NewScanner(), NewStrictScanner()} {
+				host, endsAt, err := scan.Scan([]byte(tc.request))
+				require.NoError(t, err)
+				require.Equal(t, len(tc.request), endsAt)
+				require.Equal(t, tc.host, host)
+				require.Equal(t, tc.connect, scan.Connect())
+				if tc.absolute {
+					require.Equal(t, tc.host, scan.TargetHost())
+				} else {
+					require.Empty(t, scan.TargetHost())
+				}
+
+				scan.Release()
+
+				for i := 0; i < len(tc.request); i++ {
+					host, endsAt, err = scan.Scan([]byte{tc.request[i]})
+					require.NoError(t, err)
+				}
+
+				require.Equal(t, 1, endsAt)
+				require.Equal(t, tc.host, host)
+				require.Equal(t, tc.connect, scan.Connect())
+				scan.Release()
+				require.False(t, scan.Connect())
+			}
+		})
+	}
+
+	t.Run("request line", func(t *testing.T) {
+		request := "DELETE /api/users?id=1 HTTP/1.1\r\nHost: example.com\r\n\r\n"
+		scan := NewScanner()
+		for i := 0; i < len(request); i++ {
+			_, _, err := scan.Scan([]byte{request[i]})
+			require.NoError(t, err)
+		}
+
+		line := scan.Request()
+		require.Equal(t, "DELETE", string(line.Method))
+		require.Equal(t, "/api/users?id=1", string(line.Target))
+		require.Equal(t, "HTTP/1.1", string(line.Version))
+		require.Equal(t, "/api/users", string(line.Path()))
+
+		scan.Release()
+		require.Empty(t, scan.Request().Method)
+	})
+
+	t.Run("too long request line", func(t *testing.T) {
+		request := "GET /" + strings.Repeat("a", maxRequestLineLen) + " HTTP/1.1\r\n\r\n"
+		_, _, err := NewScanner().Scan([]byte(request))
+		require.ErrorIs(t, err, ErrURITooLong)
+	})
+
+	t.Run("too long authority", func(t *testing.T) {
+		request := "GET http://" + strings.Repeat("a", 5000) + ".com/ HTTP/1.1\r\n\r\n"
+		_, _, err := NewScanner().Scan([]byte(request))
+		require.ErrorIs(t, err, ErrTooLong)
+	})
 }
@@ -9,6 +9,9 @@ const (
 	eHostValue
 	eContentLengthValue
 	eContentLengthValueCR
+	eTransferEncodingValue
+	eConnectionValue
+	eOtherHeaderKey
 	eOtherHeaderValue
 	eBody
 )
@@ -17,6 +20,29 @@ type chunkedState int
 
 const (
 	eChunkLength chunkedState = iota
+	eChunkLengthCR
+	eChunkExtensionStart
+	eChunkExtensionNameStart
+	eChunkExtensionName
+	eChunkExtensionAfterName
+	eChunkExtensionValueStart
+	eChunkExtensionToken
+	eChunkExtensionQuoted
+	eChunkExtensionQuotedPair
+	eChunkExtensionAfterValue
 	eChunkBody
-	eLastChunk
+	eChunkBodyEnd
+	eChunkBodyCR
+	eTrailers
+)
+
+type responseState int
+
+const (
+	eStatusLine responseState = iota
+	eResponseHeaderKey
+	eResponseHeaderKeyCR
+	eResponseKnownHeaderValue
+	eResponseOtherHeaderValue
+	eResponseBody
 )
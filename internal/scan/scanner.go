@@ -1,6 +1,71 @@
 package scan
 
+import (
+	"bytes"
+)
+
+var (
+	rootPath        = []byte("/")
+	schemeDelimiter = []byte("://")
+)
+
 type Scanner interface {
 	Scan(data []byte) (to string, endsAt int, err error)
 	Release()
 }
+
+// Request is the parsed request line:
+//
+//	request-line = method SP request-target SP HTTP-version
+type Request struct {
+	Method  []byte
+	Target  []byte
+	Version []byte
+}
+
+// Path returns the path of the request target without the query. Absolute-form targets
+// are stripped of the scheme and the authority. Authority-form and asterisk-form targets
+// have no path
+func (r Request) Path() []byte {
+	start, end := r.PathBounds()
+	switch {
+	case start == -1:
+		return nil
+	case start == end:
+		return rootPath
+	}
+
+	return r.Target[start:end]
+}
+
+// PathBounds returns the position of the path in the request target. Absolute-form targets
+// without the path have the empty one right after the authority. In case of authority-form
+// and asterisk-form targets, -1 is returned
+func (r Request) PathBounds() (start, end int) {
+	target := r.Target
+	if len(target) == 0 {
+		return -1, -1
+	}
+
+	if target[0] != '/' {
+		delimiter := bytes.Index(target, schemeDelimiter)
+		if delimiter == -1 {
+			return -1, -1
+		}
+
+		start = delimiter + len(schemeDelimiter)
+		pathStart := bytes.IndexAny(target[start:], "/?#")
+		if pathStart == -1 {
+			return len(target), len(target)
+		}
+
+		start += pathStart
+	}
+
+	end = len(target)
+	if queryStart := bytes.IndexAny(target[start:], "?#"); queryStart != -1 {
+		end = start + queryStart
+	}
+
+	return start, end
+}
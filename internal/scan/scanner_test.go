@@ -0,0 +1,36 @@
+package scan
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestPath(t *testing.T) {
+	for target, path := range map[string]string{
+		"/api/users?id=1":              "/api/users",
+		"/api/users#top":               "/api/users",
+		"/":                            "/",
+		"http://example.com/api?q":     "/api",
+		"https://example.com:8443":     "/",
+		"http://example.com?q":         "/",
+		"example.com:443":              "",
+		"*":                            "",
+		"":                             "",
+		"HTTP://example.com/static/a/": "/static/a/",
+	} {
+		require.Equal(t, path, string(Request{Target: []byte(target)}.Path()), target)
+	}
+}
+
+func TestPathBounds(t *testing.T) {
+	for target, bounds := range map[string][2]int{
+		"/api?q":                 {0, 4},
+		"http://example.com/api": {18, 22},
+		"http://example.com?q":   {18, 18},
+		"http://example.com":     {18, 18},
+		"example.com:443":        {-1, -1},
+	} {
+		start, end := Request{Target: []byte(target)}.PathBounds()
+		require.Equal(t, bounds, [2]int{start, end}, target)
+	}
+}
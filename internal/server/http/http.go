@@ -1,49 +1,178 @@
 package http
 
 import (
+	"at/internal/balance"
 	"at/internal/connect"
-	"at/internal/scan"
+	"at/internal/forwarded"
+	"at/internal/pages"
+	"at/internal/proxyproto"
+	"at/internal/ratelimit"
+	"at/internal/respond"
+	"at/internal/route"
+	"at/internal/scan/http1"
 	"at/internal/server/tcp"
+	"at/internal/tunnel"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"github.com/indigo-web/utils/arena"
-	"strings"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxPipelined limits the number of requests, which responses are still awaited
+const maxPipelined = 64
+
+var (
+	errResponderExited      = errors.New("responses can't be delivered anymore")
+	errConnectDisabled      = errors.New("CONNECT is disabled")
+	errForbiddenDestination = errors.New("destination is not allowed")
+
+	headMethod            = []byte("HEAD ")
+	connectionEstablished = []byte("HTTP/1.1 200 Connection Established\r\n\r\n")
+
+	// rate limit keys are prefixed by their kind
+	headerKeyPrefix = []byte("h:")
+	ipKeyPrefix     = []byte("ip:")
 )
 
 type Server struct {
-	client    tcp.Client
-	scanner   scan.Scanner
-	connector *connect.Connector
-	buffer    *arena.Arena[byte]
+	client  tcp.Client
+	scanner *http1.Scanner
+	routes  *route.Routes
+	pool    *connect.Pool
+	// newUpstream wraps new connections to upstreams
+	newUpstream func(conn net.Conn) tcp.Client
+	buffer      *arena.Arena[byte]
+	// pages render error responses
+	pages     *pages.Pages
+	responses *http1.ResponseScanner
+	// secure is set when the client is connected over TLS
+	secure bool
+	// injector adds forwarding headers to requests. It's nil if they're disabled
+	injector   *forwarded.Injector
+	clientAddr netip.Addr
+	// rewritten holds requests, rewritten by rules of the route, and target holds their
+	// request targets. Both are reused between requests
+	rewritten []byte
+	target    []byte
+	// retargeted holds requests with absolute-form targets, which Host header is replaced
+	retargeted []byte
+	// origin describes the client connection to upstreams, that want PROXY protocol. Encoded
+	// headers are cached by version
+	origin   proxyproto.Header
+	prefaces [proxyproto.V2 + 1][]byte
+	// allowlist limits destinations of CONNECT tunnels. It's nil if CONNECT is disabled
+	allowlist *tunnel.Allowlist
+	// limit is the rate limit of requests of the listener, applied on top of limits of routes.
+	// It's nil if there's none
+	limit *ratelimit.Rule
+	// key is either the rate limit or the balancing key of the current request, reused
+	// between requests
+	key []byte
+	// idle is the timeout of tunnels, either CONNECT or upgraded connections
+	idle time.Duration
+	// pending is the queue of requests, which responses are awaited. Responses are relayed
+	// to the client strictly in the order of requests
+	pending chan pending
+	// responded is closed as soon as the responder exits
+	responded chan struct{}
+	// relaying is the exchange, which response is being relayed at the moment. Once aborted,
+	// it's interrupted and no more responses are relayed
+	relayMu  sync.Mutex
+	relaying *exchange
+	aborted  bool
+	// state is one of eBusy, eIdle or eClosing. Idle server waits for the next request,
+	// so it can be interrupted on shutdown without breaking anything
+	state atomic.Int32
 }
 
 func New(
-	client tcp.Client, scanner scan.Scanner, connector *connect.Connector, buffer *arena.Arena[byte],
+	client tcp.Client, scanner *http1.Scanner, routes *route.Routes, pool *connect.Pool,
+	newUpstream func(conn net.Conn) tcp.Client, buffer *arena.Arena[byte], pages *pages.Pages,
+	secure bool, injector *forwarded.Injector, origin proxyproto.Header, allowlist *tunnel.Allowlist,
+	limit *ratelimit.Rule, idle time.Duration,
 ) *Server {
+	var clientAddr netip.Addr
+	if addr, ok := client.RemoteAddr().(*net.TCPAddr); ok {
+		clientAddr = addr.AddrPort().Addr().Unmap()
+	}
+
 	return &Server{
-		client:    client,
-		scanner:   scanner,
-		connector: connector,
-		buffer:    buffer,
+		client:      client,
+		scanner:     scanner,
+		routes:      routes,
+		pool:        pool,
+		newUpstream: newUpstream,
+		buffer:      buffer,
+		pages:       pages,
+		secure:      secure,
+		injector:    injector,
+		clientAddr:  clientAddr,
+		origin:      origin,
+		allowlist:   allowlist,
+		limit:       limit,
+		idle:        idle,
+		responses:   http1.NewResponseScanner(),
+		pending:     make(chan pending, maxPipelined),
+		responded:   make(chan struct{}),
 	}
 }
 
-func (s *Server) Serve() {
-	defer func() {
-		_ = s.client.Close()
-		s.connector.Close()
-	}()
+// Serve forwards client's requests until the connection is closed or the context is
+// cancelled. In the latter case, the server stops at the next request boundary and waits
+// at most drain for responses in flight
+func (s *Server) Serve(ctx context.Context, drain time.Duration) {
+	stop := make(chan struct{})
+	go s.watch(ctx, stop)
+	go s.respond()
+
+	finish := s.serve()
+	close(stop)
+	close(s.pending)
+
+	if finish {
+		s.wait(drain)
+	}
+
+	s.abort()
+	_ = s.client.Close()
+	// the responder must return all the upstream connections before the server exits
+	<-s.responded
+}
 
-	var forwardTo string
+// serve processes requests. Returned finish flag tells, whether responses in flight must
+// be waited for. It's set also when the client is going to be responded with an error
+func (s *Server) serve() (finish bool) {
+	var (
+		forwardTo *exchange
+		// boundary is set when there's no pending request
+		boundary = true
+	)
 
 amass:
 	for {
+		if boundary && !s.state.CompareAndSwap(eBusy, eIdle) {
+			return true
+		}
+
 		data, err := s.client.Read()
+		if boundary && !s.state.CompareAndSwap(eIdle, eBusy) {
+			return true
+		}
+
 		if err != nil {
-			return
+			return false
 		}
 
 		host, endsAt, err := s.scanner.Scan(data)
 		if err != nil {
-			return
+			return s.reject(requestErrorStatus(err), err)
 		}
 
 		// basically, there are three options now:
@@ -51,29 +180,118 @@ amass:
 		// 1) we received the whole request all at once
 		if endsAt != -1 {
 			if !s.buffer.Append(data[:endsAt]...) {
-				return
+				return s.reject(s.tooLargeStatus(data[:endsAt]), errRequestTooLarge)
 			}
 
 			s.client.Unread(data[endsAt:])
-			if err = s.send(host, s.buffer.Finish()); err != nil {
-				return
+			request := s.buffer.Finish()
+			keepAlive := s.scanner.KeepAlive()
+			if s.scanner.Connect() {
+				if s.allow(nil, request, !keepAlive) {
+					return s.connect(host)
+				}
+
+				if !s.skip(keepAlive) {
+					return false
+				}
+
+				boundary = true
+				continue
 			}
 
+			upstream, name, ok := s.route(host)
+			if !ok {
+				return true
+			}
+
+			if !s.allow(upstream, request, !keepAlive) {
+				if !s.skip(keepAlive) {
+					return false
+				}
+
+				boundary = true
+				continue
+			}
+
+			if responder := s.responder(upstream); responder != nil {
+				response := responder.Response(name, s.scanner.Request(), !keepAlive)
+				if err = s.enqueue(pending{response: response}); err != nil {
+					return true
+				}
+
+				if !s.skip(keepAlive) {
+					return false
+				}
+
+				boundary = true
+				continue
+			}
+
+			if forwardTo, err = s.send(upstream, host, request); err != nil {
+				return true
+			}
+
+			s.done(forwardTo, true)
+
+			upgrade := s.scanner.Upgrade()
 			s.buffer.Clear()
+			s.scanner.Release()
+			if upgrade && !s.upgrade() {
+				return false
+			}
+
+			if !keepAlive {
+				return s.last()
+			}
+
+			boundary = true
 			continue
 		}
 
-		// 2) we finally received Host header value, but not the whole request yet
-		if len(host) > 0 {
-			forwardTo = host
-			goto transit
+		// 2) we finally received Host header value, but not the whole request yet. So flush
+		// everything we've got so far and forward the rest as it comes. Forwarding headers,
+		// header rules and rate limits need the header section, so in this case it must be
+		// received, too. CONNECT requests aren't forwarded at all, so they're always amassed
+		// completely. Requests, that are responded by the forwarder itself, are responded as
+		// soon as the header section is received. Their bodies aren't read, so the client is
+		// disconnected afterwards
+		if len(host) > 0 && !s.scanner.Connect() {
+			upstream, name, ok := s.route(host)
+			if !ok {
+				return true
+			}
+
+			responder := s.responder(upstream)
+			if s.scanner.HeadersEnd() != -1 || (responder == nil && s.streams(upstream)) {
+				if !s.buffer.Append(data...) {
+					return s.reject(s.tooLargeStatus(data), errRequestTooLarge)
+				}
+
+				request := s.buffer.Finish()
+				if !s.allow(upstream, request, true) {
+					return true
+				}
+
+				if responder != nil {
+					_ = s.enqueue(pending{response: responder.Response(name, s.scanner.Request(), true)})
+					return true
+				}
+
+				if forwardTo, err = s.send(upstream, host, request); err != nil {
+					return true
+				}
+
+				s.buffer.Clear()
+				goto transit
+			}
 		}
 
-		// 3) no whole request, no Host, no fun. Just save it and keep going
+		// 3) no whole request, no Host (or the header section isn't complete yet), no fun.
+		// Just save it and keep going
+		boundary = false
 		if !s.buffer.Append(data...) {
-			// in case client exceeds forwarder's buffer size, just drop the connection.
-			// There's nothing else we can do in this situation
-			return
+			// in case client exceeds forwarder's buffer size, there's nothing else we can do
+			return s.reject(s.tooLargeStatus(data), errRequestTooLarge)
 		}
 	}
 
@@ -81,63 +299,390 @@ transit:
 	for {
 		data, err := s.client.Read()
 		if err != nil {
-			return
+			s.done(forwardTo, false)
+			return false
 		}
 
 		_, endsAt, err := s.scanner.Scan(data)
 		if err != nil {
-			return
+			s.fail(forwardTo, requestErrorStatus(err), err)
+			return true
 		}
 
 		if endsAt != -1 {
-			if !s.drain(forwardTo, data, endsAt) {
-				return
+			if err = s.drain(forwardTo, data, endsAt); err != nil {
+				s.fail(forwardTo, upstreamErrorStatus(err), err)
+				return true
+			}
+
+			s.done(forwardTo, true)
+			upgrade, keepAlive := s.scanner.Upgrade(), s.scanner.KeepAlive()
+			s.scanner.Release()
+			if upgrade && !s.upgrade() {
+				return false
 			}
 
+			if !keepAlive {
+				return s.last()
+			}
+
+			boundary = true
 			goto amass
 		}
 
-		err = s.send(forwardTo, data)
-		if err != nil {
-			return
+		if err = forwardTo.conn.Write(data); err != nil {
+			s.fail(forwardTo, upstreamErrorStatus(err), err)
+			return true
 		}
 	}
 }
 
-func (s *Server) drain(to string, data []byte, endsAt int) (ok bool) {
+func (s *Server) drain(to *exchange, data []byte, endsAt int) error {
 	piece, leftData := data[:endsAt], data[endsAt:]
 	s.client.Unread(leftData)
-	err := s.send(to, piece)
 
-	return err == nil
+	return to.conn.Write(piece)
 }
 
-func (s *Server) send(to string, data []byte) (err error) {
-	to = stripWWW(to)
-	host := s.connector.Get(to)
-	if host == nil {
-		host, err = s.connector.Connect(to)
-		if err != nil {
-			return err
+// upgrade waits for the response to the request, that asks to switch protocols, as nothing
+// the client sends afterwards can be scanned until it's known. In case the upstream agrees,
+// the connection turns into a tunnel, and false is returned once it's closed. Otherwise,
+// requests are served further
+func (s *Server) upgrade() (proceed bool) {
+	e, ok := s.await()
+	if !ok || e == nil {
+		return ok
+	}
+
+	_ = tunnel.Pipe(s.client, e.conn, s.idle)
+	s.done(e, false)
+
+	return false
+}
+
+// connect opens the tunnel to the destination, if it's allowed. Pending responses are
+// delivered before the tunnel is established. The client must be disconnected afterwards
+func (s *Server) connect(dst string) (finish bool) {
+	if s.allowlist == nil {
+		return s.reject(http.StatusMethodNotAllowed, errConnectDisabled)
+	}
+
+	if !s.allowlist.Allowed(dst) {
+		return s.reject(http.StatusForbidden, fmt.Errorf("%w: %s", errForbiddenDestination, dst))
+	}
+
+	// destinations are arbitrary, so they're dialed bypassing the pool, that keeps the state
+	// of every host. Still, unresponsive ones are given up as soon as backends are
+	netConn, err := net.DialTimeout("tcp", dst, s.pool.ConnectTimeout())
+	if err != nil {
+		return s.reject(upstreamErrorStatus(err), err)
+	}
+
+	conn := s.newUpstream(netConn)
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	if s.enqueue(pending{response: connectionEstablished}) != nil {
+		return false
+	}
+
+	if _, ok := s.await(); ok {
+		_ = tunnel.Pipe(s.client, conn, s.idle)
+	}
+
+	return false
+}
+
+// skip drops the request, that is completely received, but responded by the forwarder itself
+// instead of being forwarded. In case it doesn't keep the connection alive, responses in
+// flight are waited for, and false is returned, so the client must be disconnected
+func (s *Server) skip(keepAlive bool) (proceed bool) {
+	s.buffer.Clear()
+	s.scanner.Release()
+	if !keepAlive {
+		return s.last()
+	}
+
+	return true
+}
+
+// last waits for responses to all the requests so far, as the last one doesn't keep the
+// connection alive. RFC 9112, 9.6: requests, that follow it, are never read. The client must
+// be disconnected afterwards
+func (s *Server) last() (finish bool) {
+	if switched, _ := s.await(); switched != nil {
+		// the upstream has switched protocols, though the request didn't ask to
+		s.done(switched, false)
+	}
+
+	return false
+}
+
+// await waits until responses to all the requests so far are delivered. In case the upstream
+// of the last one has switched protocols, its exchange is returned and must be done after use.
+// False is returned in case any of the responses has failed
+func (s *Server) await() (switched *exchange, ok bool) {
+	result := make(chan *exchange, 1)
+	if s.enqueue(pending{await: result}) != nil {
+		return nil, false
+	}
+
+	select {
+	case switched, ok = <-result:
+		return switched, ok
+	case <-s.responded:
+		return nil, false
+	}
+}
+
+// watch marks the server as closing as soon as the context is cancelled. In case it's idle at
+// the moment, the pending read is interrupted
+func (s *Server) watch(ctx context.Context, stop <-chan struct{}) {
+	select {
+	case <-ctx.Done():
+		if s.state.Swap(eClosing) == eIdle {
+			s.client.Interrupt()
 		}
+	case <-stop:
+	}
+}
 
-		go func() {
-			for {
-				data, err := host.Read()
-				if err != nil {
-					return
-				}
+// wait waits for responses in flight. Zero drain means waiting forever
+func (s *Server) wait(drain time.Duration) {
+	if drain <= 0 {
+		<-s.responded
+		return
+	}
 
-				if err := s.client.Write(data); err != nil {
-					return
-				}
-			}
-		}()
+	timer := time.NewTimer(drain)
+	defer timer.Stop()
+
+	select {
+	case <-s.responded:
+	case <-timer.C:
+	}
+}
+
+// route looks up the upstream for the request to the host. Its canonical name is returned,
+// too. In case there's no upstream, the client is responded with an error and must be
+// disconnected
+func (s *Server) route(host string) (upstream *route.Upstream, name string, ok bool) {
+	name, port, err := route.Canonical(host)
+	if err != nil {
+		s.reject(http.StatusBadRequest, fmt.Errorf("%w: %s", err, host))
+		return nil, "", false
+	}
+
+	table := s.routes.Table()
+	upstream, ok = table.Match(name, port, s.scanner.Request())
+	if !ok {
+		s.reject(table.UnknownHostStatus(), fmt.Errorf("%w: %s", errUnknownHost, host))
 	}
 
-	return host.Write(data)
+	return upstream, name, ok
 }
 
-func stripWWW(domain string) string {
-	return strings.TrimPrefix(domain, "www.")
+// streams reports whether the request to the upstream can be forwarded before its header
+// section is received completely. The Host header of absolute-form targets is replaced, so
+// such requests are never streamed
+func (s *Server) streams(to *route.Upstream) bool {
+	return s.injector == nil && s.limit == nil && to.Headers == nil && to.RateLimit == nil &&
+		len(s.scanner.TargetHost()) == 0
+}
+
+// allow takes tokens of the request from rate limits of the listener and of the upstream, if
+// it's not nil. In case either is exhausted, the client is responded with 429 instead, which
+// closes the connection, if closing is set
+func (s *Server) allow(to *route.Upstream, request []byte, closing bool) bool {
+	rules := [2]*ratelimit.Rule{s.limit}
+	if to != nil {
+		rules[1] = to.RateLimit
+	}
+
+	for _, rule := range rules {
+		if rule == nil {
+			continue
+		}
+
+		if retryAfter, ok := rule.Allow(s.limitKey(rule, request)); !ok {
+			_ = s.throttle(retryAfter, closing)
+			return false
+		}
+	}
+
+	return true
+}
+
+// limitKey returns the key of the client for the rule. It's either the header value or, in
+// case it's not set, the client IP. Keys are prefixed by their kind, so no header value can
+// take tokens from the bucket of some IP
+func (s *Server) limitKey(rule *ratelimit.Rule, request []byte) []byte {
+	if header := rule.Header(); len(header) > 0 {
+		if value, found := http1.FindHeader(request, header); found {
+			s.key = append(append(s.key[:0], headerKeyPrefix...), value...)
+			return s.key
+		}
+	}
+
+	ip := s.clientAddr.As16()
+	s.key = append(append(s.key[:0], ipKeyPrefix...), ip[:]...)
+
+	return s.key
+}
+
+// responder returns the responder of requests to the upstream, in case they're responded by
+// the forwarder itself. Otherwise, nil
+func (s *Server) responder(to *route.Upstream) respond.Responder {
+	if to.HTTPSOnly && !s.secure {
+		return respond.HTTPS
+	}
+
+	return to.Respond
+}
+
+// send forwards the beginning of the request, which must include at least the request line,
+// and enqueues its response. The exchange is returned, so the rest of the request can be
+// forwarded directly. It must be marked as forwarded afterwards. In case of error, the client
+// is already going to be responded with an error and must be disconnected
+func (s *Server) send(to *route.Upstream, host string, request []byte) (*exchange, error) {
+	conn, backend, err := s.get(to, request)
+	if err != nil {
+		s.reject(upstreamErrorStatus(err), err)
+		return nil, err
+	}
+
+	backend.Acquire()
+	e := newExchange(conn, backend)
+	err = s.enqueue(pending{
+		exchange: e,
+		head:     bytes.HasPrefix(request, headMethod),
+	})
+	if err != nil {
+		backend.Release()
+		s.pool.Discard(conn)
+		return nil, err
+	}
+
+	request, headersEnd := s.rewrite(to, request)
+	if s.injector != nil {
+		err = conn.Writev(s.injector.Apply(request, headersEnd, s.clientAddr, host))
+	} else {
+		err = conn.Write(request)
+	}
+
+	if err != nil {
+		s.fail(e, upstreamErrorStatus(err), err)
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// rewrite applies rewriting rules of the upstream to the request and returns it with the end
+// of its header section. The request is copied only in case any rule touches it, or its
+// target is absolute-form
+func (s *Server) rewrite(to *route.Upstream, request []byte) ([]byte, int) {
+	var (
+		headersEnd                    = s.scanner.HeadersEnd()
+		rewritesPath, rewritesHeaders bool
+	)
+
+	if host := s.scanner.TargetHost(); len(host) > 0 {
+		// RFC 9112, 3.2.2: the request is routed by the target, so the upstream must see
+		// the same host in the Host header
+		s.retargeted, headersEnd = http1.SetHost(s.retargeted[:0], request, headersEnd, host)
+		request = s.retargeted
+	}
+
+	if to.Path != nil {
+		s.target, rewritesPath = to.Path.Rewrite(s.target[:0], s.scanner.Request())
+	}
+
+	rewritesHeaders = to.Headers != nil && to.Headers.Touches(request, headersEnd)
+	if !rewritesPath && !rewritesHeaders {
+		return request, headersEnd
+	}
+
+	// the request starts with the request line, where the target follows the method
+	lineEnd := bytes.IndexByte(request, '\n') + 1
+	s.rewritten = s.rewritten[:0]
+	if rewritesPath {
+		line := s.scanner.Request()
+		targetStart := len(line.Method) + 1
+		s.rewritten = append(s.rewritten, request[:targetStart]...)
+		s.rewritten = append(s.rewritten, s.target...)
+		s.rewritten = append(s.rewritten, request[targetStart+len(line.Target):lineEnd]...)
+	} else {
+		s.rewritten = append(s.rewritten, request[:lineEnd]...)
+	}
+
+	if rewritesHeaders {
+		s.rewritten, headersEnd = to.Headers.Append(s.rewritten, request, headersEnd)
+		return s.rewritten, headersEnd
+	}
+
+	if headersEnd != -1 {
+		headersEnd += len(s.rewritten) - lineEnd
+	}
+
+	s.rewritten = append(s.rewritten, request[lineEnd:]...)
+
+	return s.rewritten, headersEnd
+}
+
+func (s *Server) enqueue(p pending) error {
+	select {
+	case s.pending <- p:
+		return nil
+	case <-s.responded:
+		return errResponderExited
+	}
+}
+
+// get obtains a connection to one of upstream's backends
+func (s *Server) get(
+	upstream *route.Upstream, request []byte,
+) (conn *connect.Conn, backend *balance.Backend, err error) {
+	key := s.balanceKey(upstream.Balancer, request)
+
+	return s.pool.Pick(upstream, key, s.preface(upstream.ProxyProtocol), false, s.newUpstream)
+}
+
+// preface returns PROXY protocol header of the version, or nil if it's zero
+func (s *Server) preface(version int) []byte {
+	if version == 0 {
+		return nil
+	}
+
+	if s.prefaces[version] == nil {
+		s.prefaces[version] = s.origin.Append(nil, version)
+	}
+
+	return s.prefaces[version]
+}
+
+// balanceKey returns the key for hashing balancers. It's either the header value or, in case
+// it's not set or isn't received yet, the client IP. Behind PROXY protocol, it's the IP of the
+// origin client, not of the proxy
+func (s *Server) balanceKey(balancer balance.Balancer, request []byte) []byte {
+	hashed, ok := balancer.(balance.Hashed)
+	if !ok {
+		return nil
+	}
+
+	if header := hashed.Header(); len(header) > 0 {
+		if value, found := http1.FindHeader(request, header); found {
+			return value
+		}
+	}
+
+	if s.clientAddr.IsValid() {
+		ip := s.clientAddr.As16()
+		s.key = append(s.key[:0], ip[:]...)
+
+		return s.key
+	}
+
+	return []byte(s.client.RemoteAddr().String())
 }
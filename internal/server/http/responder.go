@@ -0,0 +1,240 @@
+package http
+
+import (
+	"at/internal/balance"
+	"at/internal/connect"
+	"at/internal/server/tcp"
+	"errors"
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+// pending is a request, which response is awaited
+type pending struct {
+	// response is set in case the request is responded by the forwarder itself. Otherwise,
+	// it's read from the exchange's connection
+	response []byte
+	exchange *exchange
+	head     bool
+	// await is set in case it's not a request, but the server awaiting responses to all the
+	// previous ones. The exchange is sent in case the last upstream has switched protocols,
+	// otherwise nil. The channel is closed in case any of the responses isn't delivered
+	await chan<- *exchange
+}
+
+// exchange is a single request-response pair over the upstream connection. The connection
+// is returned to the pool only after both the request is forwarded and the response is
+// relayed, as the upstream may respond before the request body is completely received
+type exchange struct {
+	conn    *connect.Conn
+	backend *balance.Backend
+	refs    atomic.Int32
+	broken  atomic.Bool
+	// failure is the error response, set in case forwarding the request has failed
+	failure atomic.Pointer[[]byte]
+}
+
+func newExchange(conn *connect.Conn, backend *balance.Backend) *exchange {
+	e := &exchange{
+		conn:    conn,
+		backend: backend,
+	}
+	e.refs.Store(2)
+
+	return e
+}
+
+// done releases one of the exchange's sides: either the request is completely forwarded,
+// or its response is relayed. The connection is reused only in case both of them succeeded
+func (s *Server) done(e *exchange, ok bool) {
+	if !ok {
+		e.broken.Store(true)
+	}
+
+	if e.refs.Add(-1) > 0 {
+		return
+	}
+
+	e.backend.Release()
+
+	if e.broken.Load() {
+		s.pool.Discard(e.conn)
+	} else {
+		s.pool.Put(e.conn)
+	}
+}
+
+// respond relays responses to the client in the order of requests. In case any of them
+// fails, the following ones can't be delivered in order, so the client is disconnected
+func (s *Server) respond() {
+	defer close(s.responded)
+
+	// switched is the exchange, which upstream has switched protocols. It's handed over to
+	// the server as is, so the response side isn't done by the responder
+	var switched *exchange
+
+	for p := range s.pending {
+		if p.await != nil {
+			p.await <- switched
+			switched = nil
+			continue
+		}
+
+		if switched != nil {
+			// the upstream has switched protocols, though the request didn't ask to
+			s.done(switched, false)
+			switched = nil
+			s.client.Interrupt()
+			if p.exchange != nil {
+				s.done(p.exchange, false)
+			}
+
+			break
+		}
+
+		var ok bool
+		if switched, ok = s.relay(p); !ok {
+			s.client.Interrupt()
+			break
+		}
+	}
+
+	if switched != nil {
+		s.done(switched, false)
+	}
+
+	// the rest of responses won't be delivered anyway. The server, awaiting them, is told so
+	// by the closed channel
+	for p := range s.pending {
+		if p.await != nil {
+			close(p.await)
+		}
+
+		if p.exchange != nil {
+			s.done(p.exchange, false)
+		}
+	}
+}
+
+// relay delivers the response to the client. In case the upstream has switched protocols,
+// the exchange is returned instead of being done
+func (s *Server) relay(p pending) (switched *exchange, ok bool) {
+	if p.response != nil {
+		return nil, s.client.Write(p.response) == nil
+	}
+
+	if !s.track(p.exchange) {
+		s.done(p.exchange, false)
+		return nil, false
+	}
+
+	ok, reusable := s.relayResponse(p)
+	// the connection might be interrupted by abort, even though the response is relayed
+	interrupted := !s.track(nil)
+	if ok && !interrupted && s.responses.Status() == http.StatusSwitchingProtocols {
+		return p.exchange, true
+	}
+
+	s.done(p.exchange, ok && reusable && !interrupted)
+
+	return nil, ok
+}
+
+func (s *Server) relayResponse(p pending) (ok, reusable bool) {
+	var (
+		conn, backend = p.exchange.conn, p.exchange.backend
+		// written is set as soon as any part of the response is sent to the client. After
+		// that, the error response can't be sent anymore
+		written bool
+	)
+
+	s.responses.Begin(p.head)
+
+	for {
+		data, err := conn.Read()
+		if err != nil {
+			// the only way to tell where close-delimited response ends
+			if written && errors.Is(err, io.EOF) && s.responses.CloseDelimited() {
+				backend.Report(true)
+				return true, false
+			}
+
+			if failure := p.exchange.failure.Load(); failure != nil {
+				// the request has failed, so it's not upstream's fault
+				if !written {
+					_ = s.client.Write(*failure)
+				}
+
+				return false, false
+			}
+
+			if errors.Is(err, tcp.ErrInterrupted) {
+				// relaying is aborted
+				return false, false
+			}
+
+			backend.Report(false)
+			if !written {
+				_ = s.client.Write(s.errorResponse(upstreamErrorStatus(err), err))
+			}
+
+			return false, false
+		}
+
+		endsAt, err := s.responses.Scan(data)
+		if err != nil {
+			backend.Report(false)
+			if !written {
+				_ = s.client.Write(s.errorResponse(http.StatusBadGateway, err))
+			}
+
+			return false, false
+		}
+
+		if endsAt == -1 {
+			written = true
+			if err = s.client.Write(data); err != nil {
+				return false, false
+			}
+
+			continue
+		}
+
+		backend.Report(true)
+		if s.responses.Status() == http.StatusSwitchingProtocols {
+			// the rest of data already belongs to the new protocol
+			endsAt = len(data)
+		}
+
+		if err = s.client.Write(data[:endsAt]); err != nil {
+			return false, false
+		}
+
+		// the upstream isn't supposed to send anything after the response, so the connection
+		// can't be reused in case it did
+		return true, s.responses.KeepAlive() && endsAt == len(data)
+	}
+}
+
+// track sets the exchange, which response is being relayed. False is returned in case
+// relaying is aborted
+func (s *Server) track(e *exchange) bool {
+	s.relayMu.Lock()
+	defer s.relayMu.Unlock()
+
+	s.relaying = e
+
+	return !s.aborted
+}
+
+// abort stops relaying responses, so the server can exit without waiting for them
+func (s *Server) abort() {
+	s.relayMu.Lock()
+	defer s.relayMu.Unlock()
+
+	s.aborted = true
+	if s.relaying != nil {
+		s.relaying.conn.Interrupt()
+	}
+}
@@ -0,0 +1,116 @@
+package http
+
+import (
+	"at/internal/connect"
+	"at/internal/scan/http1"
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+)
+
+var (
+	errUnknownHost     = errors.New("unknown host")
+	errRequestTooLarge = errors.New("request exceeds the buffer")
+	errRateLimited     = errors.New("rate limit is exceeded")
+)
+
+// reject enqueues the error response instead of the request, which can't be forwarded. The
+// client must be disconnected afterwards. The returned value is always true, meaning responses
+// in flight, including this one, must be waited for
+func (s *Server) reject(status int, err error) (finish bool) {
+	_ = s.enqueue(pending{response: s.errorResponse(status, err)})
+
+	return true
+}
+
+// throttle enqueues 429 response instead of the request, telling the client when to retry
+// it. Unlike reject, the connection is kept alive, unless closing is set
+func (s *Server) throttle(retryAfter time.Duration, closing bool) error {
+	status := http.StatusTooManyRequests
+	requestID := logError(status, errRateLimited)
+
+	return s.enqueue(pending{response: s.pages.RenderRetry(status, requestID, retryAfter, closing)})
+}
+
+// fail breaks the exchange, that is already enqueued. Its response is replaced with the error
+// one, unless its relaying is already started
+func (s *Server) fail(e *exchange, status int, err error) {
+	response := s.errorResponse(status, err)
+	e.failure.Store(&response)
+	s.done(e, false)
+	e.conn.Interrupt()
+}
+
+// errorResponse renders the error response and logs the error along with request id, so
+// they can be matched
+func (s *Server) errorResponse(status int, err error) []byte {
+	return s.pages.Render(status, logError(status, err))
+}
+
+// logError logs the error along with the new request id, which is returned
+func logError(status int, err error) (requestID string) {
+	requestID = fmt.Sprintf("%016x", rand.Uint64())
+	log.Printf("error: request %s: %d: %s", requestID, status, err)
+
+	return requestID
+}
+
+// requestErrorStatus returns the status code of the response to the malformed request
+func requestErrorStatus(err error) int {
+	// chunk extensions belong to the body, so they are just malformed, even though too long
+	switch {
+	case errors.Is(err, http1.ErrTooLong),
+		errors.Is(err, http1.ErrTrailersTooLong):
+		return http.StatusRequestHeaderFieldsTooLarge
+	case errors.Is(err, http1.ErrURITooLong):
+		return http.StatusRequestURITooLong
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// tooLargeStatus returns the status code of the response to the request, that doesn't fit
+// into the buffer along with the data. It's 413 in case the header section alone does, as
+// only the body is too large then. The buffer isn't usable afterwards
+func (s *Server) tooLargeStatus(data []byte) int {
+	if s.scanner.HeadersEnd() == -1 {
+		return http.StatusRequestHeaderFieldsTooLarge
+	}
+
+	// the empty line, that terminates the header section, might start in the amassed part
+	start := s.scanner.HeadersEnd() - len(s.buffer.Finish())
+	if start < -1 {
+		return http.StatusRequestEntityTooLarge
+	}
+
+	if start < 0 {
+		start = 0
+	}
+
+	end := start + bytes.IndexByte(data[start:], '\n') + 1
+	if s.buffer.Append(data[:end]...) {
+		return http.StatusRequestEntityTooLarge
+	}
+
+	return http.StatusRequestHeaderFieldsTooLarge
+}
+
+// upstreamErrorStatus returns the status code of the response to the request, that failed
+// because of the upstream
+func upstreamErrorStatus(err error) int {
+	var netErr net.Error
+
+	switch {
+	case errors.Is(err, connect.ErrPoolExhausted):
+		return http.StatusServiceUnavailable
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusBadGateway
+	}
+}
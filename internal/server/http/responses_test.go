@@ -0,0 +1,25 @@
+package http
+
+import (
+	"at/internal/scan/http1"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+)
+
+func TestRequestErrorStatus(t *testing.T) {
+	for _, tc := range []struct {
+		err    error
+		status int
+	}{
+		{http1.ErrTooLong, http.StatusRequestHeaderFieldsTooLarge},
+		{http1.ErrTrailersTooLong, http.StatusRequestHeaderFieldsTooLarge},
+		{http1.ErrURITooLong, http.StatusRequestURITooLong},
+		{http1.ErrChunkExtensionsTooLong, http.StatusBadRequest},
+		{http1.ErrBadContentLength, http.StatusBadRequest},
+		{fmt.Errorf("wrapped: %w", http1.ErrTooLong), http.StatusRequestHeaderFieldsTooLarge},
+	} {
+		require.Equal(t, tc.status, requestErrorStatus(tc.err), tc.err.Error())
+	}
+}
@@ -0,0 +1,384 @@
+package http
+
+import (
+	"at/internal/balance"
+	"at/internal/connect"
+	"at/internal/pages"
+	"at/internal/proxyproto"
+	"at/internal/ratelimit"
+	"at/internal/route"
+	"at/internal/scan/http1"
+	"at/internal/server/tcp"
+	"at/internal/tunnel"
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/indigo-web/utils/arena"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+// backend responds to requests without bodies with its name, the request target and the Host
+// header, so the test can tell where requests went and how they looked. Every response is
+// delayed, so responses of faster backends would overtake it, if they weren't ordered
+func backend(t *testing.T, name string, delay time.Duration) (addr string) {
+	sock, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = sock.Close() })
+
+	go func() {
+		for {
+			conn, err := sock.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer func() { _ = conn.Close() }()
+
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+
+					var host string
+					for {
+						header, err := r.ReadString('\n')
+						if err != nil {
+							return
+						}
+
+						if header == "\r\n" {
+							break
+						}
+
+						if key, value, found := strings.Cut(header, ":"); found && strings.EqualFold(key, "host") {
+							host = strings.TrimSpace(value)
+						}
+					}
+
+					time.Sleep(delay)
+					requestLine := strings.Fields(line)
+					body := name + " " + requestLine[1] + " " + host
+					response := fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n", len(body))
+					if requestLine[0] != http.MethodHead {
+						response += body
+					}
+
+					if _, err = conn.Write([]byte(response)); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	return sock.Addr().String()
+}
+
+// echo sends back everything it receives, so it can be a destination of CONNECT tunnels
+func echo(t *testing.T) (addr string) {
+	sock, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = sock.Close() })
+
+	go func() {
+		for {
+			conn, err := sock.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer func() { _ = conn.Close() }()
+
+				buf := make([]byte, 512)
+				for {
+					n, err := conn.Read(buf)
+					if err != nil {
+						return
+					}
+
+					if _, err = conn.Write(buf[:n]); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	return sock.Addr().String()
+}
+
+// hangup closes every connection right after accepting it, so requests are forwarded, but
+// never responded
+func hangup(t *testing.T) (addr string) {
+	sock, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = sock.Close() })
+
+	go func() {
+		for {
+			conn, err := sock.Accept()
+			if err != nil {
+				return
+			}
+
+			_ = conn.Close()
+		}
+	}()
+
+	return sock.Addr().String()
+}
+
+func newUpstream(name, addr string) *route.Upstream {
+	balancer, _ := balance.New(balance.RoundRobin, []*balance.Backend{balance.NewBackend(addr, 1, balance.Thresholds{})}, "")
+
+	return &route.Upstream{Name: name, Balancer: balancer}
+}
+
+func newClient(conn net.Conn) tcp.Client {
+	return tcp.NewClient(conn, time.Second, time.Second, make([]byte, 4096))
+}
+
+// serve connects to the server of the table over loopback. Responses are read by the
+// returned reader
+func serve(
+	t *testing.T, table *route.Table, allowlist *tunnel.Allowlist, limit *ratelimit.Rule,
+) (conn net.Conn, responses *bufio.Reader) {
+	sock, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = sock.Close() }()
+
+	conn, err = net.Dial("tcp", sock.Addr().String())
+	require.NoError(t, err)
+	remote, err := sock.Accept()
+	require.NoError(t, err)
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+	pool := connect.NewPool(connect.Limits{
+		MaxIdlePerHost: 4,
+		IdleTimeout:    time.Minute,
+		Wait:           time.Second,
+		ConnectTimeout: time.Second,
+	})
+	server := New(
+		newClient(remote), http1.NewScanner(), route.NewRoutes(table), pool, newClient,
+		arena.NewArena[byte](4096, 65536), pages.Default(), false, nil, proxyproto.Header{}, allowlist,
+		limit, time.Second,
+	)
+
+	done := make(chan struct{})
+	go func() {
+		server.Serve(context.Background(), 0)
+		close(done)
+	}()
+
+	t.Cleanup(func() {
+		_ = conn.Close()
+		<-done
+	})
+
+	return conn, bufio.NewReader(conn)
+}
+
+// read reads the response to the request with the method along with its body
+func read(t *testing.T, responses *bufio.Reader, method string) (*http.Response, string) {
+	response, err := http.ReadResponse(responses, &http.Request{Method: method})
+	require.NoError(t, err)
+	body, err := io.ReadAll(response.Body)
+	require.NoError(t, err)
+
+	return response, string(body)
+}
+
+// closed reports whether the server has closed the connection
+func closed(responses *bufio.Reader) bool {
+	_, err := responses.ReadByte()
+	return err == io.EOF
+}
+
+func TestServer(t *testing.T) {
+	var (
+		a = newUpstream("a", backend(t, "a", 50*time.Millisecond))
+		b = newUpstream("b", backend(t, "b", 0))
+	)
+
+	table := route.NewTable(0)
+	require.NoError(t, table.Add("a.com", a))
+	require.NoError(t, table.Add("b.com", b))
+
+	t.Run("pipelining", func(t *testing.T) {
+		conn, responses := serve(t, table, nil, nil)
+		_, err := conn.Write([]byte("GET /1 HTTP/1.1\r\nHost: a.com\r\n\r\n" +
+			"GET /2 HTTP/1.1\r\nHost: b.com\r\n\r\n" +
+			"GET /3 HTTP/1.1\r\nHost: a.com\r\n\r\n"))
+		require.NoError(t, err)
+
+		for _, want := range []string{"a /1 a.com", "b /2 b.com", "a /3 a.com"} {
+			response, body := read(t, responses, http.MethodGet)
+			require.Equal(t, http.StatusOK, response.StatusCode)
+			require.Equal(t, want, body)
+		}
+	})
+
+	t.Run("dead backend", func(t *testing.T) {
+		sock, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		require.NoError(t, sock.Close())
+
+		table := route.NewTable(0)
+		require.NoError(t, table.Add("dead.com", newUpstream("dead", sock.Addr().String())))
+
+		conn, responses := serve(t, table, nil, nil)
+		_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: dead.com\r\n\r\n"))
+		require.NoError(t, err)
+
+		response, _ := read(t, responses, http.MethodGet)
+		require.Equal(t, http.StatusBadGateway, response.StatusCode)
+		require.True(t, closed(responses))
+	})
+
+	t.Run("hung up backend", func(t *testing.T) {
+		table := route.NewTable(0)
+		require.NoError(t, table.Add("hangup.com", newUpstream("hangup", hangup(t))))
+
+		// the server awaits the response before disconnecting the client
+		conn, responses := serve(t, table, nil, nil)
+		_, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: hangup.com\r\nConnection: close\r\n\r\n"))
+		require.NoError(t, err)
+
+		response, _ := read(t, responses, http.MethodGet)
+		require.Equal(t, http.StatusBadGateway, response.StatusCode)
+		require.True(t, closed(responses))
+	})
+
+	t.Run("head", func(t *testing.T) {
+		conn, responses := serve(t, table, nil, nil)
+		_, err := conn.Write([]byte("HEAD /1 HTTP/1.1\r\nHost: b.com\r\n\r\nGET /2 HTTP/1.1\r\nHost: b.com\r\n\r\n"))
+		require.NoError(t, err)
+
+		// the response to HEAD has Content-Length, but no body
+		response, body := read(t, responses, http.MethodHead)
+		require.Equal(t, int64(len("b /1 b.com")), response.ContentLength)
+		require.Empty(t, body)
+
+		_, body = read(t, responses, http.MethodGet)
+		require.Equal(t, "b /2 b.com", body)
+	})
+
+	t.Run("connect after pipelined request", func(t *testing.T) {
+		dst := echo(t)
+		allowlist, err := tunnel.NewAllowlist([]string{dst})
+		require.NoError(t, err)
+
+		conn, responses := serve(t, table, allowlist, nil)
+		_, err = conn.Write([]byte("GET /1 HTTP/1.1\r\nHost: a.com\r\n\r\n" +
+			"CONNECT " + dst + " HTTP/1.1\r\nHost: " + dst + "\r\n\r\n"))
+		require.NoError(t, err)
+
+		// the tunnel is established only after the pending response is delivered
+		_, body := read(t, responses, http.MethodGet)
+		require.Equal(t, "a /1 a.com", body)
+		// the body of the response is the tunnel itself, so it's not read as a whole
+		response, err := http.ReadResponse(responses, &http.Request{Method: http.MethodConnect})
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, response.StatusCode)
+
+		_, err = conn.Write([]byte("ping"))
+		require.NoError(t, err)
+		received := make([]byte, 4)
+		_, err = io.ReadFull(responses, received)
+		require.NoError(t, err)
+		require.Equal(t, "ping", string(received))
+	})
+
+	t.Run("connect after failed request", func(t *testing.T) {
+		dst := echo(t)
+		allowlist, err := tunnel.NewAllowlist([]string{dst})
+		require.NoError(t, err)
+
+		table := route.NewTable(0)
+		require.NoError(t, table.Add("hangup.com", newUpstream("hangup", hangup(t))))
+
+		// the tunnel isn't established, as the response it would follow isn't delivered
+		conn, responses := serve(t, table, allowlist, nil)
+		_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: hangup.com\r\n\r\n" +
+			"CONNECT " + dst + " HTTP/1.1\r\nHost: " + dst + "\r\n\r\n"))
+		require.NoError(t, err)
+
+		response, _ := read(t, responses, http.MethodGet)
+		require.Equal(t, http.StatusBadGateway, response.StatusCode)
+		require.True(t, closed(responses))
+	})
+
+	t.Run("rate limit", func(t *testing.T) {
+		limit, err := ratelimit.NewLimit(1, time.Hour, 1)
+		require.NoError(t, err)
+		rule, err := ratelimit.NewRule(limit, "", ratelimit.NewLimiter())
+		require.NoError(t, err)
+
+		conn, responses := serve(t, table, nil, rule)
+		_, err = conn.Write([]byte("GET /1 HTTP/1.1\r\nHost: a.com\r\n\r\nGET /2 HTTP/1.1\r\nHost: b.com\r\n\r\n"))
+		require.NoError(t, err)
+
+		_, body := read(t, responses, http.MethodGet)
+		require.Equal(t, "a /1 a.com", body)
+
+		// excess requests are responded in order, and the connection is kept alive
+		for i := 0; i < 2; i++ {
+			response, _ := read(t, responses, http.MethodGet)
+			require.Equal(t, http.StatusTooManyRequests, response.StatusCode)
+			require.Equal(t, "3600", response.Header.Get("Retry-After"))
+			require.False(t, response.Close)
+
+			_, err = conn.Write([]byte("GET /3 HTTP/1.1\r\nHost: b.com\r\n\r\n"))
+			require.NoError(t, err)
+		}
+	})
+
+	t.Run("absolute-form target", func(t *testing.T) {
+		conn, responses := serve(t, table, nil, nil)
+		_, err := conn.Write([]byte("GET http://b.com/1 HTTP/1.1\r\nHost: a.com\r\n\r\n"))
+		require.NoError(t, err)
+
+		_, body := read(t, responses, http.MethodGet)
+		require.Equal(t, "b http://b.com/1 b.com", body)
+	})
+
+	t.Run("connection close", func(t *testing.T) {
+		for _, request := range []string{
+			"GET /1 HTTP/1.1\r\nHost: b.com\r\nConnection: close\r\n\r\n",
+			"GET /1 HTTP/1.0\r\nHost: b.com\r\n\r\n",
+		} {
+			conn, responses := serve(t, table, nil, nil)
+			_, err := conn.Write([]byte(request + "GET /2 HTTP/1.1\r\nHost: b.com\r\n\r\n"))
+			require.NoError(t, err)
+
+			// the following request is never read
+			_, body := read(t, responses, http.MethodGet)
+			require.Equal(t, "b /1 b.com", body)
+			require.True(t, closed(responses))
+		}
+	})
+}
+
+func TestBalanceKey(t *testing.T) {
+	backends := []*balance.Backend{balance.NewBackend("127.0.0.1:80", 1, balance.Thresholds{})}
+	balancer, err := balance.New(balance.Hash, backends, "X-User")
+	require.NoError(t, err)
+
+	// the address is the origin client's one, even though the connection is from the proxy
+	s := &Server{clientAddr: netip.MustParseAddr("10.0.0.1")}
+	ip := netip.MustParseAddr("10.0.0.1").As16()
+	require.Equal(t, ip[:], s.balanceKey(balancer, []byte("GET / HTTP/1.1\r\nHost: a.com\r\n\r\n")))
+	require.Equal(t, []byte("alice"), s.balanceKey(balancer, []byte("GET / HTTP/1.1\r\nX-User: alice\r\n\r\n")))
+}
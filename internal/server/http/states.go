@@ -1,8 +1,7 @@
 package http
 
-type serverState int
-
 const (
-	eAmass serverState = iota
-	eTransit
+	eBusy int32 = iota
+	eIdle
+	eClosing
 )
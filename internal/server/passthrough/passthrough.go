@@ -0,0 +1,165 @@
+package passthrough
+
+import (
+	"at/internal/connect"
+	"at/internal/proxyproto"
+	"at/internal/route"
+	"at/internal/scan"
+	"at/internal/server/tcp"
+	"at/internal/tunnel"
+	"errors"
+	"github.com/indigo-web/utils/arena"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+var (
+	errUnknownHost     = errors.New("no passthrough route")
+	errHelloTooLarge   = errors.New("ClientHello exceeds the buffer")
+	errNoHealthyRoutes = errors.New("no backend is available")
+)
+
+// Server forwards TLS connections to upstreams, chosen by SNI, without terminating them.
+// Connections to upstreams are never shared
+type Server struct {
+	client  tcp.Client
+	scanner scan.Scanner
+	routes  *route.Routes
+	pool    *connect.Pool
+	// newUpstream wraps new connections to upstreams
+	newUpstream func(conn net.Conn) tcp.Client
+	// buffer holds the ClientHello until the upstream is known
+	buffer *arena.Arena[byte]
+	// origin describes the client connection to upstreams, that want PROXY protocol
+	origin proxyproto.Header
+	// idle is the timeout of the tunnel
+	idle time.Duration
+}
+
+func New(
+	client tcp.Client, scanner scan.Scanner, routes *route.Routes, pool *connect.Pool,
+	newUpstream func(conn net.Conn) tcp.Client, buffer *arena.Arena[byte], origin proxyproto.Header,
+	idle time.Duration,
+) *Server {
+	return &Server{
+		client:      client,
+		scanner:     scanner,
+		routes:      routes,
+		pool:        pool,
+		newUpstream: newUpstream,
+		buffer:      buffer,
+		origin:      origin,
+		idle:        idle,
+	}
+}
+
+// Serve reads the ClientHello, connects to the upstream and relays the stream until either
+// side closes it. The client is closed afterwards
+func (s *Server) Serve() {
+	defer func() {
+		_ = s.client.Close()
+	}()
+
+	host, err := s.hello()
+	if err != nil {
+		if !errors.Is(err, io.EOF) {
+			log.Println("error: passthrough:", s.client.RemoteAddr(), err)
+		}
+
+		return
+	}
+
+	upstream, found := Lookup(s.routes.Table(), host)
+	if !found {
+		log.Println("error: passthrough:", s.client.RemoteAddr(), errUnknownHost, host)
+		return
+	}
+
+	s.forward(upstream, host)
+}
+
+// ServeRaw relays the connection to the upstream as is. The client is closed afterwards
+func (s *Server) ServeRaw(upstream *route.Upstream) {
+	defer func() {
+		_ = s.client.Close()
+	}()
+
+	s.forward(upstream, "")
+}
+
+// Lookup returns the passthrough route of the server name
+func Lookup(table *route.Table, host string) (*route.Upstream, bool) {
+	name, _, err := route.Canonical(host)
+	if err != nil {
+		return nil, false
+	}
+
+	return table.Passthrough().Lookup(name)
+}
+
+// forward connects to the upstream, sends already consumed data and relays the rest
+func (s *Server) forward(upstream *route.Upstream, host string) {
+	var preface []byte
+	if upstream.ProxyProtocol != 0 {
+		if len(host) > 0 {
+			s.origin.Authority = host
+		}
+
+		preface = s.origin.Append(nil, upstream.ProxyProtocol)
+	}
+
+	conn, backend, err := s.pool.Pick(upstream, s.balanceKey(), preface, true, s.newUpstream)
+	if err != nil {
+		log.Println("error: passthrough:", upstream.Name, errNoHealthyRoutes, err)
+		return
+	}
+
+	backend.Acquire()
+	defer func() {
+		backend.Release()
+		s.pool.Discard(conn)
+	}()
+
+	if consumed := s.buffer.Finish(); len(consumed) > 0 {
+		if err = conn.Write(consumed); err != nil {
+			backend.Report(false)
+			return
+		}
+	}
+
+	_ = tunnel.Pipe(s.client, conn, s.idle)
+}
+
+// hello amasses the ClientHello until the server name is known
+func (s *Server) hello() (host string, err error) {
+	for {
+		data, err := s.client.Read()
+		if err != nil {
+			return "", err
+		}
+
+		host, endsAt, err := s.scanner.Scan(data)
+		if err != nil {
+			return "", err
+		}
+
+		if !s.buffer.Append(data...) {
+			return "", errHelloTooLarge
+		}
+
+		if len(host) > 0 || endsAt != -1 {
+			return host, nil
+		}
+	}
+}
+
+// balanceKey returns the client IP for hashing balancers
+func (s *Server) balanceKey() []byte {
+	if addr, ok := s.client.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+
+	return []byte(s.client.RemoteAddr().String())
+}
@@ -1,15 +1,30 @@
 package tcp
 
 import (
+	"errors"
 	"net"
+	"sync/atomic"
 	"time"
 )
 
+var ErrInterrupted = errors.New("reading is interrupted")
+
 type Client interface {
 	Write([]byte) error
+	// Writev writes all the buffers at once, avoiding copying them together
+	Writev(net.Buffers) error
 	Read() ([]byte, error)
 	Unread([]byte)
+	// Interrupt unblocks the pending Read, if any, and makes all the following ones fail
+	// with ErrInterrupted. It's safe to be called concurrently with Read
+	Interrupt()
+	// CloseWrite shuts the writing side of the connection down, so the other side receives
+	// EOF, but still can send its data
+	CloseWrite() error
+	// SetReadTimeout replaces the timeout of following reads
+	SetReadTimeout(time.Duration)
 	Close() error
+	RemoteAddr() net.Addr
 }
 
 type client struct {
@@ -17,6 +32,7 @@ type client struct {
 	readDeadline, writeDeadline time.Duration
 	buff                        []byte
 	unread                      []byte
+	interrupted                 atomic.Bool
 }
 
 func NewClient(conn net.Conn, rDeadline, wDeadline time.Duration, buff []byte) Client {
@@ -38,6 +54,16 @@ func (c *client) Write(data []byte) error {
 	return err
 }
 
+func (c *client) Writev(buffers net.Buffers) error {
+	if err := c.conn.SetWriteDeadline(time.Now().Add(c.writeDeadline)); err != nil {
+		return err
+	}
+
+	_, err := buffers.WriteTo(c.conn)
+
+	return err
+}
+
 func (c *client) Read() ([]byte, error) {
 	if len(c.unread) > 0 {
 		data := c.unread
@@ -50,6 +76,12 @@ func (c *client) Read() ([]byte, error) {
 		return nil, err
 	}
 
+	// the check must be done after the deadline is set, otherwise it might override the
+	// one set by the Interrupt
+	if c.interrupted.Load() {
+		return nil, ErrInterrupted
+	}
+
 	n, err := c.conn.Read(c.buff)
 
 	return c.buff[:n], err
@@ -59,6 +91,27 @@ func (c *client) Unread(data []byte) {
 	c.unread = data
 }
 
+func (c *client) Interrupt() {
+	c.interrupted.Store(true)
+	_ = c.conn.SetReadDeadline(time.Unix(1, 0))
+}
+
+func (c *client) CloseWrite() error {
+	if conn, ok := c.conn.(interface{ CloseWrite() error }); ok {
+		return conn.CloseWrite()
+	}
+
+	return c.conn.Close()
+}
+
+func (c *client) SetReadTimeout(timeout time.Duration) {
+	c.readDeadline = timeout
+}
+
 func (c *client) Close() error {
 	return c.conn.Close()
 }
+
+func (c *client) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
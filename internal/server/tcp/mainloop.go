@@ -2,31 +2,148 @@ package tcp
 
 import (
 	"context"
+	"errors"
 	"log"
 	"net"
 	"sync"
+	"time"
 )
 
+const (
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = 1 * time.Second
+)
+
+// Run accepts connections until the context is cancelled or the listener is closed, and
+// then waits for all the handlers to exit, however long it takes. The listener is closed on
+// cancel, too, so Run can't be restarted on the same one. In case it's closed elsewhere,
+// net.ErrClosed is returned
 func Run(ctx context.Context, sock net.Listener, onConn func(conn net.Conn)) error {
-	wg := new(sync.WaitGroup)
+	return RunGraceful(ctx, sock, 0, nil, onConn)
+}
 
-	for {
-		if err := ctx.Err(); err != nil {
-			wg.Wait()
+// RunGraceful is Run, that force-closes connections, whose handlers didn't manage to exit
+// in the drain timeout after the context is cancelled. Zero drain timeout means waiting
+// forever. The listener is closed as soon as the context is cancelled, so the pending
+// Accept is unblocked. Connections, that aren't admitted, are closed right away without
+// spawning the handler. Nil admit admits all of them
+func RunGraceful(
+	ctx context.Context, sock net.Listener, drain time.Duration, admit func(conn net.Conn) bool,
+	onConn func(conn net.Conn),
+) error {
+	var (
+		conns   = newConnSet()
+		backoff time.Duration
+		stop    = make(chan struct{})
+	)
+
+	defer close(stop)
 
-			return err
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = sock.Close()
+		case <-stop:
 		}
+	}()
 
+	for {
 		conn, err := sock.Accept()
 		if err != nil {
-			log.Println("error accepting a connection:", err)
+			if ctx.Err() != nil {
+				conns.Drain(drain)
+
+				return ctx.Err()
+			}
+
+			if errors.Is(err, net.ErrClosed) {
+				conns.Drain(drain)
+
+				return err
+			}
+
+			if backoff = backoff * 2; backoff == 0 {
+				backoff = minAcceptBackoff
+			} else if backoff > maxAcceptBackoff {
+				backoff = maxAcceptBackoff
+			}
+
+			log.Println("error accepting a connection:", err, "retrying in", backoff)
+			time.Sleep(backoff)
+			continue
+		}
+
+		backoff = 0
+		if admit != nil && !admit(conn) {
+			_ = conn.Close()
 			continue
 		}
 
-		wg.Add(1)
+		conns.Add(conn)
 		go func() {
 			onConn(conn)
-			wg.Done()
+			conns.Done(conn)
 		}()
 	}
 }
+
+// connSet tracks connections, that are being handled, so they can be force-closed in case
+// they don't exit in time
+type connSet struct {
+	mu    sync.Mutex
+	wg    sync.WaitGroup
+	conns map[net.Conn]struct{}
+}
+
+func newConnSet() *connSet {
+	return &connSet{
+		conns: make(map[net.Conn]struct{}),
+	}
+}
+
+func (c *connSet) Add(conn net.Conn) {
+	c.mu.Lock()
+	c.conns[conn] = struct{}{}
+	c.mu.Unlock()
+	c.wg.Add(1)
+}
+
+func (c *connSet) Done(conn net.Conn) {
+	c.mu.Lock()
+	delete(c.conns, conn)
+	c.mu.Unlock()
+	c.wg.Done()
+}
+
+// Drain waits for all the handlers to exit. In case they didn't in the timeout, their
+// connections are closed and handlers are waited for once again
+func (c *connSet) Drain(timeout time.Duration) {
+	if timeout <= 0 {
+		c.wg.Wait()
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return
+	case <-time.After(timeout):
+	}
+
+	c.mu.Lock()
+	if len(c.conns) > 0 {
+		log.Println("drain timeout exceeded, force-closing", len(c.conns), "connections")
+	}
+
+	for conn := range c.conns {
+		_ = conn.Close()
+	}
+	c.mu.Unlock()
+
+	<-done
+}
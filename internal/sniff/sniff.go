@@ -0,0 +1,144 @@
+package sniff
+
+import (
+	"at/internal/scan/clienthello"
+	"errors"
+	"net"
+	"time"
+)
+
+type Protocol int
+
+const (
+	Raw Protocol = iota
+	HTTP
+	TLS
+)
+
+// maxMethodLen limits the method token. Anything longer is unlikely to be HTTP
+const maxMethodLen = 16
+
+const recordTypeHandshake = 0x16
+
+// Detect tells the protocol by the first bytes, the client sends. HTTP is recognized by
+// the method token, TLS by the handshake record. In case the client doesn't send enough
+// in the timeout, or sends something else, the protocol is Raw. The returned connection
+// replays consumed bytes
+func Detect(conn net.Conn, timeout time.Duration) (Protocol, *Conn, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return Raw, nil, err
+	}
+
+	var (
+		data = make([]byte, 0, 512)
+		err  error
+	)
+
+	for {
+		protocol, sure := guess(data)
+		if sure {
+			return protocol, replay(conn, data), conn.SetReadDeadline(time.Time{})
+		}
+
+		var n int
+		n, err = conn.Read(data[len(data):cap(data)])
+		data = data[:len(data)+n]
+		if err != nil {
+			break
+		}
+	}
+
+	if !isTimeout(err) {
+		return Raw, nil, err
+	}
+
+	// server-first protocols are detected as well, as their clients keep silence
+	return Raw, replay(conn, data), conn.SetReadDeadline(time.Time{})
+}
+
+// ServerName reads the ClientHello and returns the server name, the client has requested.
+// The ClientHello is replayed by the connection afterwards
+func ServerName(conn *Conn, timeout time.Duration) (string, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return "", err
+	}
+
+	var (
+		scanner  = clienthello.NewScanner()
+		consumed = conn.rest
+		buff     = make([]byte, 4096)
+	)
+
+	sni, endsAt, err := scanner.Scan(consumed)
+	for err == nil && len(sni) == 0 && endsAt == -1 {
+		var n int
+		n, err = conn.Conn.Read(buff)
+		consumed = append(consumed, buff[:n]...)
+		if err == nil {
+			sni, endsAt, err = scanner.Scan(buff[:n])
+		}
+	}
+
+	conn.rest = consumed
+	if err != nil {
+		return "", err
+	}
+
+	return sni, conn.SetReadDeadline(time.Time{})
+}
+
+// guess returns the protocol and whether it's known for sure
+func guess(data []byte) (protocol Protocol, sure bool) {
+	if len(data) == 0 {
+		return Raw, false
+	}
+
+	if data[0] == recordTypeHandshake {
+		return TLS, true
+	}
+
+	for i, b := range data {
+		switch {
+		case b == ' ' && i > 0:
+			return HTTP, true
+		case b < 'A' || b > 'Z' || i >= maxMethodLen:
+			return Raw, true
+		}
+	}
+
+	return Raw, false
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// Conn replays bytes, consumed while sniffing
+type Conn struct {
+	net.Conn
+	rest []byte
+}
+
+func replay(conn net.Conn, data []byte) *Conn {
+	return &Conn{Conn: conn, rest: data}
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if len(c.rest) > 0 {
+		n := copy(b, c.rest)
+		c.rest = c.rest[n:]
+
+		return n, nil
+	}
+
+	return c.Conn.Read(b)
+}
+
+func (c *Conn) CloseWrite() error {
+	if conn, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return conn.CloseWrite()
+	}
+
+	return c.Conn.Close()
+}
@@ -0,0 +1,99 @@
+package sniff
+
+import (
+	"crypto/tls"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// pair returns both ends of a loopback TCP connection
+func pair(t *testing.T) (local, remote net.Conn) {
+	sock, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = sock.Close() }()
+
+	local, err = net.Dial("tcp", sock.Addr().String())
+	require.NoError(t, err)
+	remote, err = sock.Accept()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = local.Close()
+		_ = remote.Close()
+	})
+
+	return local, remote
+}
+
+func TestDetect(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		pieces []string
+		want   Protocol
+	}{
+		{"http", []string{"GET / HTTP/1.1\r\n\r\n"}, HTTP},
+		{"http by pieces", []string{"OPT", "IONS * HTTP/1.1\r\n\r\n"}, HTTP},
+		{"tls", []string{"\x16\x03\x01"}, TLS},
+		{"ssh", []string{"SSH-2.0-OpenSSH_9.0\r\n"}, Raw},
+		{"lowercase", []string{"get / HTTP/1.1\r\n"}, Raw},
+		{"silence", nil, Raw},
+		{"no space", []string{"GET"}, Raw},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pieces := tc.pieces
+			client, server := pair(t)
+			go func() {
+				for _, piece := range pieces {
+					_, _ = client.Write([]byte(piece))
+					time.Sleep(10 * time.Millisecond)
+				}
+			}()
+
+			protocol, conn, err := Detect(server, 100*time.Millisecond)
+			require.NoError(t, err)
+			require.Equal(t, tc.want, protocol)
+
+			// everything sent must be read back
+			var sent string
+			for _, piece := range tc.pieces {
+				sent += piece
+			}
+
+			if len(sent) > 0 {
+				received := make([]byte, len(sent))
+				_, err = io.ReadFull(conn, received)
+				require.NoError(t, err)
+				require.Equal(t, sent, string(received))
+			}
+		})
+	}
+
+	t.Run("closed", func(t *testing.T) {
+		client, server := pair(t)
+		require.NoError(t, client.Close())
+		_, _, err := Detect(server, time.Second)
+		require.ErrorIs(t, err, io.EOF)
+	})
+}
+
+func TestServerName(t *testing.T) {
+	client, server := pair(t)
+	go func() {
+		_ = tls.Client(client, &tls.Config{ServerName: "example.com", InsecureSkipVerify: true}).Handshake()
+	}()
+
+	protocol, conn, err := Detect(server, time.Second)
+	require.NoError(t, err)
+	require.Equal(t, TLS, protocol)
+
+	sni, err := ServerName(conn, time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "example.com", sni)
+
+	// the ClientHello is replayed, so the handshake can be still completed by someone else
+	sni, err = ServerName(conn, time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "example.com", sni)
+}
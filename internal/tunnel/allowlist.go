@@ -0,0 +1,75 @@
+package tunnel
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+var ErrBadDestination = errors.New("must be host:port, host might be a wildcard and port might be *")
+
+// Allowlist tells whether clients may open tunnels to the destination
+type Allowlist struct {
+	destinations []destination
+}
+
+type destination struct {
+	// host is either exact or a suffix including the leading dot, in case of wildcard
+	host     string
+	wildcard bool
+	// port is empty in case any one is allowed
+	port string
+}
+
+// NewAllowlist parses destinations in the form of host:port. Host is either exact
+// (example.com) or a wildcard (*.example.com), that matches any number of labels, but not
+// the domain itself. Port * allows any port
+func NewAllowlist(destinations []string) (*Allowlist, error) {
+	a := &Allowlist{destinations: make([]destination, 0, len(destinations))}
+
+	for _, dst := range destinations {
+		host, port, err := net.SplitHostPort(strings.ToLower(dst))
+		if err != nil || len(host) == 0 || len(port) == 0 {
+			return nil, ErrBadDestination
+		}
+
+		d := destination{host: host, port: port}
+		if strings.HasPrefix(host, "*.") {
+			d.host, d.wildcard = host[1:], true
+		}
+
+		if port == "*" {
+			d.port = ""
+		}
+
+		if len(d.host) == 1 || strings.IndexByte(d.host, '*') != -1 {
+			return nil, ErrBadDestination
+		}
+
+		a.destinations = append(a.destinations, d)
+	}
+
+	return a, nil
+}
+
+// Allowed reports whether the destination in the form of host:port is allowed
+func (a *Allowlist) Allowed(dst string) bool {
+	host, port, err := net.SplitHostPort(dst)
+	if err != nil {
+		return false
+	}
+
+	host = strings.ToLower(host)
+
+	for _, d := range a.destinations {
+		if len(d.port) > 0 && d.port != port {
+			continue
+		}
+
+		if d.host == host || (d.wildcard && strings.HasSuffix(host, d.host)) {
+			return true
+		}
+	}
+
+	return false
+}
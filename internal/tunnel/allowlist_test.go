@@ -0,0 +1,31 @@
+package tunnel
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestAllowlist(t *testing.T) {
+	allowlist, err := NewAllowlist([]string{"example.com:443", "*.Internal.net:*", "[::1]:22"})
+	require.NoError(t, err)
+
+	for dst, allowed := range map[string]bool{
+		"example.com:443":      true,
+		"EXAMPLE.com:443":      true,
+		"example.com:80":       false,
+		"www.example.com:443":  false,
+		"db.internal.net:5432": true,
+		"a.b.internal.net:80":  true,
+		"internal.net:80":      false,
+		"[::1]:22":             true,
+		"[::1]:23":             false,
+		"example.com":          false,
+	} {
+		require.Equal(t, allowed, allowlist.Allowed(dst), dst)
+	}
+
+	for _, dst := range []string{"example.com", ":443", "example.com:", "*:443", "a.*.com:443"} {
+		_, err = NewAllowlist([]string{dst})
+		require.ErrorIs(t, err, ErrBadDestination, dst)
+	}
+}
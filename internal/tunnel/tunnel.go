@@ -0,0 +1,74 @@
+package tunnel
+
+import (
+	"at/internal/server/tcp"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+var ErrIdle = errors.New("no data in either direction for too long")
+
+// Pipe relays data between the client and the upstream in both directions as is. It returns
+// as soon as both sides close their writing halves, either side fails, or there's no data in
+// either direction for the idle timeout. Connections aren't closed
+func Pipe(client, upstream tcp.Client, idle time.Duration) error {
+	var (
+		lastActivity atomic.Int64
+		errs         = make(chan error, 2)
+	)
+
+	lastActivity.Store(time.Now().UnixNano())
+	client.SetReadTimeout(idle)
+	upstream.SetReadTimeout(idle)
+
+	relay := func(from, to tcp.Client) {
+		for {
+			data, err := from.Read()
+			switch {
+			case err == nil:
+			case isTimeout(err):
+				// one side might be silent for long, as long as the other one is talking
+				if time.Since(time.Unix(0, lastActivity.Load())) < idle {
+					continue
+				}
+
+				errs <- ErrIdle
+				return
+			case errors.Is(err, io.EOF):
+				// the other direction keeps going until it's closed, too
+				errs <- to.CloseWrite()
+				return
+			default:
+				errs <- err
+				return
+			}
+
+			lastActivity.Store(time.Now().UnixNano())
+			if err = to.Write(data); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}
+
+	go relay(client, upstream)
+	go relay(upstream, client)
+
+	if err := <-errs; err != nil {
+		client.Interrupt()
+		upstream.Interrupt()
+		<-errs
+
+		return err
+	}
+
+	return <-errs
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
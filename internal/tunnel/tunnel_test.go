@@ -0,0 +1,87 @@
+package tunnel
+
+import (
+	"at/internal/server/tcp"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// pair returns both ends of a loopback TCP connection
+func pair(t *testing.T) (local, remote net.Conn) {
+	sock, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = sock.Close() }()
+
+	local, err = net.Dial("tcp", sock.Addr().String())
+	require.NoError(t, err)
+	remote, err = sock.Accept()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = local.Close()
+		_ = remote.Close()
+	})
+
+	return local, remote
+}
+
+func newClient(conn net.Conn) tcp.Client {
+	return tcp.NewClient(conn, time.Second, time.Second, make([]byte, 64))
+}
+
+func TestPipe(t *testing.T) {
+	t.Run("relay and half close", func(t *testing.T) {
+		client, clientSide := pair(t)
+		upstream, upstreamSide := pair(t)
+
+		done := make(chan error)
+		go func() {
+			done <- Pipe(newClient(clientSide), newClient(upstreamSide), time.Second)
+		}()
+
+		_, err := client.Write([]byte("ping"))
+		require.NoError(t, err)
+		require.NoError(t, client.(*net.TCPConn).CloseWrite())
+
+		received, err := io.ReadAll(upstream)
+		require.NoError(t, err)
+		require.Equal(t, "ping", string(received))
+
+		// the upstream still can respond after the client is done
+		_, err = upstream.Write([]byte("pong"))
+		require.NoError(t, err)
+		require.NoError(t, upstream.Close())
+
+		received, err = io.ReadAll(client)
+		require.NoError(t, err)
+		require.Equal(t, "pong", string(received))
+		require.NoError(t, <-done)
+	})
+
+	t.Run("idle", func(t *testing.T) {
+		client, clientSide := pair(t)
+		_, upstreamSide := pair(t)
+
+		done := make(chan error)
+		go func() {
+			done <- Pipe(newClient(clientSide), newClient(upstreamSide), 100*time.Millisecond)
+		}()
+
+		// activity in one direction keeps the tunnel open
+		for i := 0; i < 4; i++ {
+			_, err := client.Write([]byte("ping"))
+			require.NoError(t, err)
+			time.Sleep(50 * time.Millisecond)
+		}
+
+		select {
+		case err := <-done:
+			require.FailNow(t, "tunnel closed early", err)
+		default:
+		}
+
+		require.ErrorIs(t, <-done, ErrIdle)
+	})
+}
@@ -5,6 +5,7 @@ import (
 	"at/internal/server/tcp"
 	"context"
 	"encoding/binary"
+	"errors"
 	"log"
 	"net"
 	"sync"
@@ -56,6 +57,11 @@ func (p *ProxyListener) Listen(sock net.Listener) {
 		})
 
 		log.Println("error: tcp: proxy listener:", err)
+		if errors.Is(err, net.ErrClosed) {
+			// the listener can't be restarted, once it's closed
+			return
+		}
+
 		log.Println("tcp: proxy listener: re-starting listener")
 		// TODO: in case proxy listener socket is somehow dead and unusable anymore, we'll just
 		//  spam in the console with these two lines. Fix this somehow
@@ -18,11 +18,10 @@ func (s *Server) Serve(masterSock, proxySock net.Listener) error {
 }
 
 func (s *Server) serveProxyServers(proxySock net.Listener) {
-	for {
-		_ = tcp.Run(context.Background(), proxySock, func(conn net.Conn) {
-			s.proxyServers = append(s.proxyServers, conn)
-		})
-	}
+	// Run returns only once the listener is closed, so there's nothing to restart
+	_ = tcp.Run(context.Background(), proxySock, func(conn net.Conn) {
+		s.proxyServers = append(s.proxyServers, conn)
+	})
 }
 
 func